@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// APIKeys authenticates bearer API keys, sent as `Authorization:
+// Bearer <key>` or `X-API-Key: <key>`. Each key has a name, which is
+// used as the Principal ID.
+//
+// Keys can be replaced at any time with SetKeys (eg. when they are
+// rotated in Vault).
+type APIKeys struct {
+	mu   sync.RWMutex
+	keys map[[sha256.Size]byte]string
+}
+
+// NewAPIKeys creates APIKeys with keys, a map of key name to key.
+func NewAPIKeys(keys map[string]string) *APIKeys {
+	a := &APIKeys{}
+	a.SetKeys(keys)
+	return a
+}
+
+// ParseAPIKeys parses a comma-separated list of `name:key` pairs.
+func ParseAPIKeys(s string) (map[string]string, error) {
+	keys := map[string]string{}
+	for i, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, key, ok := strings.Cut(pair, ":")
+		if !ok || name == "" || key == "" {
+			// Don't include the pair in the error, it may be a key
+			return nil, fmt.Errorf("invalid API key #%d, expected name:key", i+1)
+		}
+		keys[name] = key
+	}
+	return keys, nil
+}
+
+// SetKeys replaces the keys, a map of key name to key.
+func (a *APIKeys) SetKeys(keys map[string]string) {
+	// Keys are looked up by hash, so that lookups don't leak
+	// anything about valid keys through timing.
+	hashed := make(map[[sha256.Size]byte]string, len(keys))
+	for name, key := range keys {
+		hashed[sha256.Sum256([]byte(key))] = name
+	}
+
+	a.mu.Lock()
+	a.keys = hashed
+	a.mu.Unlock()
+}
+
+// Authenticate is part of Authenticator
+func (a *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		var ok bool
+		key, ok = bearerToken(r)
+		// Leave JWTs to a JWT authenticator
+		if !ok || looksLikeJWT(key) {
+			return nil, ErrNoCredentials
+		}
+	}
+
+	a.mu.RLock()
+	name, found := a.keys[sha256.Sum256([]byte(key))]
+	a.mu.RUnlock()
+
+	if !found {
+		return nil, fmt.Errorf("%w: unknown API key", ErrInvalidCredentials)
+	}
+
+	return &Principal{ID: name, Method: "api_key"}, nil
+}
+
+// Challenge is part of Challenger
+func (a *APIKeys) Challenge(realm string) string {
+	return bearerChallenge(realm)
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func bearerChallenge(realm string) string {
+	return "Bearer realm=" + strconv.Quote(realm)
+}
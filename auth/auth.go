@@ -0,0 +1,200 @@
+// Package auth provides authentication middleware, with pluggable
+// Authenticators for HTTP basic auth (htpasswd files), bearer API
+// keys and JWTs.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/theplant/appkit/log"
+	"github.com/theplant/appkit/logtracing"
+)
+
+// Principal is an authenticated user or client.
+type Principal struct {
+	// ID identifies the principal, eg. a username, the name of an API
+	// key, or the subject of a JWT.
+	ID string
+
+	// Method is how the principal was authenticated, eg. `basic`,
+	// `api_key` or `jwt`.
+	Method string
+
+	// Claims are the claims of a JWT.
+	Claims map[string]interface{}
+}
+
+type key int
+
+const principalKey key = iota
+
+// Context installs a Principal in the returned context.
+func Context(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// FromContext returns the Principal authenticated by Middleware.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey).(*Principal)
+	return p, ok && p != nil
+}
+
+// ErrNoCredentials is returned by an Authenticator when a request
+// doesn't have the kind of credentials it authenticates.
+var ErrNoCredentials = errors.New("no credentials")
+
+// ErrInvalidCredentials is returned by an Authenticator when a
+// request's credentials are wrong.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrUnknownUser is returned by an Authenticator when a request's
+// credentials are for a user it doesn't know, so that a Chain tries
+// the next Authenticator (eg. another source of basic auth users). It
+// wraps ErrInvalidCredentials.
+var ErrUnknownUser = fmt.Errorf("%w: unknown user", ErrInvalidCredentials)
+
+// Authenticator authenticates requests.
+type Authenticator interface {
+	// Authenticate returns the Principal that made the request.
+	// Returns ErrNoCredentials if the request doesn't have the kind
+	// of credentials the Authenticator handles, and any other error
+	// if it does, but they aren't valid.
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Challenger is implemented by Authenticators that want to add a
+// challenge to the `WWW-Authenticate` header of `401 Unauthorized`
+// responses.
+type Challenger interface {
+	Challenge(realm string) string
+}
+
+// Chain is an Authenticator that tries each Authenticator in turn,
+// until one finds credentials it handles, for a user it knows (see
+// ErrUnknownUser).
+type Chain []Authenticator
+
+// Authenticate is part of Authenticator
+func (c Chain) Authenticate(r *http.Request) (*Principal, error) {
+	var unknownUser error
+	for _, a := range c {
+		p, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if errors.Is(err, ErrUnknownUser) {
+			if unknownUser == nil {
+				unknownUser = err
+			}
+			continue
+		}
+		return p, err
+	}
+	if unknownUser != nil {
+		return nil, unknownUser
+	}
+	return nil, ErrNoCredentials
+}
+
+// Challenge is part of Challenger
+func (c Chain) Challenge(realm string) string {
+	var challenges []string
+	for _, a := range c {
+		if ch, ok := a.(Challenger); ok {
+			if challenge := ch.Challenge(realm); challenge != "" && !slices.Contains(challenges, challenge) {
+				challenges = append(challenges, challenge)
+			}
+		}
+	}
+	return strings.Join(challenges, ", ")
+}
+
+// Config is configuration for Middleware.
+type Config struct {
+	// Authenticator is required. Use a Chain to accept several kinds
+	// of credentials.
+	Authenticator Authenticator
+
+	// Realm is sent in `WWW-Authenticate` challenges. Defaults to
+	// `Restricted`.
+	Realm string
+
+	// Optional allows requests without credentials through,
+	// unauthenticated (requests with invalid credentials are still
+	// rejected).
+	Optional bool
+
+	// Skip, if set, exempts requests from authentication (eg. health
+	// checks).
+	Skip func(r *http.Request) bool
+}
+
+// Middleware authenticates requests with cfg.Authenticator, and
+// rejects requests that can't be authenticated with `401
+// Unauthorized`.
+//
+// The authenticated Principal is installed in the request context
+// (see FromContext), recorded on the request's logtracing span as
+// `auth.principal` and `auth.method`, and added to the request's
+// logger as `principal`.
+func Middleware(cfg Config) func(http.Handler) http.Handler {
+	if cfg.Authenticator == nil {
+		panic("appkit/auth.Middleware: no authenticator configured")
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = "Restricted"
+	}
+
+	challenge := ""
+	if ch, ok := cfg.Authenticator.(Challenger); ok {
+		challenge = ch.Challenge(cfg.Realm)
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cfg.Skip != nil && cfg.Skip(r) {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := r.Context()
+			logger := log.ForceContext(ctx)
+
+			p, err := cfg.Authenticator.Authenticate(r)
+			if errors.Is(err, ErrNoCredentials) && cfg.Optional {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			if err != nil {
+				logtracing.AppendSpanKVs(ctx, "auth.error", err.Error())
+				logger.Warn().Log(
+					"msg", fmt.Sprintf("authentication failed: %v", err),
+					"during", "appkit/auth.Middleware",
+					"err", err,
+				)
+
+				if challenge != "" {
+					w.Header().Set("WWW-Authenticate", challenge)
+				}
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			logtracing.AppendSpanKVs(ctx,
+				"auth.principal", p.ID,
+				"auth.method", p.Method,
+			)
+
+			ctx = Context(ctx, p)
+			ctx = log.Context(ctx, logger.With("principal", p.ID))
+
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
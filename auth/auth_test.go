@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/theplant/appkit/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testHtpasswd(t *testing.T) *Htpasswd {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewHtpasswd(strings.NewReader(fmt.Sprintf("# users\n\nalice:%s\n", hash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestNewHtpasswd_Invalid(t *testing.T) {
+	for _, file := range []string{
+		"alice",
+		":$2y$05$abc",
+		"alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+	} {
+		if _, err := NewHtpasswd(strings.NewReader(file)); err == nil {
+			t.Errorf("expected error for %q", file)
+		}
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	h := testHtpasswd(t)
+
+	cases := []struct {
+		username, password string
+		err                error
+	}{
+		{"alice", "secret", nil},
+		{"alice", "wrong", ErrInvalidCredentials},
+		{"bob", "secret", ErrUnknownUser},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(c.username, c.password)
+
+		p, err := h.Authenticate(r)
+		if !errorIs(err, c.err) {
+			t.Errorf("%s:%s: expected error %v, got %v", c.username, c.password, c.err, err)
+			continue
+		}
+		if err == nil && (p.ID != "alice" || p.Method != "basic") {
+			t.Errorf("unexpected principal %+v", p)
+		}
+	}
+
+	if _, err := h.Authenticate(httptest.NewRequest("GET", "/", nil)); err != ErrNoCredentials {
+		t.Errorf("expected ErrNoCredentials, got %v", err)
+	}
+}
+
+func TestChain_BasicAuthenticators(t *testing.T) {
+	chain := Chain{testHtpasswd(t), StaticBasic{Username: "ci", Password: "ci-password"}}
+
+	cases := []struct {
+		username, password string
+		err                error
+	}{
+		{"alice", "secret", nil},
+		// users unknown to the htpasswd file are tried with the next
+		// authenticator...
+		{"ci", "ci-password", nil},
+		// ...and wrong passwords aren't
+		{"alice", "ci-password", ErrInvalidCredentials},
+		{"ci", "wrong", ErrInvalidCredentials},
+		{"bob", "secret", ErrUnknownUser},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(c.username, c.password)
+
+		p, err := chain.Authenticate(r)
+		if !errorIs(err, c.err) {
+			t.Errorf("%s:%s: expected error %v, got %v", c.username, c.password, c.err, err)
+			continue
+		}
+		if err == nil && p.ID != c.username {
+			t.Errorf("unexpected principal %+v", p)
+		}
+		if errors.Is(err, ErrUnknownUser) && !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("expected ErrUnknownUser to be ErrInvalidCredentials")
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	keys, err := ParseAPIKeys("ci:key-1, deploy:key-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAPIKeys(keys)
+
+	cases := []struct {
+		header, value string
+		id            string
+		err           error
+	}{
+		{"Authorization", "Bearer key-1", "ci", nil},
+		{"Authorization", "bearer key-2", "deploy", nil},
+		{"X-API-Key", "key-2", "deploy", nil},
+		{"Authorization", "Bearer wrong", "", ErrInvalidCredentials},
+		{"Authorization", "Bearer a.b.c", "", ErrNoCredentials},
+		{"Authorization", "Basic YTpi", "", ErrNoCredentials},
+		{"", "", "", ErrNoCredentials},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+
+		p, err := a.Authenticate(r)
+		if !errorIs(err, c.err) {
+			t.Errorf("%s: %s: expected error %v, got %v", c.header, c.value, c.err, err)
+			continue
+		}
+		if err == nil && (p.ID != c.id || p.Method != "api_key") {
+			t.Errorf("%s: %s: unexpected principal %+v", c.header, c.value, p)
+		}
+	}
+
+	a.SetKeys(map[string]string{"rotated": "key-3"})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-API-Key", "key-1")
+	if _, err := a.Authenticate(r); !errorIs(err, ErrInvalidCredentials) {
+		t.Errorf("expected rotated key to be rejected, got %v", err)
+	}
+}
+
+func TestParseAPIKeys_Invalid(t *testing.T) {
+	_, err := ParseAPIKeys("ci:key-1,just-a-key")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if strings.Contains(err.Error(), "just-a-key") {
+		t.Errorf("error leaks key: %v", err)
+	}
+}
+
+func protected(cfg Config) http.Handler {
+	return log.WithLogger(log.NewNopLogger())(Middleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := FromContext(r.Context())
+		if !ok {
+			_, _ = io.WriteString(w, "anonymous")
+			return
+		}
+		_, _ = io.WriteString(w, p.Method+":"+p.ID)
+	})))
+}
+
+func TestMiddleware(t *testing.T) {
+	cfg := Config{
+		Authenticator: Chain{
+			testHtpasswd(t),
+			NewAPIKeys(map[string]string{"ci": "key-1"}),
+		},
+		Realm: "Test",
+		Skip: func(r *http.Request) bool {
+			return r.URL.Path == "/healthz"
+		},
+	}
+
+	cases := []struct {
+		name     string
+		optional bool
+		path     string
+		setup    func(r *http.Request)
+		code     int
+		body     string
+	}{
+		{
+			name:  "basic",
+			setup: func(r *http.Request) { r.SetBasicAuth("alice", "secret") },
+			code:  200,
+			body:  "basic:alice",
+		},
+		{
+			name:  "api key",
+			setup: func(r *http.Request) { r.Header.Set("Authorization", "Bearer key-1") },
+			code:  200,
+			body:  "api_key:ci",
+		},
+		{
+			name: "no credentials",
+			code: 401,
+		},
+		{
+			name:  "invalid credentials",
+			setup: func(r *http.Request) { r.SetBasicAuth("alice", "wrong") },
+			code:  401,
+		},
+		{
+			name:     "optional, no credentials",
+			optional: true,
+			code:     200,
+			body:     "anonymous",
+		},
+		{
+			name:     "optional, invalid credentials",
+			optional: true,
+			setup:    func(r *http.Request) { r.Header.Set("X-API-Key", "wrong") },
+			code:     401,
+		},
+		{
+			name: "skipped",
+			path: "/healthz",
+			code: 200,
+			body: "anonymous",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := cfg
+			cfg.Optional = c.optional
+
+			path := c.path
+			if path == "" {
+				path = "/"
+			}
+			r := httptest.NewRequest("GET", path, nil)
+			if c.setup != nil {
+				c.setup(r)
+			}
+
+			rw := httptest.NewRecorder()
+			protected(cfg).ServeHTTP(rw, r)
+
+			if rw.Code != c.code {
+				t.Fatalf("expected %d, got %d", c.code, rw.Code)
+			}
+
+			if c.code == 401 {
+				expected := `Basic realm="Test", Bearer realm="Test"`
+				if got := rw.Header().Get("WWW-Authenticate"); got != expected {
+					t.Errorf("expected challenge %q, got %q", expected, got)
+				}
+			} else if rw.Body.String() != c.body {
+				t.Errorf("expected body %q, got %q", c.body, rw.Body.String())
+			}
+		})
+	}
+}
+
+func errorIs(err, target error) bool {
+	if target == nil {
+		return err == nil
+	}
+	return errors.Is(err, target)
+}
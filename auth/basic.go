@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd authenticates HTTP basic auth credentials against bcrypt
+// password hashes, as in an Apache htpasswd file (created with
+// `htpasswd -B`).
+type Htpasswd struct {
+	hashes map[string][]byte
+}
+
+// dummyHash is compared against when a username isn't found, so that
+// unknown usernames take as long to reject as wrong passwords.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	return hash
+})
+
+// LoadHtpasswd reads an htpasswd file.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return NewHtpasswd(f)
+}
+
+// NewHtpasswd parses `username:hash` lines. Blank lines and lines
+// starting with `#` are ignored. Returns an error if a hash isn't a
+// bcrypt hash.
+func NewHtpasswd(r io.Reader) (*Htpasswd, error) {
+	h := &Htpasswd{hashes: map[string][]byte{}}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(text, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("htpasswd line %d: expected username:hash", line)
+		}
+
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("htpasswd line %d: only bcrypt hashes are supported: %w", line, err)
+		}
+
+		h.hashes[username] = []byte(hash)
+	}
+
+	return h, scanner.Err()
+}
+
+// Authenticate is part of Authenticator
+func (h *Htpasswd) Authenticate(r *http.Request) (*Principal, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	hash, found := h.hashes[username]
+	if !found {
+		hash = dummyHash()
+	}
+
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if !found {
+		return nil, fmt.Errorf("%w %q", ErrUnknownUser, username)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: wrong password for %q", ErrInvalidCredentials, username)
+	}
+
+	return &Principal{ID: username, Method: "basic"}, nil
+}
+
+// Challenge is part of Challenger
+func (h *Htpasswd) Challenge(realm string) string {
+	return basicChallenge(realm)
+}
+
+// StaticBasic authenticates a single HTTP basic auth username and
+// password.
+type StaticBasic struct {
+	Username string
+	Password string
+}
+
+// Authenticate is part of Authenticator
+func (s StaticBasic) Authenticate(r *http.Request) (*Principal, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(s.Username)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.Password)) == 1
+	if !userOK {
+		return nil, fmt.Errorf("%w %q", ErrUnknownUser, username)
+	}
+	if !passwordOK {
+		return nil, fmt.Errorf("%w: wrong password for %q", ErrInvalidCredentials, username)
+	}
+
+	return &Principal{ID: username, Method: "basic"}, nil
+}
+
+// Challenge is part of Challenger
+func (s StaticBasic) Challenge(realm string) string {
+	return basicChallenge(realm)
+}
+
+func basicChallenge(realm string) string {
+	return "Basic realm=" + strconv.Quote(realm)
+}
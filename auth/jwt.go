@@ -0,0 +1,351 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// JWKS is a JSON Web Key Set of RSA and EC public keys, used to
+// verify JWT signatures.
+type JWKS struct {
+	keys []jwk
+}
+
+type jwk struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+type rawJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS reads a JWKS file.
+func LoadJWKS(path string) (*JWKS, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(b)
+}
+
+// ParseJWKS parses a JWKS (`{"keys":[...]}`). Keys that aren't for
+// signatures are ignored.
+func ParseJWKS(b []byte) (*JWKS, error) {
+	var raw struct {
+		Keys []rawJWK `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS: %w", err)
+	}
+
+	jwks := &JWKS{}
+	for i, k := range raw.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing JWKS key #%d (kid %q): %w", i+1, k.Kid, err)
+		}
+		jwks.keys = append(jwks.keys, jwk{kid: k.Kid, alg: k.Alg, key: key})
+	}
+
+	if len(jwks.keys) == 0 {
+		return nil, errors.New("no signature keys in JWKS")
+	}
+
+	return jwks, nil
+}
+
+func (k rawJWK) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid e")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %w", err)
+		}
+
+		key := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+type jwtAlgorithm struct {
+	hash crypto.Hash
+	// kty of keys that can verify the algorithm
+	kty string
+	pss bool
+}
+
+// Only asymmetric algorithms are supported, so that a public key can
+// never be used as an HMAC secret.
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"RS256": {crypto.SHA256, "RSA", false},
+	"RS384": {crypto.SHA384, "RSA", false},
+	"RS512": {crypto.SHA512, "RSA", false},
+	"PS256": {crypto.SHA256, "RSA", true},
+	"PS384": {crypto.SHA384, "RSA", true},
+	"PS512": {crypto.SHA512, "RSA", true},
+	"ES256": {crypto.SHA256, "EC", false},
+	"ES384": {crypto.SHA384, "EC", false},
+	"ES512": {crypto.SHA512, "EC", false},
+}
+
+func (a jwtAlgorithm) verify(key crypto.PublicKey, signed, sig []byte) bool {
+	h := a.hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if a.kty != "RSA" {
+			return false
+		}
+		if a.pss {
+			return rsa.VerifyPSS(key, a.hash, digest, sig, nil) == nil
+		}
+		return rsa.VerifyPKCS1v15(key, a.hash, digest, sig) == nil
+
+	case *ecdsa.PublicKey:
+		if a.kty != "EC" {
+			return false
+		}
+		// JWS ECDSA signatures are r || s, each the size of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+
+	return false
+}
+
+// JWT authenticates bearer JWTs (`Authorization: Bearer <jwt>`),
+// signed with a key in Keys. The JWT's `sub` claim is used as the
+// Principal ID, and all claims are available as Principal.Claims.
+//
+// JWTs must have an `exp` claim. `nbf` is checked if present.
+type JWT struct {
+	Keys *JWKS
+
+	// Issuer, if set, must match the `iss` claim.
+	Issuer string
+
+	// Audience, if set, must be in the `aud` claim.
+	Audience string
+
+	// Leeway allows for clock skew when checking `exp` and `nbf`.
+	Leeway time.Duration
+
+	// now is used in tests
+	now func() time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Authenticate is part of Authenticator
+func (j *JWT) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok || !looksLikeJWT(token) {
+		return nil, ErrNoCredentials
+	}
+
+	claims, err := j.Verify(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, fmt.Errorf("%w: JWT has no subject", ErrInvalidCredentials)
+	}
+
+	return &Principal{ID: sub, Method: "jwt", Claims: claims}, nil
+}
+
+// Challenge is part of Challenger
+func (j *JWT) Challenge(realm string) string {
+	return bearerChallenge(realm)
+}
+
+// Verify verifies the signature and claims of token, returning the
+// claims.
+func (j *JWT) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %w", err)
+	}
+
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed JWT signature")
+	}
+
+	if !j.verifySignature(header, alg, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errors.New("invalid JWT signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %w", err)
+	}
+
+	if err := j.verifyClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (j *JWT) verifySignature(header jwtHeader, alg jwtAlgorithm, signed, sig []byte) bool {
+	for _, k := range j.Keys.keys {
+		if header.Kid != "" && k.kid != header.Kid {
+			continue
+		}
+		if k.alg != "" && k.alg != header.Alg {
+			continue
+		}
+		if alg.verify(k.key, signed, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *JWT) verifyClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	if j.now != nil {
+		now = j.now()
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("JWT has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(j.Leeway)) {
+		return errors.New("JWT has expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(j.Leeway).Before(time.Unix(int64(nbf), 0)) {
+			return errors.New("JWT is not valid yet")
+		}
+	}
+
+	if j.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != j.Issuer {
+			return fmt.Errorf("JWT issuer %q is not %q", iss, j.Issuer)
+		}
+	}
+
+	if j.Audience != "" && !hasAudience(claims["aud"], j.Audience) {
+		return fmt.Errorf("JWT audience is not %q", j.Audience)
+	}
+
+	return nil
+}
+
+// hasAudience checks an `aud` claim, which can be a string or an
+// array of strings.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var (
+	testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testNow       = time.Unix(1700000000, 0)
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func testJWKS(t *testing.T) *JWKS {
+	jwks := fmt.Sprintf(`{"keys":[
+		{"kty":"RSA","kid":"rsa","use":"sig","n":%q,"e":%q},
+		{"kty":"EC","kid":"ec","crv":"P-256","x":%q,"y":%q},
+		{"kty":"RSA","kid":"enc","use":"enc","n":"AQAB","e":"AQAB"}
+	]}`,
+		b64(testRSAKey.N.Bytes()), b64(big.NewInt(int64(testRSAKey.E)).Bytes()),
+		b64(testECKey.X.FillBytes(make([]byte, 32))), b64(testECKey.Y.FillBytes(make([]byte, 32))),
+	)
+
+	keys, err := ParseJWKS([]byte(jwks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func signJWT(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+
+	digest := func(h crypto.Hash) []byte {
+		hh := h.New()
+		hh.Write([]byte(signed))
+		return hh.Sum(nil)
+	}
+
+	var sig []byte
+	var err error
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, testRSAKey, crypto.SHA256, digest(crypto.SHA256))
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, testRSAKey, crypto.SHA256, digest(crypto.SHA256), nil)
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, testECKey, digest(crypto.SHA256))
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	default:
+		sig = []byte("signature")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func TestJWT(t *testing.T) {
+	j := &JWT{
+		Keys:     testJWKS(t),
+		Issuer:   "https://issuer.example.com",
+		Audience: "api",
+		Leeway:   time.Minute,
+		now:      func() time.Time { return testNow },
+	}
+
+	valid := func(overrides map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"sub": "user-1",
+			"iss": "https://issuer.example.com",
+			"aud": []string{"web", "api"},
+			"exp": testNow.Add(time.Hour).Unix(),
+			"nbf": testNow.Add(-time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", signJWT(t, "RS256", "rsa", valid(nil)), true},
+		{"PS256", signJWT(t, "PS256", "rsa", valid(nil)), true},
+		{"ES256", signJWT(t, "ES256", "ec", valid(nil)), true},
+		{"no kid", signJWT(t, "ES256", "", valid(nil)), true},
+		{"string audience", signJWT(t, "RS256", "rsa", valid(map[string]interface{}{"aud": "api"})), true},
+		{"within leeway", signJWT(t, "RS256", "rsa", valid(map[string]interface{}{"exp": testNow.Add(-30 * time.Second).Unix()})), true},
+
+		{"wrong kid", signJWT(t, "RS256", "ec", valid(nil)), false},
+		{"none", signJWT(t, "none", "", valid(nil)), false},
+		{"HS256", signJWT(t, "HS256", "rsa", valid(nil)), false},
+		{"expired", signJWT(t, "RS256", "rsa", valid(map[string]interface{}{"exp": testNow.Add(-2 * time.Minute).Unix()})), false},
+		{"no expiry", signJWT(t, "RS256", "rsa", valid(map[string]interface{}{"exp": nil})), false},
+		{"not yet valid", signJWT(t, "RS256", "rsa", valid(map[string]interface{}{"nbf": testNow.Add(2 * time.Minute).Unix()})), false},
+		{"wrong issuer", signJWT(t, "RS256", "rsa", valid(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+		{"wrong audience", signJWT(t, "RS256", "rsa", valid(map[string]interface{}{"aud": "web"})), false},
+		{"no subject", signJWT(t, "RS256", "rsa", valid(map[string]interface{}{"sub": nil})), false},
+		{"tampered", signJWT(t, "RS256", "rsa", valid(nil))[1:], false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", "Bearer "+c.token)
+
+			p, err := j.Authenticate(r)
+			if !c.ok {
+				if !errorIs(err, ErrInvalidCredentials) {
+					t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.ID != "user-1" || p.Method != "jwt" || p.Claims["iss"] != "https://issuer.example.com" {
+				t.Errorf("unexpected principal %+v", p)
+			}
+		})
+	}
+}
+
+func TestParseJWKS_Invalid(t *testing.T) {
+	for _, jwks := range []string{
+		`not json`,
+		`{"keys":[]}`,
+		`{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`,
+		`{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`,
+		`{"keys":[{"kty":"RSA","n":"","e":"AQAB"}]}`,
+	} {
+		if _, err := ParseJWKS([]byte(jwks)); err == nil {
+			t.Errorf("expected error for %s", jwks)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package contexts
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIPConfig is configuration for resolving the IP address of
+// the client that made a request, when the service is behind one or
+// more proxies (eg. load-balancers).
+type ClientIPConfig struct {
+	// TrustedProxies is a list of CIDRs (eg. `10.0.0.0/8`) or single
+	// IP addresses of proxies whose forwarding headers are trusted.
+	// Forwarding headers on requests from any other address are
+	// ignored, since any client can set them.
+	TrustedProxies []string
+
+	// Headers are the forwarding headers to read, in order of
+	// preference. Supported headers are `Forwarded` (RFC 7239),
+	// `X-Forwarded-For` and `X-Real-IP`. Defaults to all three, in
+	// that order.
+	Headers []string
+}
+
+// ClientIPResolver resolves the IP address of the client that made a
+// request, only trusting forwarding headers set by trusted proxies.
+type ClientIPResolver struct {
+	trusted []netip.Prefix
+	headers []string
+}
+
+var defaultClientIPHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Real-Ip"}
+
+// DefaultClientIPResolver trusts proxies on loopback and private
+// network (RFC 1918 and RFC 4193) addresses. It is used to resolve
+// client IPs for requests that don't have a client IP in their
+// context (see WithClientIP).
+var DefaultClientIPResolver = mustClientIPResolver(ClientIPConfig{
+	TrustedProxies: []string{
+		"127.0.0.0/8",
+		"::1/128",
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"fc00::/7",
+	},
+})
+
+// NewClientIPResolver creates a ClientIPResolver. Returns an error if
+// a trusted proxy is not a valid CIDR or IP address, or a header is
+// not supported.
+func NewClientIPResolver(cfg ClientIPConfig) (*ClientIPResolver, error) {
+	resolver := &ClientIPResolver{}
+
+	for _, p := range cfg.TrustedProxies {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		if strings.Contains(p, "/") {
+			prefix, err := netip.ParsePrefix(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy CIDR %q: %w", p, err)
+			}
+			resolver.trusted = append(resolver.trusted, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy IP %q: %w", p, err)
+		}
+		addr = addr.Unmap()
+		resolver.trusted = append(resolver.trusted, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	headers := cfg.Headers
+	if len(headers) == 0 {
+		headers = defaultClientIPHeaders
+	}
+	for _, h := range headers {
+		h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+		switch h {
+		case "Forwarded", "X-Forwarded-For", "X-Real-Ip":
+			resolver.headers = append(resolver.headers, h)
+		default:
+			return nil, fmt.Errorf("unsupported client IP header %q", h)
+		}
+	}
+
+	return resolver, nil
+}
+
+func mustClientIPResolver(cfg ClientIPConfig) *ClientIPResolver {
+	r, err := NewClientIPResolver(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Resolve returns the IP address of the client that made r, or "" if
+// it can't be determined.
+//
+// If the request comes from a trusted proxy, the first forwarding
+// header (in Headers order) present in the request is used:
+// forwarded-for addresses are walked from right to left (ie. from
+// the closest proxy back towards the client), skipping trusted
+// proxies, and the first untrusted address is the client. If every
+// address is trusted, the left-most address is the client.
+func (c *ClientIPResolver) Resolve(r *http.Request) string {
+	remote, ok := parseIP(r.RemoteAddr)
+	if !ok {
+		return ""
+	}
+
+	if !c.isTrusted(remote) {
+		return remote.String()
+	}
+
+	for _, h := range c.headers {
+		var forwarded []string
+		switch h {
+		case "Forwarded":
+			forwarded = forwardedFor(r.Header.Values(h))
+		case "X-Forwarded-For":
+			forwarded = splitList(r.Header.Values(h))
+		case "X-Real-Ip":
+			forwarded = r.Header.Values(h)
+			if len(forwarded) > 1 {
+				// Only one value makes sense, don't guess
+				forwarded = nil
+			}
+		}
+
+		if len(forwarded) == 0 {
+			continue
+		}
+
+		return c.walk(remote, forwarded).String()
+	}
+
+	return remote.String()
+}
+
+// walk returns the right-most untrusted address in forwarded. If an
+// address can't be parsed, the chain of trust is broken and the last
+// trusted address is returned.
+func (c *ClientIPResolver) walk(remote netip.Addr, forwarded []string) netip.Addr {
+	client := remote
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip, ok := parseIP(forwarded[i])
+		if !ok {
+			return client
+		}
+
+		client = ip
+		if !c.isTrusted(ip) {
+			return ip
+		}
+	}
+	return client
+}
+
+func (c *ClientIPResolver) isTrusted(ip netip.Addr) bool {
+	for _, p := range c.trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP parses an IP address with an optional port (eg.
+// `192.0.2.1:1234`, `[2001:db8::1]:4711`, `2001:db8::1`).
+func parseIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// splitList splits comma-separated header values into a single list.
+func splitList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			list = append(list, strings.TrimSpace(item))
+		}
+	}
+	return list
+}
+
+// forwardedFor returns the `for` parameters of RFC 7239 `Forwarded`
+// header values, eg. `for=192.0.2.60;proto=http, for="[2001:db8::17]:4711"`.
+// Elements without a `for` parameter are returned as "" (an
+// unparseable address).
+func forwardedFor(values []string) []string {
+	var list []string
+	for _, element := range splitList(values) {
+		var forValue string
+		for _, pair := range strings.Split(element, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(k, "for") {
+				forValue = strings.Trim(v, `"`)
+			}
+		}
+		list = append(list, forValue)
+	}
+	return list
+}
+
+////////////////////////////////////////////////////////////
+
+// WithClientIP returns middleware that resolves the client IP of the
+// request with resolver, and stores it in the request context, for
+// use by ClientIP and ResolveClientIP.
+func WithClientIP(resolver *ClientIPResolver) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), clientIPKey, resolver.Resolve(r))
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ClientIP returns the client IP stored in the context by WithClientIP.
+func ClientIP(ctx context.Context) (string, bool) {
+	ip, ok := ctx.Value(clientIPKey).(string)
+	return ip, ok
+}
+
+// ResolveClientIP returns the client IP stored in the request context
+// by WithClientIP, or resolves it with DefaultClientIPResolver.
+func ResolveClientIP(r *http.Request) string {
+	if ip, ok := ClientIP(r.Context()); ok {
+		return ip
+	}
+	return DefaultClientIPResolver.Resolve(r)
+}
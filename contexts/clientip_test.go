@@ -0,0 +1,168 @@
+package contexts
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	resolver, err := NewClientIPResolver(ClientIPConfig{
+		TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		desc    string
+		remote  string
+		headers map[string][]string
+		want    string
+	}{
+		{
+			desc:   "untrusted remote, headers ignored",
+			remote: "203.0.113.9:1234",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"198.51.100.1"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			desc:   "trusted remote, no headers",
+			remote: "10.0.0.1:1234",
+			want:   "10.0.0.1",
+		},
+		{
+			desc:   "spoofed left-most X-Forwarded-For entry",
+			remote: "10.0.0.1:1234",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"198.51.100.1, 203.0.113.9", "10.0.0.2"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			desc:   "all X-Forwarded-For entries trusted",
+			remote: "10.0.0.1:1234",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"},
+			},
+			want: "10.0.0.3",
+		},
+		{
+			desc:   "invalid X-Forwarded-For entry breaks the chain",
+			remote: "10.0.0.1:1234",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"198.51.100.1, garbage, 10.0.0.2"},
+			},
+			want: "10.0.0.2",
+		},
+		{
+			desc:   "Forwarded preferred over X-Forwarded-For",
+			remote: "10.0.0.1:1234",
+			headers: map[string][]string{
+				"Forwarded":       {`for=198.51.100.1;proto=https, for="[2001:db8:cafe::17]:4711";by=10.0.0.1`},
+				"X-Forwarded-For": {"203.0.113.9"},
+			},
+			want: "2001:db8:cafe::17",
+		},
+		{
+			desc:   "Forwarded with trusted IPv6 proxy",
+			remote: "[2001:db8::1]:443",
+			headers: map[string][]string{
+				"Forwarded": {`For=198.51.100.1, for="[2001:db8::1]"`},
+			},
+			want: "198.51.100.1",
+		},
+		{
+			desc:   "X-Real-IP",
+			remote: "10.0.0.1:1234",
+			headers: map[string][]string{
+				"X-Real-Ip": {"198.51.100.1"},
+			},
+			want: "198.51.100.1",
+		},
+		{
+			desc:   "IPv4-mapped IPv6 remote",
+			remote: "[::ffff:10.0.0.1]:1234",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"198.51.100.1"},
+			},
+			want: "198.51.100.1",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = c.remote
+			for k, vs := range c.headers {
+				for _, v := range vs {
+					req.Header.Add(k, v)
+				}
+			}
+
+			if got := resolver.Resolve(req); got != c.want {
+				t.Errorf("want %q, got %q", c.want, got)
+			}
+		})
+	}
+}
+
+func TestClientIPResolverHeaders(t *testing.T) {
+	resolver, err := NewClientIPResolver(ClientIPConfig{
+		TrustedProxies: []string{"10.0.0.1"},
+		Headers:        []string{"x-real-ip"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("X-Real-IP", "198.51.100.2")
+
+	if got := resolver.Resolve(req); got != "198.51.100.2" {
+		t.Errorf("want 198.51.100.2, got %q", got)
+	}
+}
+
+func TestNewClientIPResolverInvalid(t *testing.T) {
+	cases := []ClientIPConfig{
+		{TrustedProxies: []string{"10.0.0.0/33"}},
+		{TrustedProxies: []string{"not-an-ip"}},
+		{Headers: []string{"X-Client-IP"}},
+	}
+
+	for _, c := range cases {
+		if _, err := NewClientIPResolver(c); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
+
+func TestWithClientIP(t *testing.T) {
+	resolver, _ := NewClientIPResolver(ClientIPConfig{})
+
+	var got string
+	var ok bool
+	h := WithClientIP(resolver)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok = ClientIP(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	// No trusted proxies => X-Forwarded-For is ignored
+	if !ok || got != "10.0.0.1" {
+		t.Errorf("want 10.0.0.1 in context, got %q (%v)", got, ok)
+	}
+
+	// Without WithClientIP, the default resolver trusts private networks
+	if ip := ResolveClientIP(req); ip != "198.51.100.1" {
+		t.Errorf("ResolveClientIP: want 198.51.100.1, got %q", ip)
+	}
+}
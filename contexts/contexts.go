@@ -7,7 +7,12 @@ import (
 
 type key int
 
-const statusKey key = iota
+const (
+	statusKey key = iota
+	requestTagsKey
+	clientIPKey
+	routeKey
+)
 
 ////////////////////////////////////////////////////////////
 
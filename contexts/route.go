@@ -0,0 +1,76 @@
+package contexts
+
+import (
+	"context"
+	"sync"
+)
+
+// route holds the route pattern matched for a request, so that a
+// router deep in the handler stack can tell middleware further out
+// (eg. logging and metrics) which route handled the request.
+type route struct {
+	mu      sync.Mutex
+	pattern string
+	onSet   []func(pattern string)
+}
+
+// ContextWithRoute returns a context holding a route that a router
+// can set with SetRoute. If ctx already holds a route, it is
+// returned unchanged, so that all handlers share the same route.
+func ContextWithRoute(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(routeKey).(*route); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, routeKey, &route{})
+}
+
+// SetRoute sets the route pattern (eg. `GET /users/{id}`) that
+// matched the request. Returns false (and does nothing) if there is
+// no route in the context.
+func SetRoute(ctx context.Context, pattern string) bool {
+	rt, ok := ctx.Value(routeKey).(*route)
+	if !ok {
+		return false
+	}
+
+	rt.mu.Lock()
+	rt.pattern = pattern
+	onSet := rt.onSet
+	rt.mu.Unlock()
+
+	for _, f := range onSet {
+		f(pattern)
+	}
+	return true
+}
+
+// OnRoute registers f to be called with the route pattern each time
+// it is set with SetRoute, so that middleware can follow a request as
+// it is routed (eg. to count requests in flight by route). Returns
+// false (and does nothing) if there is no route in the context.
+func OnRoute(ctx context.Context, f func(pattern string)) bool {
+	rt, ok := ctx.Value(routeKey).(*route)
+	if !ok {
+		return false
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.onSet = append(rt.onSet, f)
+	return true
+}
+
+// Route returns the route pattern that matched the request, or false
+// if no route has been set.
+func Route(ctx context.Context) (string, bool) {
+	rt, ok := ctx.Value(routeKey).(*route)
+	if !ok {
+		return "", false
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	return rt.pattern, rt.pattern != ""
+}
@@ -0,0 +1,50 @@
+package contexts
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRouteSharedWithOuterContext(t *testing.T) {
+	outer := ContextWithRoute(context.Background())
+
+	if _, ok := Route(outer); ok {
+		t.Fatal("Route: expected no route before SetRoute")
+	}
+
+	// Re-installing must not hide the outer route.
+	inner := ContextWithRoute(context.WithValue(outer, struct{}{}, 1))
+	if !SetRoute(inner, "GET /users/{id}") {
+		t.Fatal("SetRoute: no route in context")
+	}
+
+	if route, ok := Route(outer); !ok || route != "GET /users/{id}" {
+		t.Errorf("Route: want GET /users/{id}, got %q, %v", route, ok)
+	}
+}
+
+func TestSetRouteWithoutRoute(t *testing.T) {
+	if SetRoute(context.Background(), "/") {
+		t.Error("SetRoute: expected false without route in context")
+	}
+}
+
+func TestOnRoute(t *testing.T) {
+	ctx := ContextWithRoute(context.Background())
+
+	var patterns []string
+	if !OnRoute(ctx, func(pattern string) { patterns = append(patterns, pattern) }) {
+		t.Fatal("OnRoute: no route in context")
+	}
+
+	SetRoute(ctx, "/users/")
+	SetRoute(ctx, "GET /users/{id}")
+
+	if len(patterns) != 2 || patterns[0] != "/users/" || patterns[1] != "GET /users/{id}" {
+		t.Errorf("OnRoute: unexpected patterns %q", patterns)
+	}
+
+	if OnRoute(context.Background(), func(string) {}) {
+		t.Error("OnRoute: expected false without route in context")
+	}
+}
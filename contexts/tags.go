@@ -0,0 +1,66 @@
+package contexts
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// requestTags is a mutable set of tags shared by every handler of a
+// single request, so that middleware deeper in the stack can
+// annotate the request for middleware further out (eg. for metrics).
+type requestTags struct {
+	mu   sync.Mutex
+	tags map[string]string
+}
+
+// WithRequestTags is middleware that installs a set of request tags
+// in the request context (see ContextWithRequestTags).
+func WithRequestTags(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(ContextWithRequestTags(r.Context())))
+	})
+}
+
+// ContextWithRequestTags returns a context holding a set of request
+// tags that later handlers can add to with SetRequestTag. If ctx
+// already holds request tags, it is returned unchanged, so that all
+// handlers share the same set.
+func ContextWithRequestTags(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(requestTagsKey).(*requestTags); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, requestTagsKey, &requestTags{tags: map[string]string{}})
+}
+
+// SetRequestTag sets a tag on the request. Returns false (and does
+// nothing) if there are no request tags in the context.
+func SetRequestTag(ctx context.Context, key, value string) bool {
+	rt, ok := ctx.Value(requestTagsKey).(*requestTags)
+	if !ok {
+		return false
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.tags[key] = value
+	return true
+}
+
+// RequestTags returns a copy of the tags set on the request.
+func RequestTags(ctx context.Context) (map[string]string, bool) {
+	rt, ok := ctx.Value(requestTagsKey).(*requestTags)
+	if !ok {
+		return nil, false
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	tags := make(map[string]string, len(rt.tags))
+	for k, v := range rt.tags {
+		tags[k] = v
+	}
+	return tags, true
+}
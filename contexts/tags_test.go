@@ -0,0 +1,46 @@
+package contexts
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Tags set by an inner handler must be visible to the outer
+// middleware that installed them, after the request is handled.
+func TestRequestTagsSharedWithOuterMiddleware(t *testing.T) {
+	var outer context.Context
+
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Re-installing must not hide the outer set of tags.
+		ctx := ContextWithRequestTags(r.Context())
+		if !SetRequestTag(ctx, "timeout", "1") {
+			t.Fatal("SetRequestTag: no request tags in context")
+		}
+	})
+
+	h := WithRequestTags(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		outer = r.Context()
+		inner.ServeHTTP(w, r)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	tags, ok := RequestTags(outer)
+	if !ok {
+		t.Fatal("RequestTags: no request tags in context")
+	}
+	if tags["timeout"] != "1" {
+		t.Errorf("timeout tag: want 1, got %q", tags["timeout"])
+	}
+}
+
+func TestSetRequestTagWithoutTags(t *testing.T) {
+	if SetRequestTag(context.Background(), "k", "v") {
+		t.Error("SetRequestTag should report false without request tags in context")
+	}
+	if _, ok := RequestTags(context.Background()); ok {
+		t.Error("RequestTags should report false without request tags in context")
+	}
+}
@@ -29,6 +29,9 @@ type airbrakeNotifier struct {
 
 func (n *airbrakeNotifier) Notify(e interface{}, req *http.Request, context map[string]interface{}) {
 	notice := n.notifier.Notice(e, req, 1)
+	// the type of the notified value, rather than its stackError
+	// wrapper (see withStack)
+	notice.Errors[0].Type = errorType(e)
 	for k, v := range context {
 		notice.Context[k] = v
 	}
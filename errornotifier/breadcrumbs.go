@@ -0,0 +1,72 @@
+package errornotifier
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxBreadcrumbs limits the breadcrumbs kept for a request, older
+// breadcrumbs are dropped.
+const maxBreadcrumbs = 100
+
+// Breadcrumb is an event that happened before an error (eg. a
+// database query, or an outbound request), sent with notifications by
+// notifiers that support them.
+type Breadcrumb struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Category  string                 `json:"category,omitempty"`
+	Message   string                 `json:"message,omitempty"`
+	Level     string                 `json:"level,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+type breadcrumbs struct {
+	mu    sync.Mutex
+	trail []Breadcrumb
+}
+
+// ContextWithBreadcrumbs returns a context that collects breadcrumbs
+// added with AddBreadcrumb. Recover installs it in request contexts.
+func ContextWithBreadcrumbs(ctx context.Context) context.Context {
+	return context.WithValue(ctx, breadcrumbsKey, &breadcrumbs{})
+}
+
+// AddBreadcrumb adds b to the breadcrumbs of ctx (see
+// ContextWithBreadcrumbs), timestamped now if it has no timestamp. It
+// does nothing if ctx doesn't collect breadcrumbs.
+func AddBreadcrumb(ctx context.Context, b Breadcrumb) {
+	crumbs, ok := ctx.Value(breadcrumbsKey).(*breadcrumbs)
+	if !ok {
+		return
+	}
+
+	if b.Timestamp.IsZero() {
+		b.Timestamp = time.Now()
+	}
+
+	crumbs.mu.Lock()
+	defer crumbs.mu.Unlock()
+
+	if len(crumbs.trail) >= maxBreadcrumbs {
+		crumbs.trail = append(crumbs.trail[:0], crumbs.trail[1:]...)
+	}
+	crumbs.trail = append(crumbs.trail, b)
+}
+
+// Breadcrumbs returns the breadcrumbs of ctx, oldest first.
+func Breadcrumbs(ctx context.Context) []Breadcrumb {
+	if ctx == nil {
+		return nil
+	}
+
+	crumbs, ok := ctx.Value(breadcrumbsKey).(*breadcrumbs)
+	if !ok {
+		return nil
+	}
+
+	crumbs.mu.Lock()
+	defer crumbs.mu.Unlock()
+
+	return append([]Breadcrumb(nil), crumbs.trail...)
+}
@@ -0,0 +1,316 @@
+package errornotifier
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/theplant/appkit/monitoring"
+)
+
+const (
+	// DefaultDedupWindow is how long Dedup deduplicates notifications
+	// of an error, unless configured otherwise.
+	DefaultDedupWindow = time.Minute
+
+	// DefaultDedupPerMinute is the number of notifications of new
+	// errors Dedup sends per minute, unless configured otherwise.
+	DefaultDedupPerMinute = 60
+
+	// DefaultDedupStackFrames is the number of stack frames in Dedup's
+	// error fingerprints, unless configured otherwise.
+	DefaultDedupStackFrames = 3
+)
+
+// suppressedNotifications counts notifications that weren't sent, by
+// reason: `duplicate` or `rate_limit`.
+var suppressedNotifications = monitoring.NewCounter("error-notifications-suppressed", [1]string{"reason"})
+
+// DedupConfig configures Dedup.
+type DedupConfig struct {
+	// Window is how long notifications of the same error are
+	// deduplicated, and how often summaries of duplicates are sent,
+	// default DefaultDedupWindow.
+	Window time.Duration
+
+	// PerMinute limits the number of notifications of new errors sent
+	// per minute, default DefaultDedupPerMinute. Summaries don't count
+	// towards the limit.
+	PerMinute int
+
+	// StackFrames is the number of innermost stack frames that are
+	// part of an error's fingerprint, default DefaultDedupStackFrames.
+	StackFrames int
+
+	// Monitor counts suppressed notifications, if nil the request
+	// context's Monitor is used (see monitoring.ForceContext).
+	Monitor monitoring.Monitor
+}
+
+// Dedup returns a Notifier that protects n from floods of
+// notifications (eg. a broken dependency failing every request):
+//
+//   - Errors are fingerprinted by their type, their message (with
+//     numbers and IDs normalized) and the functions of their innermost
+//     stack frames. Only the first notification of an error is sent to
+//     n in each window, and later ones are suppressed.
+//   - At the end of each window, a summary of each error with
+//     suppressed notifications is sent to n, with the first
+//     notification's error, stack trace and context, and
+//     `occurrences` and `suppressed` counts in the context.
+//   - Notifications of new errors beyond the per-minute limit are
+//     suppressed, and summarized in one notification per window.
+//
+// Notifications sent to n have the error's `fingerprint` in their
+// context. Suppressed notifications are counted in the
+// `error-notifications-suppressed` measurement, tagged with their
+// `reason` (`duplicate` or `rate_limit`).
+//
+// The returned io.Closer sends the current summaries, and stops the
+// summarizing goroutine. It doesn't close n.
+func Dedup(n Notifier, cfg DedupConfig) (Notifier, io.Closer) {
+	if cfg.Window <= 0 {
+		cfg.Window = DefaultDedupWindow
+	}
+	if cfg.PerMinute <= 0 {
+		cfg.PerMinute = DefaultDedupPerMinute
+	}
+	if cfg.StackFrames <= 0 {
+		cfg.StackFrames = DefaultDedupStackFrames
+	}
+
+	d := &dedupNotifier{
+		notifier: n,
+		cfg:      cfg,
+		seen:     map[string]*dedupEntry{},
+		running:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go d.run()
+	return d, d
+}
+
+type dedupNotifier struct {
+	notifier Notifier
+	cfg      DedupConfig
+
+	mu   sync.Mutex
+	seen map[string]*dedupEntry
+	// the current per-minute budget
+	budgetStart time.Time
+	budgetUsed  int
+	// notifications suppressed by the budget in the current window
+	rateLimited int
+
+	closeOnce sync.Once
+	running   chan struct{}
+	done      chan struct{}
+}
+
+type dedupEntry struct {
+	// err has the stack trace of where it was first notified (see
+	// withStack), which is sent with summaries
+	err        interface{}
+	context    map[string]interface{}
+	suppressed int
+}
+
+// Notify is part of Notifier interface
+func (d *dedupNotifier) Notify(e interface{}, req *http.Request, context map[string]interface{}) {
+	stacked := withStack(e, 0)
+	fp := fingerprint(stacked, d.cfg.StackFrames)
+
+	d.mu.Lock()
+	if entry, ok := d.seen[fp]; ok {
+		entry.suppressed++
+		d.mu.Unlock()
+		d.countSuppressed(req, "duplicate")
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(d.budgetStart) >= time.Minute {
+		d.budgetStart = now
+		d.budgetUsed = 0
+	}
+	if d.budgetUsed >= d.cfg.PerMinute {
+		d.rateLimited++
+		d.mu.Unlock()
+		d.countSuppressed(req, "rate_limit")
+		return
+	}
+	d.budgetUsed++
+	d.seen[fp] = &dedupEntry{err: stacked, context: context}
+	d.mu.Unlock()
+
+	d.notifier.Notify(e, req, withContext(context, map[string]interface{}{"fingerprint": fp}))
+}
+
+func (d *dedupNotifier) countSuppressed(req *http.Request, reason string) {
+	ctx := context.Background()
+	if d.cfg.Monitor != nil {
+		ctx = monitoring.Context(ctx, d.cfg.Monitor)
+	} else if req != nil {
+		ctx = req.Context()
+	}
+	suppressedNotifications.Inc(ctx, [1]string{reason})
+}
+
+func (d *dedupNotifier) run() {
+	defer close(d.done)
+
+	t := time.NewTicker(d.cfg.Window)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			d.summarize()
+		case <-d.running:
+			d.summarize()
+			return
+		}
+	}
+}
+
+// summarize sends summaries of the current window, with the stack
+// traces of the errors' first notifications, and starts a new
+// window. Errors with suppressed notifications stay deduplicated in
+// the new window (so that an ongoing error is only summarized), other
+// errors are forgotten.
+func (d *dedupNotifier) summarize() {
+	type summary struct {
+		fingerprint string
+		dedupEntry
+	}
+
+	d.mu.Lock()
+	var summaries []summary
+	for fp, entry := range d.seen {
+		if entry.suppressed == 0 {
+			delete(d.seen, fp)
+			continue
+		}
+		summaries = append(summaries, summary{fp, *entry})
+		entry.suppressed = 0
+	}
+	rateLimited := d.rateLimited
+	d.rateLimited = 0
+	d.mu.Unlock()
+
+	for _, s := range summaries {
+		d.notifier.Notify(s.err, nil, withContext(s.context, map[string]interface{}{
+			"fingerprint": s.fingerprint,
+			"occurrences": s.suppressed + 1,
+			"suppressed":  s.suppressed,
+			"window":      d.cfg.Window.String(),
+		}))
+	}
+
+	if rateLimited > 0 {
+		d.notifier.Notify(
+			fmt.Errorf("%d error notifications suppressed by rate limit of %d per minute", rateLimited, d.cfg.PerMinute),
+			nil,
+			map[string]interface{}{
+				"suppressed": rateLimited,
+				"window":     d.cfg.Window.String(),
+			},
+		)
+	}
+}
+
+// Close is part of io.Closer.
+func (d *dedupNotifier) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.running)
+		<-d.done
+	})
+	return nil
+}
+
+// withContext returns a copy of context with extra values.
+func withContext(context, extra map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(context)+len(extra))
+	for k, v := range context {
+		merged[k] = v
+	}
+	for k, v := range extra {
+		merged[k] = v
+	}
+	return merged
+}
+
+var (
+	uuidPattern   = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	hexPattern    = regexp.MustCompile(`\b(0x[0-9a-fA-F]+|[0-9a-fA-F]{8,})\b`)
+	numberPattern = regexp.MustCompile(`[0-9]+`)
+)
+
+// normalizeMessage replaces UUIDs, hex strings (eg. hashes and
+// addresses) and numbers in an error message, eg. `order 123 not
+// found` => `order <n> not found`.
+func normalizeMessage(message string) string {
+	message = uuidPattern.ReplaceAllString(message, "<uuid>")
+	message = hexPattern.ReplaceAllStringFunc(message, func(s string) string {
+		// words like `deadbeef` aren't IDs
+		if strings.ContainsAny(s, "0123456789") {
+			return "<hex>"
+		}
+		return s
+	})
+	return numberPattern.ReplaceAllString(message, "<n>")
+}
+
+// ownPackage is this package's path, whose frames aren't part of
+// fingerprints.
+var ownPackage = framePackage(runtime.Frame{Function: runtime.FuncForPC(reflect.ValueOf(Dedup).Pointer()).Name()})
+
+// fingerprint identifies an error by its type, normalized message, and
+// the functions of its innermost stack frames.
+func fingerprint(e interface{}, stackFrames int) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s\n", errorType(e), normalizeMessage(fmt.Sprint(e)))
+
+	for _, f := range fingerprintFrames(e, stackFrames) {
+		fmt.Fprintln(h, f.Function)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// fingerprintFrames returns up to n innermost frames of e's stack,
+// starting from where it panicked (if it was recovered from a panic),
+// without frames of the runtime or this package.
+func fingerprintFrames(e interface{}, n int) []runtime.Frame {
+	// errors without a stack trace of their own get the stack of
+	// where they were notified (see withStack) in Notify
+	frames := stackFrames(e, 0)
+
+	for i := len(frames) - 1; i >= 0; i-- {
+		if frames[i].Function == "runtime.gopanic" {
+			frames = frames[i+1:]
+			break
+		}
+	}
+
+	var result []runtime.Frame
+	for _, f := range frames {
+		if len(result) == n {
+			break
+		}
+		if pkg := framePackage(f); pkg == "runtime" || pkg == ownPackage {
+			continue
+		}
+		result = append(result, f)
+	}
+	return result
+}
@@ -0,0 +1,221 @@
+package errornotifier_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/theplant/appkit/errornotifier"
+	"github.com/theplant/appkit/log"
+	"github.com/theplant/appkit/monitoring"
+)
+
+// lockedNotifier records notifications, and can be notified
+// concurrently.
+type lockedNotifier struct {
+	mu      sync.Mutex
+	notices []lockedNotice
+}
+
+type lockedNotice struct {
+	err     interface{}
+	context map[string]interface{}
+}
+
+func (n *lockedNotifier) Notify(err interface{}, req *http.Request, context map[string]interface{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.notices = append(n.notices, lockedNotice{err, context})
+}
+
+func (n *lockedNotifier) get() []lockedNotice {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]lockedNotice(nil), n.notices...)
+}
+
+// countsMonitor sums Count values by measurement and reason tag.
+type countsMonitor struct {
+	monitoring.Monitor
+	mu     sync.Mutex
+	counts map[string]float64
+}
+
+func (m *countsMonitor) Count(measurement string, value float64, tags map[string]string, fields map[string]interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counts == nil {
+		m.counts = map[string]float64{}
+	}
+	m.counts[measurement+","+tags["reason"]] += value
+}
+
+func TestDedup(t *testing.T) {
+	bn := &lockedNotifier{}
+	m := &countsMonitor{}
+	n, closer := errornotifier.Dedup(bn, errornotifier.DedupConfig{Window: time.Hour, Monitor: m})
+
+	notifyMissing := func(id string) {
+		n.Notify(fmt.Errorf("order %s not found", id), nil, map[string]interface{}{"id": id})
+	}
+	for i := 0; i < 5; i++ {
+		notifyMissing(fmt.Sprint(i))
+	}
+	notifyMissing("0b9e4a6e-3d52-4a8c-9d3a-6f1c2e7b8a90")
+	notifyMissing("5f0c1d2e-8a7b-4c3d-9e1f-2a3b4c5d6e7f")
+
+	// the same message from elsewhere is another error
+	n.Notify(errors.New("order 1 not found"), nil, nil)
+
+	notices := bn.get()
+	if len(notices) != 3 {
+		t.Fatalf("expected 3 notices, got %d: %v", len(notices), notices)
+	}
+	if notices[0].context["id"] != "0" || notices[0].context["fingerprint"] == nil {
+		t.Errorf("unexpected context %v", notices[0].context)
+	}
+	if notices[0].context["fingerprint"] == notices[2].context["fingerprint"] {
+		t.Errorf("expected errors from different functions to have different fingerprints")
+	}
+	if m.counts["error-notifications-suppressed,duplicate"] != 5 {
+		t.Errorf("expected 5 duplicates counted, got %v", m.counts)
+	}
+
+	closer.Close()
+
+	notices = bn.get()
+	if len(notices) != 5 {
+		t.Fatalf("expected 2 summaries, got %d notices: %v", len(notices), notices)
+	}
+	summaries := map[interface{}]lockedNotice{}
+	for _, notice := range notices[3:] {
+		summaries[notice.context["id"]] = notice
+	}
+	if s := summaries["0"]; s.err.(error).Error() != "order 0 not found" || s.context["occurrences"] != 5 || s.context["suppressed"] != 4 {
+		t.Errorf("unexpected summary %v %v", s.err, s.context)
+	}
+	if s := summaries["0b9e4a6e-3d52-4a8c-9d3a-6f1c2e7b8a90"]; s.context["occurrences"] != 2 || s.context["suppressed"] != 1 {
+		t.Errorf("unexpected summary %v %v", s.err, s.context)
+	}
+}
+
+func TestDedup_RateLimit(t *testing.T) {
+	bn := &lockedNotifier{}
+	m := &countsMonitor{}
+	n, closer := errornotifier.Dedup(bn, errornotifier.DedupConfig{Window: time.Hour, PerMinute: 2, Monitor: m})
+
+	for _, message := range []string{"a", "b", "c", "d", "e"} {
+		n.Notify(errors.New(message), nil, nil)
+	}
+
+	if notices := bn.get(); len(notices) != 2 {
+		t.Fatalf("expected 2 notices, got %d", len(notices))
+	}
+	if m.counts["error-notifications-suppressed,rate_limit"] != 3 {
+		t.Errorf("expected 3 rate limited counted, got %v", m.counts)
+	}
+
+	closer.Close()
+
+	notices := bn.get()
+	if len(notices) != 3 || notices[2].context["suppressed"] != 3 {
+		t.Fatalf("expected a rate limit summary, got %v", notices)
+	}
+}
+
+func TestDedup_Window(t *testing.T) {
+	bn := &lockedNotifier{}
+	n, closer := errornotifier.Dedup(bn, errornotifier.DedupConfig{Window: 20 * time.Millisecond, Monitor: &countsMonitor{}})
+	defer closer.Close()
+
+	notify := func() { n.Notify(errors.New("ongoing"), nil, nil) }
+	notify()
+	notify()
+
+	deadline := time.Now().Add(time.Second)
+	for len(bn.get()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("no summary sent")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the ongoing error is still deduplicated, and only summarized...
+	notify()
+	for len(bn.get()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("no summary sent")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	notices := bn.get()
+	if notices[1].context["suppressed"] != 1 || notices[2].context["suppressed"] != 1 {
+		t.Fatalf("expected summaries, got %v", notices)
+	}
+
+	// ...until a window without it
+	time.Sleep(60 * time.Millisecond)
+	notify()
+	notices = bn.get()
+	if len(notices) != 4 || notices[3].context["suppressed"] != nil {
+		t.Fatalf("expected the error to be notified again, got %v", notices)
+	}
+}
+
+func TestDedup_Panics(t *testing.T) {
+	bn := &lockedNotifier{}
+	n, closer := errornotifier.Dedup(bn, errornotifier.DedupConfig{Window: time.Hour, Monitor: &countsMonitor{}})
+	defer closer.Close()
+
+	panicHere := func() { panic("boom") }
+	panicThere := func() { panic("boom") }
+
+	for i := 0; i < 3; i++ {
+		errornotifier.NotifyOnPanic(n, nil, panicHere)
+		errornotifier.NotifyOnPanic(n, nil, panicThere)
+	}
+
+	// panics are fingerprinted by where they panicked
+	if notices := bn.get(); len(notices) != 2 {
+		t.Fatalf("expected 2 notices, got %d", len(notices))
+	}
+}
+
+func TestDedup_SummaryStackTrace(t *testing.T) {
+	rc := &received{}
+	s := rc.server(t)
+
+	wn, wCloser, err := errornotifier.NewWebhookNotifier(errornotifier.WebhookConfig{URL: s.URL}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, closer := errornotifier.Dedup(wn, errornotifier.DedupConfig{Window: time.Hour, Monitor: &countsMonitor{}})
+
+	for i := 0; i < 2; i++ {
+		n.Notify(errors.New("boom"), nil, nil)
+	}
+	closer.Close()
+	wCloser.Close()
+
+	if len(rc.bodies) != 2 {
+		t.Fatalf("expected notification and summary, got %d", len(rc.bodies))
+	}
+
+	// the summary is sent by Dedup's goroutine, but has the stack of
+	// the first notification
+	var summary errornotifier.WebhookNotification
+	if err := json.Unmarshal(rc.bodies[1], &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Context["suppressed"] != float64(1) || summary.Type != "*errors.errorString" {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if len(summary.Stacktrace) == 0 || !strings.HasSuffix(summary.Stacktrace[0].Function, "TestDedup_SummaryStackTrace") {
+		t.Errorf("unexpected summary stack trace %+v", summary.Stacktrace)
+	}
+}
@@ -14,12 +14,18 @@ import (
 
 type key int
 
-const ctxKey key = iota
+const (
+	ctxKey key = iota
+	breadcrumbsKey
+)
 
 // Recover wraps an http.Handler to report all `panic`s to Airbrake.
+// It also installs the notifier in the request context (see
+// ForceContext), and collects breadcrumbs (see AddBreadcrumb).
 func Recover(n Notifier) func(h http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req = req.WithContext(ContextWithBreadcrumbs(req.Context()))
 			c := Context(req.Context(), n)
 			err := NotifyOnPanic(n, req, func() {
 				h.ServeHTTP(w, req.WithContext(c))
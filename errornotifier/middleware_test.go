@@ -41,6 +41,11 @@ func TestRecoverMiddleware(t *testing.T) {
 	if bufferNotifier.Notices[0].Context == nil {
 		t.Fatalf("Context shouldn't be nil")
 	}
+
+	breadcrumbs := errornotifier.Breadcrumbs(bufferNotifier.Notices[0].Request.Context())
+	if len(breadcrumbs) != 1 || breadcrumbs[0].Message != "about to panic" {
+		t.Fatalf("Got unexpected breadcrumbs: %v", breadcrumbs)
+	}
 }
 
 // newRecoverTestServer prepares a test HTTP server that has the Recover
@@ -61,6 +66,7 @@ func newRecoverTestServer(n errornotifier.Notifier) *httptest.Server {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/recover", func(w http.ResponseWriter, r *http.Request) {
+		errornotifier.AddBreadcrumb(r.Context(), errornotifier.Breadcrumb{Message: "about to panic"})
 		panic(errHandlerException)
 	})
 
@@ -0,0 +1,173 @@
+package errornotifier
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/theplant/appkit/log"
+)
+
+const (
+	// DefaultQueueSize is the default number of notifications queued
+	// for sending by asynchronous notifiers.
+	DefaultQueueSize = 100
+
+	// DefaultCloseTimeout is how long closing asynchronous notifiers
+	// waits for queued notifications to be sent, by default.
+	DefaultCloseTimeout = 10 * time.Second
+
+	sendTimeout = 10 * time.Second
+)
+
+// post is a queued notification request.
+type post struct {
+	url    string
+	header http.Header
+	body   []byte
+}
+
+// postQueue sends HTTP POST requests from a bounded queue in a
+// goroutine, so that notifying doesn't block (or slow down) the
+// caller. Notifications are dropped when the queue is full.
+type postQueue struct {
+	name         string
+	client       *http.Client
+	closeTimeout time.Duration
+	logger       log.Logger
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan post
+	done   chan struct{}
+
+	// ctx is cancelled when closing times out, to abort sending
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newPostQueue(name string, size int, closeTimeout time.Duration, logger log.Logger) *postQueue {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	if closeTimeout <= 0 {
+		closeTimeout = DefaultCloseTimeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &postQueue{
+		name:         name,
+		client:       &http.Client{Timeout: sendTimeout},
+		closeTimeout: closeTimeout,
+		logger:       logger,
+		queue:        make(chan post, size),
+		done:         make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+	go q.run()
+	return q
+}
+
+// enqueue queues p, or drops it if the queue is full or closed.
+func (q *postQueue) enqueue(p post) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		_ = q.logger.Warn().Log(
+			"msg", fmt.Sprintf("dropping %s error notification: notifier is closed", q.name),
+		)
+		return
+	}
+
+	select {
+	case q.queue <- p:
+	default:
+		_ = q.logger.Warn().Log(
+			"msg", fmt.Sprintf("dropping %s error notification: queue is full", q.name),
+			"queue_size", cap(q.queue),
+		)
+	}
+}
+
+func (q *postQueue) run() {
+	defer close(q.done)
+
+	dropped := 0
+	for p := range q.queue {
+		if q.ctx.Err() != nil {
+			dropped++
+			continue
+		}
+		err := q.send(p)
+		switch {
+		case err == nil:
+		case q.ctx.Err() != nil:
+			dropped++
+		default:
+			_ = q.logger.Error().Log(
+				"msg", fmt.Sprintf("error sending %s error notification: %v", q.name, err),
+				"err", err,
+			)
+		}
+	}
+
+	if dropped > 0 {
+		_ = q.logger.Warn().Log(
+			"msg", fmt.Sprintf("dropped %d %s error notifications: timed out closing notifier", dropped, q.name),
+			"dropped", dropped,
+			"close_timeout", q.closeTimeout,
+		)
+	}
+}
+
+func (q *postQueue) send(p post) error {
+	req, err := http.NewRequestWithContext(q.ctx, "POST", p.url, bytes.NewReader(p.body))
+	if err != nil {
+		return err
+	}
+	req.Header = p.header
+
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// Close stops accepting notifications, and waits for queued
+// notifications to be sent, for at most the close timeout. Then
+// sending is aborted, and notifications that weren't sent are
+// dropped. It is part of io.Closer.
+func (q *postQueue) Close() error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+
+	t := time.NewTimer(q.closeTimeout)
+	defer t.Stop()
+	defer q.cancel()
+
+	select {
+	case <-q.done:
+	case <-t.C:
+		q.cancel()
+		<-q.done
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package errornotifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/theplant/appkit/log"
+)
+
+const sentryClient = "appkit-errornotifier/1.0"
+
+// SentryConfig is struct to embed into application config to allow
+// configuration of the Sentry notifier from environment or other
+// external source
+type SentryConfig struct {
+	// DSN is the project's client key URL, eg.
+	// `https://<key>@o0.ingest.sentry.io/<project id>`
+	DSN         string
+	Environment string `default:"dev"`
+	Release     string
+
+	// QueueSize limits the number of notifications waiting to be
+	// sent, default DefaultQueueSize.
+	QueueSize int
+
+	// CloseTimeout limits how long closing the notifier waits for
+	// queued notifications to be sent, default DefaultCloseTimeout.
+	CloseTimeout time.Duration
+}
+
+// sentryNotifier is a Notifier that sends events to Sentry (or a
+// Sentry-compatible service) via the envelope protocol, constructed
+// via NewSentryNotifier
+type sentryNotifier struct {
+	*postQueue
+	config   SentryConfig
+	endpoint string
+	auth     string
+	hostname string
+}
+
+// NewSentryNotifier constructs a Sentry notifier from given config,
+// logging send errors with logger.
+//
+// Returns error if the DSN is blank or invalid.
+//
+// Notify is async, call close to wait for queued events to be sent.
+func NewSentryNotifier(c SentryConfig, logger log.Logger) (Notifier, io.Closer, error) {
+	endpoint, key, err := parseSentryDSN(c.DSN)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostname, _ := os.Hostname()
+
+	n := &sentryNotifier{
+		postQueue: newPostQueue("sentry", c.QueueSize, c.CloseTimeout, logger),
+		config:    c,
+		endpoint:  endpoint,
+		auth:      fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=%s", key, sentryClient),
+		hostname:  hostname,
+	}
+	return n, n.postQueue, nil
+}
+
+// parseSentryDSN returns the envelope endpoint and public key of a
+// DSN, eg. `https://key@sentry.example.com/path/42` has endpoint
+// `https://sentry.example.com/path/api/42/envelope/`.
+func parseSentryDSN(dsn string) (string, string, error) {
+	if dsn == "" {
+		return "", "", errors.New("blank Sentry DSN")
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid Sentry DSN: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", "", fmt.Errorf("invalid Sentry DSN scheme: %q", u.Scheme)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return "", "", errors.New("invalid Sentry DSN: no public key")
+	}
+
+	path, project := "", strings.TrimSuffix(u.Path, "/")
+	if i := strings.LastIndexByte(project, '/'); i >= 0 {
+		path, project = project[:i], project[i+1:]
+	}
+	if _, err := strconv.ParseUint(project, 10, 64); err != nil {
+		return "", "", fmt.Errorf("invalid Sentry DSN project id: %q", project)
+	}
+
+	endpoint := fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, path, project)
+	return endpoint, u.User.Username(), nil
+}
+
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Level       string            `json:"level"`
+	Environment string            `json:"environment,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Exception   struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+	Request     *sentryRequest `json:"request,omitempty"`
+	Breadcrumbs *struct {
+		Values []Breadcrumb `json:"values"`
+	} `json:"breadcrumbs,omitempty"`
+}
+
+type sentryException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []sentryFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type sentryRequest struct {
+	URL         string            `json:"url"`
+	Method      string            `json:"method"`
+	QueryString string            `json:"query_string,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+// Notify is part of Notifier interface. Context values are sent as
+// event tags.
+func (n *sentryNotifier) Notify(e interface{}, req *http.Request, context map[string]interface{}) {
+	event := sentryEvent{
+		EventID:     strings.ReplaceAll(uuid.NewString(), "-", ""),
+		Timestamp:   time.Now().UTC(),
+		Platform:    "go",
+		Level:       "error",
+		Environment: n.config.Environment,
+		Release:     n.config.Release,
+		ServerName:  n.hostname,
+	}
+
+	if len(context) > 0 {
+		event.Tags = make(map[string]string, len(context))
+		for k, v := range context {
+			event.Tags[k] = fmt.Sprint(v)
+		}
+	}
+
+	exception := sentryException{Type: errorType(e), Value: fmt.Sprint(e)}
+	frames := stackFrames(e, 0)
+	// Sentry frames are oldest first
+	for i := len(frames) - 1; i >= 0; i-- {
+		f := frames[i]
+		pkg := framePackage(f)
+		exception.Stacktrace.Frames = append(exception.Stacktrace.Frames, sentryFrame{
+			Function: strings.TrimPrefix(f.Function, pkg+"."),
+			Module:   pkg,
+			Filename: f.File[strings.LastIndexByte(f.File, '/')+1:],
+			AbsPath:  f.File,
+			Lineno:   f.Line,
+			InApp:    inApp(f),
+		})
+	}
+	event.Exception.Values = []sentryException{exception}
+
+	if req != nil {
+		event.Request = &sentryRequest{
+			URL:         requestURL(req),
+			Method:      req.Method,
+			QueryString: req.URL.RawQuery,
+			Headers:     requestHeaders(req),
+		}
+
+		if crumbs := Breadcrumbs(req.Context()); len(crumbs) > 0 {
+			event.Breadcrumbs = &struct {
+				Values []Breadcrumb `json:"values"`
+			}{crumbs}
+		}
+	}
+
+	body, err := n.envelope(event)
+	if err != nil {
+		_ = n.logger.Error().Log(
+			"msg", fmt.Sprintf("error encoding sentry event: %v", err),
+			"err", err,
+		)
+		return
+	}
+
+	n.enqueue(post{
+		url: n.endpoint,
+		header: http.Header{
+			"Content-Type":  {"application/x-sentry-envelope"},
+			"X-Sentry-Auth": {n.auth},
+		},
+		body: body,
+	})
+}
+
+// envelope encodes event as an envelope: a header, an item header and
+// the event, each on a line.
+func (n *sentryNotifier) envelope(event sentryEvent) ([]byte, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	if err := enc.Encode(map[string]interface{}{
+		"event_id": event.EventID,
+		"sent_at":  event.Timestamp.Format(time.RFC3339Nano),
+		"dsn":      n.config.DSN,
+	}); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(map[string]interface{}{
+		"type":   "event",
+		"length": len(payload),
+	}); err != nil {
+		return nil, err
+	}
+	b.Write(payload)
+	b.WriteByte('\n')
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,184 @@
+package errornotifier_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/theplant/appkit/errornotifier"
+	"github.com/theplant/appkit/log"
+)
+
+// received records requests to a test endpoint.
+type received struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *received) server(t *testing.T) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		rc.requests = append(rc.requests, r)
+		rc.bodies = append(rc.bodies, body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestSentryNotifier(t *testing.T) {
+	rc := &received{}
+	s := rc.server(t)
+
+	dsn := strings.Replace(s.URL, "://", "://public@", 1) + "/sentry/42"
+	n, closer, err := errornotifier.NewSentryNotifier(errornotifier.SentryConfig{
+		DSN:         dsn,
+		Environment: "test",
+		Release:     "v1.2.3",
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/orders?page=2", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("User-Agent", "test")
+	ctx := errornotifier.ContextWithBreadcrumbs(req.Context())
+	errornotifier.AddBreadcrumb(ctx, errornotifier.Breadcrumb{Category: "sql", Message: "SELECT 1"})
+	req = req.WithContext(ctx)
+
+	n.Notify(errors.New("boom"), req, map[string]interface{}{"req_id": 123})
+	closer.Close()
+
+	if len(rc.requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(rc.requests))
+	}
+
+	r := rc.requests[0]
+	if r.URL.Path != "/sentry/api/42/envelope/" {
+		t.Errorf("unexpected envelope path %q", r.URL.Path)
+	}
+	if auth := r.Header.Get("X-Sentry-Auth"); !strings.Contains(auth, "sentry_version=7") || !strings.Contains(auth, "sentry_key=public") {
+		t.Errorf("unexpected X-Sentry-Auth %q", auth)
+	}
+
+	lines := bufio.NewScanner(bytes.NewReader(rc.bodies[0]))
+	var envelope, item struct {
+		EventID string `json:"event_id"`
+		DSN     string `json:"dsn"`
+		Type    string `json:"type"`
+		Length  int    `json:"length"`
+	}
+	var event struct {
+		EventID     string            `json:"event_id"`
+		Level       string            `json:"level"`
+		Environment string            `json:"environment"`
+		Release     string            `json:"release"`
+		Tags        map[string]string `json:"tags"`
+		Exception   struct {
+			Values []struct {
+				Type       string `json:"type"`
+				Value      string `json:"value"`
+				Stacktrace struct {
+					Frames []struct {
+						Function string `json:"function"`
+						Module   string `json:"module"`
+						Lineno   int    `json:"lineno"`
+						InApp    bool   `json:"in_app"`
+					} `json:"frames"`
+				} `json:"stacktrace"`
+			} `json:"values"`
+		} `json:"exception"`
+		Request struct {
+			URL         string            `json:"url"`
+			Method      string            `json:"method"`
+			QueryString string            `json:"query_string"`
+			Headers     map[string]string `json:"headers"`
+		} `json:"request"`
+		Breadcrumbs struct {
+			Values []errornotifier.Breadcrumb `json:"values"`
+		} `json:"breadcrumbs"`
+	}
+
+	var payload []byte
+	for i, v := range []interface{}{&envelope, &item, &event} {
+		if !lines.Scan() {
+			t.Fatalf("envelope has %d lines, expected 3:\n%s", i, rc.bodies[0])
+		}
+		if i == 2 {
+			payload = lines.Bytes()
+		}
+		if err := json.Unmarshal(lines.Bytes(), v); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+	}
+
+	if envelope.DSN != dsn || envelope.EventID != event.EventID || len(event.EventID) != 32 {
+		t.Errorf("unexpected envelope header %+v", envelope)
+	}
+	if item.Type != "event" || item.Length != len(payload) {
+		t.Errorf("unexpected item header %+v", item)
+	}
+	if event.Level != "error" || event.Environment != "test" || event.Release != "v1.2.3" {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if event.Tags["req_id"] != "123" {
+		t.Errorf("expected req_id tag, got %v", event.Tags)
+	}
+
+	if len(event.Exception.Values) != 1 {
+		t.Fatalf("expected 1 exception, got %d", len(event.Exception.Values))
+	}
+	exception := event.Exception.Values[0]
+	if exception.Value != "boom" || exception.Type != "*errors.fundamental" {
+		t.Errorf("unexpected exception %q of type %q", exception.Value, exception.Type)
+	}
+	frames := exception.Stacktrace.Frames
+	if len(frames) == 0 {
+		t.Fatal("expected stack frames")
+	}
+	// frames are oldest first, ending where the error was created
+	last := frames[len(frames)-1]
+	if last.Function != "TestSentryNotifier" || last.Module != "github.com/theplant/appkit/errornotifier_test" || !last.InApp {
+		t.Errorf("unexpected innermost frame %+v", last)
+	}
+	if frames[0].InApp {
+		t.Errorf("expected standard library frame not to be in app: %+v", frames[0])
+	}
+
+	if event.Request.URL != "http://example.com/orders" || event.Request.Method != "POST" || event.Request.QueryString != "page=2" {
+		t.Errorf("unexpected request %+v", event.Request)
+	}
+	if event.Request.Headers["Authorization"] != "[Filtered]" || event.Request.Headers["User-Agent"] != "test" {
+		t.Errorf("unexpected request headers %v", event.Request.Headers)
+	}
+
+	if len(event.Breadcrumbs.Values) != 1 || event.Breadcrumbs.Values[0].Message != "SELECT 1" {
+		t.Errorf("unexpected breadcrumbs %+v", event.Breadcrumbs.Values)
+	}
+}
+
+func TestNewSentryNotifier_InvalidDSN(t *testing.T) {
+	for dsn, expectedErrContains := range map[string]string{
+		"":                                 "blank Sentry DSN",
+		"ftp://key@sentry.example.com/42":  "scheme",
+		"https://sentry.example.com/42":    "no public key",
+		"https://key@sentry.example.com/":  "project id",
+		"https://key@sentry.example.com/x": "project id",
+	} {
+		_, _, err := errornotifier.NewSentryNotifier(errornotifier.SentryConfig{DSN: dsn}, log.NewNopLogger())
+		if err == nil || !strings.Contains(err.Error(), expectedErrContains) {
+			t.Errorf("%q: expected error containing %q, got %v", dsn, expectedErrContains, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package errornotifier
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxStackFrames limits the frames of a notification's stack trace.
+const maxStackFrames = 64
+
+// stackTracer is implemented by errors created with
+// github.com/pkg/errors.
+type stackTracer interface {
+	StackTrace() errors.StackTrace
+}
+
+// stackFrames returns the stack trace of e, innermost frame first:
+// where e was created if it is a github.com/pkg/errors error, or else
+// the stack of the caller of stackFrames' caller, skipping skip more
+// frames.
+func stackFrames(e interface{}, skip int) []runtime.Frame {
+	var pcs []uintptr
+
+	var tracer stackTracer
+	if err, ok := e.(error); ok && errors.As(err, &tracer) {
+		for _, f := range tracer.StackTrace() {
+			pcs = append(pcs, uintptr(f))
+		}
+		if len(pcs) > maxStackFrames {
+			pcs = pcs[:maxStackFrames]
+		}
+	} else {
+		pcs = make([]uintptr, maxStackFrames)
+		pcs = pcs[:runtime.Callers(skip+3, pcs)]
+	}
+
+	var frames []runtime.Frame
+	iter := runtime.CallersFrames(pcs)
+	for {
+		f, more := iter.Next()
+		if f.Function != "" {
+			frames = append(frames, f)
+		}
+		if !more {
+			break
+		}
+	}
+	return frames
+}
+
+// stackError is a notified value with the stack trace of where it
+// was first notified, so that notifying it again later (eg. in a
+// summary sent by Dedup) reports the same stack, rather than the
+// stack of the goroutine notifying it later.
+type stackError struct {
+	value interface{}
+	stack errors.StackTrace
+}
+
+func (e stackError) Error() string { return fmt.Sprint(e.value) }
+
+// StackTrace is part of stackTracer.
+func (e stackError) StackTrace() errors.StackTrace { return e.stack }
+
+// Unwrap returns the notified error, or nil if the notified value
+// isn't an error.
+func (e stackError) Unwrap() error {
+	err, _ := e.value.(error)
+	return err
+}
+
+// withStack returns e, if it is a github.com/pkg/errors error, or else
+// e with the stack of the caller of withStack's caller, skipping skip
+// more frames.
+func withStack(e interface{}, skip int) interface{} {
+	var tracer stackTracer
+	if err, ok := e.(error); ok && errors.As(err, &tracer) {
+		return e
+	}
+
+	pcs := make([]uintptr, maxStackFrames)
+	pcs = pcs[:runtime.Callers(skip+3, pcs)]
+
+	stack := make(errors.StackTrace, len(pcs))
+	for i, pc := range pcs {
+		stack[i] = errors.Frame(pc)
+	}
+	return stackError{value: e, stack: stack}
+}
+
+// framePackage returns the package path of f's function, eg.
+// `github.com/theplant/appkit/server` for
+// `github.com/theplant/appkit/server.Recovery.func1`.
+func framePackage(f runtime.Frame) string {
+	name := f.Function
+	slash := strings.LastIndexByte(name, '/')
+	if dot := strings.IndexByte(name[slash+1:], '.'); dot >= 0 {
+		return name[:slash+1+dot]
+	}
+	return name
+}
+
+// inApp is true for frames of application code, rather than the
+// standard library (whose packages don't start with a domain) or
+// module dependencies.
+func inApp(f runtime.Frame) bool {
+	pkg := framePackage(f)
+	first, _, _ := strings.Cut(pkg, "/")
+	return strings.Contains(first, ".") && !strings.Contains(f.File, "/pkg/mod/")
+}
+
+// errorType returns the type of e's cause, eg. `*fs.PathError`.
+func errorType(e interface{}) string {
+	if se, ok := e.(stackError); ok {
+		e = se.value
+	}
+	if err, ok := e.(error); ok {
+		return fmt.Sprintf("%T", errors.Cause(err))
+	}
+	return fmt.Sprintf("%T", e)
+}
+
+// filteredHeaders are request headers whose values aren't sent with
+// notifications.
+var filteredHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "X-Api-Key"}
+
+const filteredValue = "[Filtered]"
+
+// requestHeaders returns r's headers, with the values of
+// filteredHeaders replaced.
+func requestHeaders(r *http.Request) map[string]string {
+	headers := make(map[string]string, len(r.Header))
+	for k, v := range r.Header {
+		headers[k] = strings.Join(v, ", ")
+	}
+	for _, k := range filteredHeaders {
+		if _, ok := headers[k]; ok {
+			headers[k] = filteredValue
+		}
+	}
+	return headers
+}
+
+// requestURL returns r's absolute URL, without the query.
+func requestURL(r *http.Request) string {
+	if r.URL.IsAbs() {
+		u := *r.URL
+		u.RawQuery = ""
+		return u.String()
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.Path
+}
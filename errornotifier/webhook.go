@@ -0,0 +1,139 @@
+package errornotifier
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/theplant/appkit/log"
+)
+
+// WebhookConfig is struct to embed into application config to allow
+// configuration of the webhook notifier from environment or other
+// external source
+type WebhookConfig struct {
+	// URL receives notifications as JSON POST requests.
+	URL string
+	// Token, if set, is sent as a bearer token in the Authorization
+	// header.
+	Token       string
+	Environment string `default:"dev"`
+
+	// QueueSize limits the number of notifications waiting to be
+	// sent, default DefaultQueueSize.
+	QueueSize int
+
+	// CloseTimeout limits how long closing the notifier waits for
+	// queued notifications to be sent, default DefaultCloseTimeout.
+	CloseTimeout time.Duration
+}
+
+// WebhookNotification is the JSON body of notifications sent by the
+// webhook notifier.
+type WebhookNotification struct {
+	Error       string                 `json:"error"`
+	Type        string                 `json:"type"`
+	Environment string                 `json:"environment,omitempty"`
+	Timestamp   time.Time              `json:"timestamp"`
+	Context     map[string]interface{} `json:"context,omitempty"`
+	Request     *WebhookRequest        `json:"request,omitempty"`
+	Stacktrace  []WebhookFrame         `json:"stacktrace"`
+	Breadcrumbs []Breadcrumb           `json:"breadcrumbs,omitempty"`
+}
+
+// WebhookRequest is the HTTP request of a WebhookNotification.
+type WebhookRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Query   string            `json:"query,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// WebhookFrame is a stack frame of a WebhookNotification, innermost
+// first.
+type WebhookFrame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// webhookNotifier is a Notifier that POSTs notifications as JSON,
+// constructed via NewWebhookNotifier
+type webhookNotifier struct {
+	*postQueue
+	config WebhookConfig
+}
+
+// NewWebhookNotifier constructs a webhook notifier from given config,
+// logging send errors with logger. Notifications are sent as
+// WebhookNotification JSON.
+//
+// Returns error if the URL is blank or invalid.
+//
+// Notify is async, call close to wait for queued notifications to be
+// sent.
+func NewWebhookNotifier(c WebhookConfig, logger log.Logger) (Notifier, io.Closer, error) {
+	if c.URL == "" {
+		return nil, nil, errors.New("blank webhook URL")
+	}
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, nil, fmt.Errorf("invalid webhook URL: %q", c.URL)
+	}
+
+	n := &webhookNotifier{
+		postQueue: newPostQueue("webhook", c.QueueSize, c.CloseTimeout, logger),
+		config:    c,
+	}
+	return n, n.postQueue, nil
+}
+
+// Notify is part of Notifier interface
+func (n *webhookNotifier) Notify(e interface{}, req *http.Request, context map[string]interface{}) {
+	notification := WebhookNotification{
+		Error:       fmt.Sprint(e),
+		Type:        errorType(e),
+		Environment: n.config.Environment,
+		Timestamp:   time.Now().UTC(),
+		Context:     context,
+		Stacktrace:  []WebhookFrame{},
+	}
+
+	for _, f := range stackFrames(e, 0) {
+		notification.Stacktrace = append(notification.Stacktrace, WebhookFrame{
+			Function: f.Function,
+			File:     f.File,
+			Line:     f.Line,
+		})
+	}
+
+	if req != nil {
+		notification.Request = &WebhookRequest{
+			Method:  req.Method,
+			URL:     requestURL(req),
+			Query:   req.URL.RawQuery,
+			Headers: requestHeaders(req),
+		}
+		notification.Breadcrumbs = Breadcrumbs(req.Context())
+	}
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		// eg. context values that can't be encoded
+		_ = n.logger.Error().Log(
+			"msg", fmt.Sprintf("error encoding webhook notification: %v", err),
+			"err", err,
+		)
+		return
+	}
+
+	header := http.Header{"Content-Type": {"application/json"}}
+	if n.config.Token != "" {
+		header.Set("Authorization", "Bearer "+n.config.Token)
+	}
+
+	n.enqueue(post{url: n.config.URL, header: header, body: body})
+}
@@ -0,0 +1,154 @@
+package errornotifier_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theplant/appkit/errornotifier"
+	"github.com/theplant/appkit/log"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	rc := &received{}
+	s := rc.server(t)
+
+	n, closer, err := errornotifier.NewWebhookNotifier(errornotifier.WebhookConfig{
+		URL:         s.URL + "/notify",
+		Token:       "secret",
+		Environment: "test",
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/orders/1", nil)
+	req.Header.Set("Cookie", "session=1")
+
+	n.Notify(errors.New("boom"), req, map[string]interface{}{"req_id": "abc"})
+	n.Notify("panic value", nil, nil)
+	closer.Close()
+
+	if len(rc.requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(rc.requests))
+	}
+
+	r := rc.requests[0]
+	if r.URL.Path != "/notify" || r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected request %s %v", r.URL, r.Header)
+	}
+
+	var notification errornotifier.WebhookNotification
+	if err := json.Unmarshal(rc.bodies[0], &notification); err != nil {
+		t.Fatal(err)
+	}
+	if notification.Error != "boom" || notification.Type != "*errors.errorString" || notification.Environment != "test" {
+		t.Errorf("unexpected notification %+v", notification)
+	}
+	if notification.Context["req_id"] != "abc" {
+		t.Errorf("unexpected context %v", notification.Context)
+	}
+	if notification.Request == nil || notification.Request.URL != "http://example.com/orders/1" || notification.Request.Headers["Cookie"] != "[Filtered]" {
+		t.Errorf("unexpected request %+v", notification.Request)
+	}
+	// errors without stack traces are notified with the caller's stack
+	if len(notification.Stacktrace) == 0 || !strings.HasSuffix(notification.Stacktrace[0].Function, "TestWebhookNotifier") {
+		t.Errorf("unexpected stack trace %+v", notification.Stacktrace)
+	}
+
+	if err := json.Unmarshal(rc.bodies[1], &notification); err != nil {
+		t.Fatal(err)
+	}
+	if notification.Error != "panic value" || notification.Type != "string" {
+		t.Errorf("unexpected notification %+v", notification)
+	}
+}
+
+func TestWebhookNotifier_DropsWhenQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	requests := make(chan struct{}, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		<-release
+	}))
+	defer s.Close()
+
+	n, closer, err := errornotifier.NewWebhookNotifier(errornotifier.WebhookConfig{
+		URL:       s.URL,
+		QueueSize: 1,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first notification is being sent...
+	n.Notify(errors.New("1"), nil, nil)
+	select {
+	case <-requests:
+	case <-time.After(time.Second):
+		t.Fatal("notification not sent")
+	}
+
+	// ...the second is queued, and the third dropped
+	n.Notify(errors.New("2"), nil, nil)
+	n.Notify(errors.New("3"), nil, nil)
+
+	close(release)
+	closer.Close()
+
+	if len(requests) != 1 {
+		t.Fatalf("expected 2 notifications to be sent, got %d", len(requests)+1)
+	}
+
+	// notifications after Close are dropped
+	n.Notify(errors.New("4"), nil, nil)
+	if len(requests) != 1 {
+		t.Fatal("expected notification after Close to be dropped")
+	}
+}
+
+func TestWebhookNotifier_CloseTimeout(t *testing.T) {
+	requests := make(chan struct{}, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		requests <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	n, closer, err := errornotifier.NewWebhookNotifier(errornotifier.WebhookConfig{
+		URL:          s.URL,
+		CloseTimeout: 50 * time.Millisecond,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		n.Notify(errors.New("boom"), nil, nil)
+	}
+
+	// the first notification is being sent, when closing times out it
+	// is aborted, and the others are dropped
+	start := time.Now()
+	closer.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Close to time out, took %v", elapsed)
+	}
+	if len(requests) != 1 {
+		t.Errorf("expected 1 notification to be sent, got %d", len(requests))
+	}
+}
+
+func TestNewWebhookNotifier_InvalidURL(t *testing.T) {
+	for _, u := range []string{"", "errors.example.com", "ftp://errors.example.com"} {
+		if _, _, err := errornotifier.NewWebhookNotifier(errornotifier.WebhookConfig{URL: u}, log.NewNopLogger()); err == nil {
+			t.Errorf("%q: expected error", u)
+		}
+	}
+}
@@ -46,6 +46,15 @@ func (s *span) IsRecording() bool {
 	return s.endTime.IsZero()
 }
 
+// SetName renames the span, eg. once the route that handled a request
+// is known.
+func (s *span) SetName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.name = name
+}
+
 func (s *span) RecordError(err error) {
 	s.err = err
 }
@@ -2,9 +2,10 @@ package logtracing
 
 import (
 	"fmt"
-	"net"
 	"net/http"
 	"strings"
+
+	"github.com/theplant/appkit/contexts"
 )
 
 func HTTPClientKVs(req *http.Request) []interface{} {
@@ -60,19 +61,10 @@ func HTTPServerKVs(req *http.Request) []interface{} {
 	}
 }
 
+// clientIP returns the client IP resolved by contexts.WithClientIP,
+// or by contexts.DefaultClientIPResolver.
 func clientIP(r *http.Request) string {
-	clientIP := r.Header.Get("X-Forwarded-For")
-	if index := strings.IndexByte(clientIP, ','); index >= 0 {
-		clientIP = clientIP[0:index]
-	}
-	clientIP = strings.TrimSpace(clientIP)
-	if len(clientIP) > 0 {
-		return clientIP
-	}
-	if ip, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr)); err == nil {
-		return ip
-	}
-	return ""
+	return contexts.ResolveClientIP(r)
 }
 
 func HTTPServerResponseKVs(status string) []interface{} {
@@ -0,0 +1,276 @@
+package monitoring
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAggregateFlushInterval is how often Aggregate writes
+	// aggregates, unless configured otherwise.
+	DefaultAggregateFlushInterval = 10 * time.Second
+
+	// DefaultAggregateMaxSeries is the number of tag sets Aggregate
+	// keeps per measurement and flush interval, unless configured
+	// otherwise.
+	DefaultAggregateMaxSeries = 1000
+
+	aggregateOverflowValue = "other"
+)
+
+// DefaultAggregateBuckets are exponential bucket upper bounds from
+// 0.1 to ~900000 (eg. milliseconds, up to 15 minutes), each 20%
+// larger than the last, so percentiles are estimated with a relative
+// error of at most 20%.
+var DefaultAggregateBuckets = exponentialBuckets(0.1, 1.2, 89)
+
+func exponentialBuckets(start, factor float64, n int) []float64 {
+	buckets := make([]float64, n)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// AggregateConfig configures Aggregate.
+type AggregateConfig struct {
+	// Measurements are the InsertRecord measurements to aggregate (eg.
+	// `request`), by name or prefix ending with `*`. Other
+	// measurements are passed on as-is.
+	Measurements []string
+
+	// FlushInterval is how often aggregates are written, default
+	// DefaultAggregateFlushInterval.
+	FlushInterval time.Duration
+
+	// Buckets are sorted upper bounds of the histogram used to
+	// estimate percentiles, default DefaultAggregateBuckets.
+	Buckets []float64
+
+	// MaxSeries limits the number of tag sets of each measurement
+	// per flush interval, default DefaultAggregateMaxSeries. Once a
+	// measurement has that many, values with new tag sets are
+	// aggregated with every tag set to `other`.
+	MaxSeries int
+}
+
+// Aggregate returns a Monitor that aggregates InsertRecord values of
+// the configured measurements in m, rather than passing on every
+// value (eg. a point per HTTP request).
+//
+// Values are aggregated per measurement and tag set, and written to m
+// every flush interval as one record with the measurement's name, the
+// mean as value, and `count`, `sum`, `min`, `max`, `p50`, `p90` and
+// `p99` fields. Fields of the aggregated values are discarded.
+// Percentiles are estimated from a histogram, interpolating within
+// buckets.
+//
+// This is intended for monitors that store every value (eg. InfluxDB
+// and StatsD). Prometheus monitors already aggregate values in
+// histograms, so don't wrap them (or a Multi including them). Values
+// shouldn't be sampled (see Sample) before being aggregated, as the
+// aggregated counts and sums aren't scaled.
+//
+// The second return value is a function that writes the current
+// aggregates, and stops the flushing goroutine.
+func Aggregate(m Monitor, cfg AggregateConfig) (Monitor, func()) {
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultAggregateFlushInterval
+	}
+	if len(cfg.Buckets) == 0 {
+		cfg.Buckets = DefaultAggregateBuckets
+	}
+	if cfg.MaxSeries <= 0 {
+		cfg.MaxSeries = DefaultAggregateMaxSeries
+	}
+
+	a := &aggregateMonitor{
+		Monitor: m,
+		cfg:     cfg,
+		series:  map[string]*aggregateSeries{},
+		counts:  map[string]int{},
+	}
+
+	running := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		t := time.NewTicker(cfg.FlushInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				a.flush()
+			case <-running:
+				a.flush()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return a, func() {
+		once.Do(func() {
+			close(running)
+			<-done
+		})
+	}
+}
+
+type aggregateMonitor struct {
+	// Count, CountError and CountSimple are passed on
+	Monitor
+	cfg AggregateConfig
+
+	mu sync.Mutex
+	// series are keyed by measurement and sorted tags
+	series map[string]*aggregateSeries
+	// counts are the number of series of each measurement
+	counts map[string]int
+}
+
+type aggregateSeries struct {
+	measurement string
+	tags        map[string]string
+
+	count    uint64
+	sum      float64
+	min, max float64
+	// buckets[i] counts values <= cfg.Buckets[i], the last counts
+	// values larger than all buckets
+	buckets []uint64
+}
+
+func (a *aggregateMonitor) aggregated(measurement string) bool {
+	for _, pattern := range a.cfg.Measurements {
+		if matchMeasurement(pattern, measurement) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *aggregateMonitor) InsertRecord(measurement string, value interface{}, tags map[string]string, fields map[string]interface{}, t time.Time) {
+	if !a.aggregated(measurement) {
+		a.Monitor.InsertRecord(measurement, value, tags, fields, t)
+		return
+	}
+
+	v, ok := toFloat(value)
+	if !ok {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := aggregateKey(measurement, tags)
+	s := a.series[key]
+	if s == nil {
+		if a.counts[measurement] >= a.cfg.MaxSeries {
+			other := make(map[string]string, len(tags))
+			for k := range tags {
+				other[k] = aggregateOverflowValue
+			}
+			tags = other
+			key = aggregateKey(measurement, tags)
+			s = a.series[key]
+		}
+		if s == nil {
+			s = &aggregateSeries{
+				measurement: measurement,
+				tags:        tags,
+				min:         math.Inf(1),
+				max:         math.Inf(-1),
+				buckets:     make([]uint64, len(a.cfg.Buckets)+1),
+			}
+			a.series[key] = s
+			a.counts[measurement]++
+		}
+	}
+
+	s.count++
+	s.sum += v
+	s.min = math.Min(s.min, v)
+	s.max = math.Max(s.max, v)
+	s.buckets[sort.SearchFloat64s(a.cfg.Buckets, v)]++
+}
+
+// aggregateKey returns a key for measurement and tags: the
+// measurement, and tag names and values sorted by name, separated by
+// NUL bytes.
+func aggregateKey(measurement string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(measurement)
+	for _, k := range keys {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(tags[k])
+	}
+	return b.String()
+}
+
+// flush writes aggregates of the current interval to the wrapped
+// Monitor, and starts a new interval.
+func (a *aggregateMonitor) flush() {
+	a.mu.Lock()
+	series := a.series
+	a.series = map[string]*aggregateSeries{}
+	a.counts = map[string]int{}
+	a.mu.Unlock()
+
+	now := time.Now()
+	for _, s := range series {
+		a.Monitor.InsertRecord(s.measurement, s.sum/float64(s.count), s.tags, map[string]interface{}{
+			"count": int64(s.count),
+			"sum":   s.sum,
+			"min":   s.min,
+			"max":   s.max,
+			"p50":   s.quantile(a.cfg.Buckets, 0.5),
+			"p90":   s.quantile(a.cfg.Buckets, 0.9),
+			"p99":   s.quantile(a.cfg.Buckets, 0.99),
+		}, now)
+	}
+}
+
+// quantile estimates the q quantile (eg. 0.99) by finding the bucket
+// containing it, and interpolating linearly between the bucket's
+// bounds (narrowed to the series' min and max).
+func (s *aggregateSeries) quantile(bounds []float64, q float64) float64 {
+	rank := q * float64(s.count)
+
+	var cumulative float64
+	for i, n := range s.buckets {
+		if n == 0 {
+			continue
+		}
+		if cumulative+float64(n) < rank {
+			cumulative += float64(n)
+			continue
+		}
+
+		lower, upper := s.min, s.max
+		if i > 0 && bounds[i-1] > lower {
+			lower = bounds[i-1]
+		}
+		if i < len(bounds) && bounds[i] < upper {
+			upper = bounds[i]
+		}
+		return lower + (upper-lower)*(rank-cumulative)/float64(n)
+	}
+	return s.max
+}
@@ -0,0 +1,113 @@
+package monitoring
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+type record struct {
+	measurement string
+	value       interface{}
+	tags        map[string]string
+	fields      map[string]interface{}
+}
+
+// recordsMonitor records InsertRecord and Count calls.
+type recordsMonitor struct {
+	Monitor
+	mu      sync.Mutex
+	records []record
+}
+
+func (m *recordsMonitor) InsertRecord(measurement string, value interface{}, tags map[string]string, fields map[string]interface{}, t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records = append(m.records, record{measurement, value, tags, fields})
+}
+
+func (m *recordsMonitor) Count(measurement string, value float64, tags map[string]string, fields map[string]interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records = append(m.records, record{measurement, value, tags, fields})
+}
+
+func (m *recordsMonitor) find(measurement, tag, value string) *record {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, r := range m.records {
+		if r.measurement == measurement && r.tags[tag] == value {
+			return &m.records[i]
+		}
+	}
+	return nil
+}
+
+func TestAggregate(t *testing.T) {
+	rm := &recordsMonitor{}
+	m, closer := Aggregate(rm, AggregateConfig{Measurements: []string{"request"}, FlushInterval: time.Hour})
+
+	for i := 1; i <= 100; i++ {
+		m.InsertRecord("request", i, map[string]string{"path": "/a"}, map[string]interface{}{"req_id": i}, time.Now())
+	}
+	m.InsertRecord("request", 5*time.Millisecond, map[string]string{"path": "/b"}, nil, time.Now())
+	m.InsertRecord("request-size", 10, map[string]string{"path": "/a"}, nil, time.Now())
+
+	// other measurements are passed on immediately
+	if r := rm.find("request-size", "path", "/a"); r == nil || r.value != 10 {
+		t.Fatalf("expected request-size to be passed on, got %v", r)
+	}
+	if rm.find("request", "path", "/a") != nil {
+		t.Fatalf("expected request to be aggregated")
+	}
+
+	closer()
+
+	r := rm.find("request", "path", "/a")
+	if r == nil {
+		t.Fatalf("expected aggregated request record")
+	}
+	if r.value != 50.5 {
+		t.Errorf("expected mean 50.5, got %v", r.value)
+	}
+	for field, expected := range map[string]interface{}{"count": int64(100), "sum": 5050.0, "min": 1.0, "max": 100.0} {
+		if r.fields[field] != expected {
+			t.Errorf("expected %s %v, got %v", field, expected, r.fields[field])
+		}
+	}
+	for field, expected := range map[string]float64{"p50": 50, "p90": 90, "p99": 99} {
+		actual := r.fields[field].(float64)
+		if math.Abs(actual-expected)/expected > 0.2 {
+			t.Errorf("expected %s about %v, got %v", field, expected, actual)
+		}
+	}
+	if _, ok := r.fields["req_id"]; ok {
+		t.Errorf("expected fields of aggregated values to be discarded")
+	}
+
+	r = rm.find("request", "path", "/b")
+	if r == nil || r.fields["p99"] != 5.0 {
+		t.Errorf("expected p99 of a single value to be the value, got %v", r)
+	}
+}
+
+func TestAggregate_MaxSeries(t *testing.T) {
+	rm := &recordsMonitor{}
+	m, closer := Aggregate(rm, AggregateConfig{Measurements: []string{"req*"}, FlushInterval: time.Hour, MaxSeries: 2})
+
+	for _, path := range []string{"/1", "/2", "/3", "/4", "/1"} {
+		m.InsertRecord("request", 1, map[string]string{"path": path}, nil, time.Now())
+	}
+	closer()
+
+	for path, count := range map[string]int64{"/1": 2, "/2": 1, "other": 2} {
+		r := rm.find("request", "path", path)
+		if r == nil || r.fields["count"] != count {
+			t.Errorf("expected %d requests of %s, got %v", count, path, r)
+		}
+	}
+	if rm.find("request", "path", "/3") != nil {
+		t.Errorf("expected /3 to be aggregated as other")
+	}
+}
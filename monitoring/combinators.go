@@ -0,0 +1,249 @@
+package monitoring
+
+import (
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Multi returns a Monitor that writes to all monitors, eg. to migrate
+// from one backend to another without a gap in metrics. Each monitor
+// gets its own copy of tags and fields, as monitors may modify them.
+func Multi(monitors ...Monitor) Monitor {
+	if len(monitors) == 1 {
+		return monitors[0]
+	}
+	return multiMonitor(monitors)
+}
+
+type multiMonitor []Monitor
+
+func (mm multiMonitor) InsertRecord(measurement string, value interface{}, tags map[string]string, fields map[string]interface{}, t time.Time) {
+	for _, m := range mm {
+		m.InsertRecord(measurement, value, maps.Clone(tags), maps.Clone(fields), t)
+	}
+}
+
+func (mm multiMonitor) Count(measurement string, value float64, tags map[string]string, fields map[string]interface{}) {
+	for _, m := range mm {
+		m.Count(measurement, value, maps.Clone(tags), maps.Clone(fields))
+	}
+}
+
+func (mm multiMonitor) CountError(measurement string, value float64, err error) {
+	for _, m := range mm {
+		m.CountError(measurement, value, err)
+	}
+}
+
+func (mm multiMonitor) CountSimple(measurement string, value float64) {
+	for _, m := range mm {
+		m.CountSimple(measurement, value)
+	}
+}
+
+// Sample returns a Monitor that passes on a random sample of metrics
+// to m, with rate (between 0 and 1) being the fraction passed on.
+// Counts are divided by rate, so that sums of counts stay correct on
+// average.
+//
+// InsertRecord values of the except measurements (by name or prefix
+// ending with `*`) are all passed on, eg. for measurements aggregated
+// with Aggregate, whose counts and sums wouldn't be scaled.
+func Sample(m Monitor, rate float64, except ...string) Monitor {
+	if rate >= 1 {
+		return m
+	}
+	return sampleMonitor{m: m, rate: rate, except: except}
+}
+
+type sampleMonitor struct {
+	m      Monitor
+	rate   float64
+	except []string
+}
+
+func (s sampleMonitor) sampled() bool {
+	return rand.Float64() < s.rate
+}
+
+func (s sampleMonitor) InsertRecord(measurement string, value interface{}, tags map[string]string, fields map[string]interface{}, t time.Time) {
+	for _, pattern := range s.except {
+		if matchMeasurement(pattern, measurement) {
+			s.m.InsertRecord(measurement, value, tags, fields, t)
+			return
+		}
+	}
+	if s.sampled() {
+		s.m.InsertRecord(measurement, value, tags, fields, t)
+	}
+}
+
+func (s sampleMonitor) Count(measurement string, value float64, tags map[string]string, fields map[string]interface{}) {
+	if s.sampled() {
+		s.m.Count(measurement, value/s.rate, tags, fields)
+	}
+}
+
+func (s sampleMonitor) CountError(measurement string, value float64, err error) {
+	if s.sampled() {
+		s.m.CountError(measurement, value/s.rate, err)
+	}
+}
+
+func (s sampleMonitor) CountSimple(measurement string, value float64) {
+	if s.sampled() {
+		s.m.CountSimple(measurement, value/s.rate)
+	}
+}
+
+// FilterRule is a rule for Filter, applied to metrics with matching
+// measurements.
+type FilterRule struct {
+	// Measurement is a measurement name, or a prefix ending with `*`
+	// (eg. `influxdb-*`), or `*` for all measurements.
+	Measurement string
+
+	// Drop drops matching metrics.
+	Drop bool
+
+	// Rename, if set, renames the measurement.
+	Rename string
+
+	// DropTags are tags removed from matching metrics, by their
+	// original names (before RenameTags).
+	DropTags []string
+
+	// RenameTags renames tags, old name => new name.
+	RenameTags map[string]string
+}
+
+func (r FilterRule) matches(measurement string) bool {
+	return matchMeasurement(r.Measurement, measurement)
+}
+
+// matchMeasurement returns true if measurement is pattern, or starts
+// with pattern's prefix if pattern ends with `*`.
+func matchMeasurement(pattern, measurement string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(measurement, prefix)
+	}
+	return pattern == measurement
+}
+
+// Filter returns a Monitor that applies the first matching rule to
+// each metric before passing it on to m. Metrics that don't match any
+// rule are passed on unchanged.
+func Filter(m Monitor, rules ...FilterRule) Monitor {
+	return filterMonitor{m: m, rules: rules}
+}
+
+type filterMonitor struct {
+	m     Monitor
+	rules []FilterRule
+}
+
+// apply returns the rule for measurement, and the (possibly renamed)
+// measurement, or false if the metric should be dropped.
+func (f filterMonitor) apply(measurement string) (*FilterRule, string, bool) {
+	for i := range f.rules {
+		rule := &f.rules[i]
+		if !rule.matches(measurement) {
+			continue
+		}
+		if rule.Drop {
+			return nil, "", false
+		}
+		if rule.Rename != "" {
+			measurement = rule.Rename
+		}
+		return rule, measurement, true
+	}
+	return nil, measurement, true
+}
+
+func (f filterMonitor) filterTags(rule *FilterRule, tags map[string]string) map[string]string {
+	if rule == nil || (len(rule.DropTags) == 0 && len(rule.RenameTags) == 0) || len(tags) == 0 {
+		return tags
+	}
+
+	filtered := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if slices.Contains(rule.DropTags, k) {
+			continue
+		}
+		if newName, ok := rule.RenameTags[k]; ok {
+			k = newName
+		}
+		filtered[k] = v
+	}
+	return filtered
+}
+
+func (f filterMonitor) InsertRecord(measurement string, value interface{}, tags map[string]string, fields map[string]interface{}, t time.Time) {
+	if rule, measurement, ok := f.apply(measurement); ok {
+		f.m.InsertRecord(measurement, value, f.filterTags(rule, tags), fields, t)
+	}
+}
+
+func (f filterMonitor) Count(measurement string, value float64, tags map[string]string, fields map[string]interface{}) {
+	if rule, measurement, ok := f.apply(measurement); ok {
+		f.m.Count(measurement, value, f.filterTags(rule, tags), fields)
+	}
+}
+
+func (f filterMonitor) CountError(measurement string, value float64, err error) {
+	if _, measurement, ok := f.apply(measurement); ok {
+		f.m.CountError(measurement, value, err)
+	}
+}
+
+func (f filterMonitor) CountSimple(measurement string, value float64) {
+	if _, measurement, ok := f.apply(measurement); ok {
+		f.m.CountSimple(measurement, value)
+	}
+}
+
+// WithTags returns a Monitor that adds tags (eg. `env`, `region`,
+// `version`) to every metric passed on to m. Tags of the metric take
+// precedence.
+//
+// CountError and CountSimple are passed on as Count, with the error's
+// message in an `error` tag for CountError, as the InfluxDB monitor
+// records them.
+func WithTags(m Monitor, tags map[string]string) Monitor {
+	if len(tags) == 0 {
+		return m
+	}
+	return tagsMonitor{m: m, tags: tags}
+}
+
+type tagsMonitor struct {
+	m    Monitor
+	tags map[string]string
+}
+
+func (t tagsMonitor) withTags(tags map[string]string) map[string]string {
+	merged := make(map[string]string, len(t.tags)+len(tags))
+	maps.Copy(merged, t.tags)
+	maps.Copy(merged, tags)
+	return merged
+}
+
+func (t tagsMonitor) InsertRecord(measurement string, value interface{}, tags map[string]string, fields map[string]interface{}, at time.Time) {
+	t.m.InsertRecord(measurement, value, t.withTags(tags), fields, at)
+}
+
+func (t tagsMonitor) Count(measurement string, value float64, tags map[string]string, fields map[string]interface{}) {
+	t.m.Count(measurement, value, t.withTags(tags), fields)
+}
+
+func (t tagsMonitor) CountError(measurement string, value float64, err error) {
+	t.m.Count(measurement, value, t.withTags(map[string]string{"error": err.Error()}), nil)
+}
+
+func (t tagsMonitor) CountSimple(measurement string, value float64) {
+	t.m.Count(measurement, value, t.withTags(nil), nil)
+}
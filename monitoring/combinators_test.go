@@ -0,0 +1,103 @@
+package monitoring
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMulti(t *testing.T) {
+	a := NewPrometheusMonitor(PrometheusConfig{})
+	b := NewPrometheusMonitor(PrometheusConfig{ConstLabels: map[string]string{"backend": "b"}})
+
+	m := Multi(a, b)
+	m.InsertRecord("request", 5, map[string]string{"path": "/"}, nil, time.Now())
+	m.CountError("errors", 1, errors.New("EOF"))
+
+	expectLines(t, scrape(t, a),
+		`request_count{path="/"} 1`,
+		`errors_total{error="EOF"} 1`,
+	)
+	expectLines(t, scrape(t, b),
+		`request_count{backend="b",path="/"} 1`,
+		`errors_total{backend="b",error="EOF"} 1`,
+	)
+
+	if Multi(a) != Monitor(a) {
+		t.Errorf("expected Multi of a single monitor to return the monitor")
+	}
+}
+
+func TestSample(t *testing.T) {
+	p := NewPrometheusMonitor(PrometheusConfig{})
+	m := Sample(p, 0.5)
+
+	for i := 0; i < 10000; i++ {
+		m.CountSimple("hits", 1)
+	}
+
+	out := scrape(t, p)
+	var sum float64
+	for _, line := range strings.Split(out, "\n") {
+		if v, ok := strings.CutPrefix(line, "hits_total "); ok {
+			sum, _ = strconv.ParseFloat(v, 64)
+		}
+	}
+	if math.Abs(sum-10000) > 1000 {
+		t.Errorf("expected sampled count near 10000, got %v", sum)
+	}
+
+	p = NewPrometheusMonitor(PrometheusConfig{})
+	m = Sample(p, 0.01, "request")
+	for i := 0; i < 100; i++ {
+		m.InsertRecord("request", 5, nil, nil, time.Now())
+	}
+	expectLines(t, scrape(t, p), `request_count 100`)
+
+	if Sample(p, 1) != Monitor(p) {
+		t.Errorf("expected Sample with rate 1 to return the monitor")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	p := NewPrometheusMonitor(PrometheusConfig{})
+	m := Filter(p,
+		FilterRule{Measurement: "debug-*", Drop: true},
+		FilterRule{Measurement: "request", Rename: "http_request", DropTags: []string{"req_id", "route"}, RenameTags: map[string]string{"path": "route"}},
+		FilterRule{Measurement: "*", DropTags: []string{"user"}},
+	)
+
+	// tags are dropped by their original names
+	m.InsertRecord("request", 5, map[string]string{"path": "/", "req_id": "1", "route": "GET /"}, nil, time.Now())
+	m.CountSimple("debug-queue", 1)
+	m.Count("logins", 1, map[string]string{"user": "bob", "method": "password"}, nil)
+
+	out := scrape(t, p)
+	expectLines(t, out,
+		`http_request_count{route="/"} 1`,
+		`logins_total{method="password"} 1`,
+	)
+	for _, unexpected := range []string{"debug", "req_id", "bob"} {
+		if strings.Contains(out, unexpected) {
+			t.Errorf("expected %q to be filtered out of:\n%s", unexpected, out)
+		}
+	}
+}
+
+func TestWithTags(t *testing.T) {
+	p := NewPrometheusMonitor(PrometheusConfig{})
+	m := WithTags(p, map[string]string{"env": "test", "region": "eu"})
+
+	m.Count("logins", 1, map[string]string{"region": "us"}, nil)
+	m.CountError("errors", 1, errors.New("EOF"))
+	m.CountSimple("signups", 1)
+
+	expectLines(t, scrape(t, p),
+		`logins_total{env="test",region="us"} 1`,
+		`errors_total{env="test",error="EOF",region="eu"} 1`,
+		`signups_total{env="test",region="eu"} 1`,
+	)
+}
@@ -0,0 +1,148 @@
+package monitoring
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// countingBody counts the bytes of a request body read by handlers.
+type countingBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes of a response body, and records when
+// the response started (when headers or the first body bytes were
+// written).
+type countingWriter struct {
+	http.ResponseWriter
+	bytes     int64
+	firstByte time.Time
+}
+
+func (w *countingWriter) started() {
+	if w.firstByte.IsZero() {
+		w.firstByte = time.Now()
+	}
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	// informational responses (eg. 103 Early Hints) aren't the response
+	if status >= 200 {
+		w.started()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.started()
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap exposes the wrapped ResponseWriter to http.ResponseController.
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingFlusher is a countingWriter of an http.Flusher.
+type countingFlusher struct {
+	*countingWriter
+}
+
+// Flush implements http.Flusher, to support streaming responses.
+func (w countingFlusher) Flush() {
+	w.started()
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// wrap returns w as a ResponseWriter implementing http.Flusher and
+// http.Hijacker if its wrapped ResponseWriter does. Bytes written to
+// hijacked connections aren't counted.
+func (w *countingWriter) wrap() http.ResponseWriter {
+	hijacker, isHijacker := w.ResponseWriter.(http.Hijacker)
+	_, isFlusher := w.ResponseWriter.(http.Flusher)
+
+	switch {
+	case isFlusher && isHijacker:
+		return struct {
+			countingFlusher
+			http.Hijacker
+		}{countingFlusher{w}, hijacker}
+	case isFlusher:
+		return countingFlusher{w}
+	case isHijacker:
+		return struct {
+			*countingWriter
+			http.Hijacker
+		}{w, hijacker}
+	}
+	return w
+}
+
+// inFlight counts requests in flight by path tag, recording the
+// count in the request-in-flight measurement each time it changes.
+type inFlight struct {
+	m      Monitor
+	counts sync.Map // path tag => *atomic.Int64
+}
+
+func (f *inFlight) add(path string, delta int64) {
+	c, ok := f.counts.Load(path)
+	if !ok {
+		c, _ = f.counts.LoadOrStore(path, &atomic.Int64{})
+	}
+	n := c.(*atomic.Int64).Add(delta)
+
+	f.m.InsertRecord("request-in-flight", int(n), map[string]string{"path": path}, nil, time.Now())
+}
+
+// start counts a request in flight with the given path tag.
+func (f *inFlight) start(path string) *inFlightRequest {
+	f.add(path, 1)
+	return &inFlightRequest{inFlight: f, path: path}
+}
+
+// inFlightRequest is a request counted by inFlight.
+type inFlightRequest struct {
+	*inFlight
+
+	mu   sync.Mutex
+	path string
+	done bool
+}
+
+// route moves the request's count to path, when the request is
+// routed after it started (eg. by a server.Router).
+func (r *inFlightRequest) route(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done || path == r.path {
+		return
+	}
+	r.add(r.path, -1)
+	r.add(path, 1)
+	r.path = path
+}
+
+func (r *inFlightRequest) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done {
+		return
+	}
+	r.done = true
+	r.add(r.path, -1)
+}
@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	influxdb "github.com/influxdata/influxdb1-client/v2"
@@ -32,6 +33,14 @@ type influxMonitorCfg struct {
 	BufferSize         int
 	MaxBufferSize      int
 	ServiceName        string
+	SpoolDir           string
+	SpoolMaxSize       int
+
+	// InfluxDB 2.x, see parseInfluxdb2Config
+	Org       string
+	Token     string
+	Precision string
+	Gzip      bool
 }
 
 const (
@@ -44,6 +53,8 @@ const (
 	batchWriteIntervalParamName = "batch-write-interval"
 	bufferSizeParamName         = "buffer-size"
 	maxBufferSizeParamName      = "max-buffer-size"
+	spoolDirParamName           = "spool-dir"
+	spoolMaxSizeParamName       = "spool-max-size"
 
 	serviceNameParamName = "service-name"
 )
@@ -121,7 +132,18 @@ func parseInfluxMonitorConfig(config InfluxMonitorConfig) (*influxMonitorCfg, er
 		return nil, errors.Errorf("%v can not be greater than %v", bufferSizeParamName, maxBufferSizeParamName)
 	}
 
-	return &influxMonitorCfg{
+	spoolDir := values.Get(spoolDirParamName)
+	var spoolMaxSize int
+	if spoolDir != "" {
+		spoolMaxSize, err = getBufferSize(values, spoolMaxSizeParamName, defaultSpoolMaxSize)
+		if err != nil {
+			return nil, err
+		}
+	} else if values.Get(spoolMaxSizeParamName) != "" {
+		return nil, errors.Errorf("%v requires %v", spoolMaxSizeParamName, spoolDirParamName)
+	}
+
+	cfg := &influxMonitorCfg{
 		Scheme:             u.Scheme,
 		Host:               u.Host,
 		Addr:               fmt.Sprintf("%s://%s", u.Scheme, u.Host),
@@ -132,12 +154,22 @@ func parseInfluxMonitorConfig(config InfluxMonitorConfig) (*influxMonitorCfg, er
 		BufferSize:         bufferSize,
 		MaxBufferSize:      maxBufferSize,
 		ServiceName:        values.Get(serviceNameParamName),
-	}, nil
+		SpoolDir:           spoolDir,
+		SpoolMaxSize:       spoolMaxSize,
+	}
+
+	if u.Scheme == influxdb2Scheme {
+		if err := parseInfluxdb2Config(cfg, values); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
 }
 
 // NewInfluxdbMonitor creates new monitoring influxdb
 // client. config URL syntax is
-// `https://<username>:<password>@<influxDB host>/<database>?batch-write-interval=timeDuration&buffer-size=number&max-buffer-size=number&service-name=name`
+// `https://<username>:<password>@<influxDB host>/<database>?batch-write-interval=timeDuration&buffer-size=number&max-buffer-size=number&service-name=name&spool-dir=path&spool-max-size=bytes`
 // batch-write-interval is optional, default is 60s,
 // valid time units are "ns", "us" (or "µs"), "ms", "s", "m", "h".
 //   exec batch write when we haven't sent data since batch-write-interval ago
@@ -147,11 +179,36 @@ func parseInfluxMonitorConfig(config InfluxMonitorConfig) (*influxMonitorCfg, er
 //   if the batch write fails and buffered size reach max-buffer-size then clean up the buffer (mean the data is lost).
 // service-name is optional
 //   if set then all points will add tag service=service-name.
+// spool-dir is optional
+//   if set then failed batch writes are saved to segment files in this
+//   directory (instead of being buffered in memory), and written to
+//   InfluxDB, oldest first, when writes succeed again. Spooled
+//   segments are kept across restarts.
+// spool-max-size is optional, default is 104857600 (100MiB),
+//   when spooled segments are larger than spool-max-size bytes, the
+//   oldest segments are removed (mean the data is lost).
+//
+// For InfluxDB 2.x, config URL syntax is
+// `influxdb2://<token>@<influxDB host>/<bucket>?org=name&precision=ns|us|ms|s&gzip=true&tls=false`,
+// with the other parameters as above. Points are written with the
+// `/api/v2/write` API, authenticated with the token (which must be
+// URL-encoded). org is required. precision is optional, default is ns.
+// gzip is optional, default is false, if true then request bodies are
+// gzipped. tls is optional, default is true, if false then InfluxDB is
+// accessed with http instead of https.
+//
+// Points are queued in a bounded, lock-free queue (with capacity of
+// max-buffer-size, rounded up to a power of two) for the batching
+// goroutine, so that the Monitor's methods never block. When the queue
+// is full, points are dropped. Each batch also includes metrics about
+// the monitor itself: influxdb-queue-length, influxdb-queued,
+// influxdb-dropped, influxdb-write-latency and influxdb-write-failures.
 //
 // The second return value is a function that will cause the batching
-// goroutine to write buffered points, then terminate. This function
-// will block until one attempt to flush the buffer completes (either
-// success or failure).
+// goroutine to write queued and buffered points, then terminate. This
+// function will block until one attempt to flush the buffer completes
+// (either success or failure). Points inserted after this function is
+// called are discarded.
 //
 // The third return value will be non-nil if monitorURL is invalid or
 // not absolute.
@@ -165,6 +222,10 @@ func NewInfluxdbMonitor(config InfluxMonitorConfig, logger log.Logger) (Monitor,
 		return nil, func() {}, err
 	}
 
+	if cfg.Scheme == influxdb2Scheme {
+		return NewInfluxdbMonitorWithClient(config, logger, newInfluxdb2Client(cfg))
+	}
+
 	httpConfig := influxdb.HTTPConfig{
 		Addr:     cfg.Addr,
 		Username: cfg.Username,
@@ -188,23 +249,15 @@ func NewInfluxdbMonitorWithClient(config InfluxMonitorConfig, logger log.Logger,
 
 	logger = logger.With("context", "appkit/monitoring.influxdb")
 
-	monitor := &influxdbMonitor{
-		database: cfg.Database,
-		client:   client,
-		logger:   logger,
+	monitor := newInfluxdbMonitor(client, cfg, logger)
 
-		pointChan:          make(chan *influxdb.Point),
-		batchWriteInterval: cfg.BatchWriteInterval,
-		bufferSize:         cfg.BufferSize,
-		maxBufferSize:      cfg.MaxBufferSize,
-
-		done: &sync.WaitGroup{},
-
-		serviceName: cfg.ServiceName,
+	if cfg.SpoolDir != "" {
+		monitor.spool, err = newSpool(cfg.SpoolDir, int64(cfg.SpoolMaxSize), logger)
+		if err != nil {
+			return nil, func() {}, err
+		}
 	}
 
-	running := make(chan struct{})
-
 	logger = logger.With(
 		"scheme", cfg.Scheme,
 		"username", cfg.Username,
@@ -229,7 +282,7 @@ func NewInfluxdbMonitorWithClient(config InfluxMonitorConfig, logger log.Logger,
 			select {
 			case <-t.C:
 				// continue
-			case <-running:
+			case <-monitor.running:
 				_ = logger.Info().Log(
 					"during", "influxdb.Client.Ping",
 					"msg", "influxdb monitor closed, stopping influxdb pings",
@@ -240,7 +293,7 @@ func NewInfluxdbMonitorWithClient(config InfluxMonitorConfig, logger log.Logger,
 		}
 	}()
 
-	go monitor.batchWriteDaemon(running)
+	monitor.start()
 
 	_ = logger.Info().Log(
 		"msg", fmt.Sprintf("influxdb instrumentation writing to %s://%s@%s/%s", cfg.Scheme, cfg.Username, cfg.Host, monitor.database),
@@ -248,17 +301,49 @@ func NewInfluxdbMonitorWithClient(config InfluxMonitorConfig, logger log.Logger,
 		"buffer-size", cfg.BufferSize,
 		"max-buffer-size", cfg.MaxBufferSize,
 		"service-name", cfg.ServiceName,
+		"spool-dir", cfg.SpoolDir,
 	)
 
 	return monitor, func() {
 		_ = logger.Debug().Log(
 			"msg", "closing influxdb monitor",
 		)
-		close(running)
-		monitor.done.Wait()
+		monitor.close()
 	}, nil
 }
 
+const (
+	// minQueueSize is the minimum capacity of the queue between
+	// InsertRecord and the batching goroutine.
+	minQueueSize = 64
+
+	// spoolReplayInterval paces writes of spooled segments, and
+	// failed replays are retried with exponential backoff between
+	// minSpoolReplayBackoff and maxSpoolReplayBackoff.
+	spoolReplayInterval   = 100 * time.Millisecond
+	minSpoolReplayBackoff = time.Second
+	maxSpoolReplayBackoff = time.Minute
+)
+
+func newInfluxdbMonitor(client influxdb.Client, cfg *influxMonitorCfg, logger log.Logger) *influxdbMonitor {
+	return &influxdbMonitor{
+		database: cfg.Database,
+		client:   client,
+		logger:   logger,
+
+		queue:              newRing[*influxdb.Point](max(cfg.MaxBufferSize, minQueueSize)),
+		notify:             make(chan struct{}, 1),
+		running:            make(chan struct{}),
+		batchWriteInterval: cfg.BatchWriteInterval,
+		bufferSize:         cfg.BufferSize,
+		maxBufferSize:      cfg.MaxBufferSize,
+
+		done: &sync.WaitGroup{},
+
+		serviceName: cfg.ServiceName,
+	}
+}
+
 // InfluxdbMonitor implements monitor.Monitor interface, it wraps
 // the influxdb client configuration.
 type influxdbMonitor struct {
@@ -266,11 +351,31 @@ type influxdbMonitor struct {
 	database string
 	logger   log.Logger
 
-	pointChan          chan *influxdb.Point
+	// queue holds points from InsertRecord until batchWriteDaemon
+	// moves them into its buffer. InsertRecord drops (and counts in
+	// dropped) points when the queue is full, rather than blocking.
+	queue   *ring[*influxdb.Point]
+	notify  chan struct{}
+	dropped atomic.Int64
+
+	running   chan struct{}
+	closed    atomic.Bool
+	closeOnce sync.Once
+
 	batchWriteInterval time.Duration
 	bufferSize         int
 	maxBufferSize      int
 
+	// only used by batchWriteDaemon, reported with each batch write
+	lastWriteLatency time.Duration
+	writeFailures    int
+
+	// spool, if not nil, persists failed batches. Only used by
+	// batchWriteDaemon, which replays them when replayAt fires.
+	spool         *spool
+	replayAt      <-chan time.Time
+	replayBackoff time.Duration
+
 	// We need a pointer here since:
 	//
 	// > A WaitGroup must not be copied after first use.
@@ -281,8 +386,30 @@ type influxdbMonitor struct {
 	serviceName string
 }
 
-func (im influxdbMonitor) batchWriteDaemon(running chan struct{}) {
+// close stops batchWriteDaemon after it writes the queued and
+// buffered points, and waits for it to finish. Points inserted after
+// close are discarded.
+func (im *influxdbMonitor) close() {
+	im.closeOnce.Do(func() {
+		im.closed.Store(true)
+		close(im.running)
+		im.done.Wait()
+	})
+}
+
+// start starts batchWriteDaemon. done is incremented before the
+// goroutine starts, so that close always waits for the final flush.
+func (im *influxdbMonitor) start() {
+	// replay batches spooled by a previous process
+	if im.spool != nil && !im.spool.empty() {
+		im.replayAt = time.After(0)
+	}
+
 	im.done.Add(1)
+	go im.batchWriteDaemon()
+}
+
+func (im *influxdbMonitor) batchWriteDaemon() {
 	defer func() {
 		im.done.Done()
 
@@ -306,14 +433,15 @@ func (im influxdbMonitor) batchWriteDaemon(running chan struct{}) {
 
 			after = time.After(im.batchWriteInterval)
 
-		case pt := <-im.pointChan:
-			points = append(points, pt)
+		case <-im.notify:
+			im.dequeue(&points, &nextWriteBufferSize)
 
-			if len(points) >= nextWriteBufferSize {
-				im.batchWriteAndHandleErr(&points, &nextWriteBufferSize)
-			}
+		case <-im.replayAt:
+			im.replaySpool()
+
+		case <-im.running:
+			im.dequeue(&points, &nextWriteBufferSize)
 
-		case <-running:
 			_ = im.logger.Debug().Log(
 				"msg", "influxdb monitor buffer closed, flushing buffer",
 				"point_count", len(points),
@@ -326,6 +454,23 @@ func (im influxdbMonitor) batchWriteDaemon(running chan struct{}) {
 
 }
 
+// dequeue moves all queued points into *points, writing them whenever
+// *nextWriteBufferSize points are buffered.
+func (im *influxdbMonitor) dequeue(points *[]*influxdb.Point, nextWriteBufferSize *int) {
+	for {
+		pt, ok := im.queue.pop()
+		if !ok {
+			return
+		}
+
+		*points = append(*points, pt)
+
+		if len(*points) >= *nextWriteBufferSize {
+			im.batchWriteAndHandleErr(points, nextWriteBufferSize)
+		}
+	}
+}
+
 func increaseBufferSize(nextWriteBufferSize, bufferSize, maxBufferSize int) int {
 	newSize := nextWriteBufferSize + bufferSize
 	if newSize > maxBufferSize {
@@ -335,22 +480,72 @@ func increaseBufferSize(nextWriteBufferSize, bufferSize, maxBufferSize int) int
 	}
 }
 
+// selfMetrics returns points about the monitor itself, written with
+// each batch:
+//
+//   - influxdb-queue-length: number of buffered points being written
+//   - influxdb-queued: number of points waiting in the queue
+//   - influxdb-dropped: number of points dropped since the last
+//     successful write, as the queue was full
+//   - influxdb-write-latency: duration of the previous write, in
+//     milliseconds
+//   - influxdb-write-failures: number of failed writes since the last
+//     successful write
+func (im *influxdbMonitor) selfMetrics(queueLength int, dropped int64) []*influxdb.Point {
+	now := time.Now()
+	metrics := []struct {
+		measurement string
+		value       interface{}
+	}{
+		{"influxdb-queue-length", queueLength},
+		{"influxdb-queued", im.queue.len()},
+		{"influxdb-dropped", dropped},
+		{"influxdb-write-latency", float64(im.lastWriteLatency) / float64(time.Millisecond)},
+		{"influxdb-write-failures", im.writeFailures},
+	}
+
+	points := make([]*influxdb.Point, 0, len(metrics))
+	for _, m := range metrics {
+		if pt, err := im.newRecord(m.measurement, m.value, nil, nil, now); err == nil {
+			points = append(points, pt)
+		}
+	}
+	return points
+}
+
 // *points will be set to nil if write successful.
-func (im influxdbMonitor) batchWriteAndHandleErr(points *[]*influxdb.Point, nextWriteBufferSize *int) {
+func (im *influxdbMonitor) batchWriteAndHandleErr(points *[]*influxdb.Point, nextWriteBufferSize *int) {
 	if points == nil || len(*points) == 0 {
 		return
 	}
 
-	var newPoints []*influxdb.Point
-	pt, err := im.newRecord("influxdb-queue-length", len(*points), nil, nil, time.Now())
-	if err != nil {
-		newPoints = *points
-	} else {
-		newPoints = append(*points, pt)
+	dropped := im.dropped.Swap(0)
+	if dropped > 0 {
+		_ = im.logger.Warn().Log(
+			"msg", fmt.Sprintf("influxdb monitor queue full, dropped %d points", dropped),
+			"dropped", dropped,
+			"queue_size", im.queue.cap(),
+		)
 	}
 
-	err = im.batchWrite(newPoints)
+	newPoints := append(*points, im.selfMetrics(len(*points), dropped)...)
+
+	start := time.Now()
+	err := im.batchWrite(newPoints)
+	im.lastWriteLatency = time.Since(start)
+
 	if err != nil {
+		im.writeFailures++
+
+		if im.spoolBatch(newPoints) {
+			*points = nil
+			*nextWriteBufferSize = im.bufferSize
+			return
+		}
+
+		// report the dropped points with the next write
+		im.dropped.Add(dropped)
+
 		*nextWriteBufferSize = increaseBufferSize(*nextWriteBufferSize, im.bufferSize, im.maxBufferSize)
 
 		if len(*points) >= im.maxBufferSize {
@@ -360,12 +555,90 @@ func (im influxdbMonitor) batchWriteAndHandleErr(points *[]*influxdb.Point, next
 			)
 		}
 	} else {
+		im.writeFailures = 0
 		*points = nil
 		*nextWriteBufferSize = im.bufferSize
+
+		// InfluxDB is available again, start replaying now
+		if im.spool != nil && !im.spool.empty() {
+			im.replayBackoff = 0
+			im.replayAt = time.After(0)
+		}
+	}
+}
+
+// spoolBatch saves points in the spool, returning false if there is no
+// spool or saving failed.
+func (im *influxdbMonitor) spoolBatch(points []*influxdb.Point) bool {
+	if im.spool == nil {
+		return false
 	}
+
+	if err := im.spool.write(points); err != nil {
+		_ = im.logger.Error().Log(
+			"err", err,
+			"during", "influxdb.spool.write",
+			"msg", fmt.Sprintf("couldn't spool influxdb batch: %v", err),
+		)
+		return false
+	}
+
+	if im.replayAt == nil {
+		im.scheduleReplayRetry()
+	}
+	return true
 }
 
-func (im influxdbMonitor) batchWrite(points []*influxdb.Point) error {
+// replaySpool writes the oldest spooled segment, and schedules the
+// next replay.
+func (im *influxdbMonitor) replaySpool() {
+	im.replayAt = nil
+
+	name, points, err := im.spool.oldest()
+	if name == "" {
+		if err != nil {
+			_ = im.logger.Error().Log(
+				"err", err,
+				"during", "influxdb.spool.oldest",
+				"msg", fmt.Sprintf("couldn't read influxdb spool: %v", err),
+			)
+			im.scheduleReplayRetry()
+		}
+		return
+	}
+
+	if err != nil {
+		// an unreadable segment would block replay forever
+		_ = im.logger.Error().Log(
+			"err", err,
+			"during", "influxdb.spool.oldest",
+			"msg", fmt.Sprintf("discarding influxdb spool segment %v: %v", name, err),
+		)
+	} else if err := im.batchWrite(points); err != nil {
+		im.scheduleReplayRetry()
+		return
+	}
+
+	if err := im.spool.remove(name); err != nil {
+		_ = im.logger.Error().Log(
+			"err", err,
+			"during", "influxdb.spool.remove",
+			"msg", fmt.Sprintf("couldn't remove influxdb spool segment: %v", err),
+		)
+		im.scheduleReplayRetry()
+		return
+	}
+
+	im.replayBackoff = 0
+	im.replayAt = time.After(spoolReplayInterval)
+}
+
+func (im *influxdbMonitor) scheduleReplayRetry() {
+	im.replayBackoff = min(max(im.replayBackoff*2, minSpoolReplayBackoff), maxSpoolReplayBackoff)
+	im.replayAt = time.After(im.replayBackoff)
+}
+
+func (im *influxdbMonitor) batchWrite(points []*influxdb.Point) error {
 	bp, err := influxdb.NewBatchPoints(influxdb.BatchPointsConfig{
 		Database: im.database,
 	})
@@ -402,7 +675,7 @@ func (im influxdbMonitor) batchWrite(points []*influxdb.Point) error {
 	})
 }
 
-func (im influxdbMonitor) newRecord(measurement string, value interface{}, tags map[string]string, fields map[string]interface{}, at time.Time) (*influxdb.Point, error) {
+func (im *influxdbMonitor) newRecord(measurement string, value interface{}, tags map[string]string, fields map[string]interface{}, at time.Time) (*influxdb.Point, error) {
 	if fields == nil {
 		fields = map[string]interface{}{}
 	}
@@ -435,28 +708,43 @@ func (im influxdbMonitor) newRecord(measurement string, value interface{}, tags
 	return pt, nil
 }
 
-// InsertRecord part of monitor.Monitor.
-func (im influxdbMonitor) InsertRecord(measurement string, value interface{}, tags map[string]string, fields map[string]interface{}, at time.Time) {
+// InsertRecord part of monitor.Monitor. InsertRecord doesn't block:
+// if the queue is full, the point is dropped and counted in the
+// `influxdb-dropped` metric.
+func (im *influxdbMonitor) InsertRecord(measurement string, value interface{}, tags map[string]string, fields map[string]interface{}, at time.Time) {
+	if im.closed.Load() {
+		return
+	}
+
 	pt, err := im.newRecord(measurement, value, tags, fields, at)
 	if err != nil {
 		return
 	}
 
-	im.pointChan <- pt
+	if !im.queue.push(pt) {
+		im.dropped.Add(1)
+		return
+	}
+
+	select {
+	case im.notify <- struct{}{}:
+	default:
+		// batchWriteDaemon already has a pending notification
+	}
 }
 
-func (im influxdbMonitor) Count(measurement string, value float64, tags map[string]string, fields map[string]interface{}) {
+func (im *influxdbMonitor) Count(measurement string, value float64, tags map[string]string, fields map[string]interface{}) {
 	im.InsertRecord(measurement, value, tags, fields, time.Now())
 }
 
 // CountError logs a value in measurement, with the given error's
 // message stored in an `error` tag.
-func (im influxdbMonitor) CountError(measurement string, value float64, err error) {
+func (im *influxdbMonitor) CountError(measurement string, value float64, err error) {
 	data := map[string]string{"error": err.Error()}
 	im.Count(measurement, value, data, nil)
 }
 
 // CountSimple logs a value in measurement (with no tags).
-func (im influxdbMonitor) CountSimple(measurement string, value float64) {
+func (im *influxdbMonitor) CountSimple(measurement string, value float64) {
 	im.Count(measurement, value, nil, nil)
 }
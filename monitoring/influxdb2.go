@@ -0,0 +1,217 @@
+package monitoring
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	influxdb "github.com/influxdata/influxdb1-client/v2"
+	"github.com/pkg/errors"
+)
+
+const (
+	influxdb2Scheme = "influxdb2"
+
+	defaultInfluxdb2Precision = "ns"
+
+	orgParamName       = "org"
+	precisionParamName = "precision"
+	gzipParamName      = "gzip"
+	tlsParamName       = "tls"
+)
+
+// influxdb2Precisions maps InfluxDB 2.x write precisions to the
+// precisions of influxdb.Point.PrecisionString.
+var influxdb2Precisions = map[string]string{
+	"ns": "n",
+	"us": "u",
+	"ms": "ms",
+	"s":  "s",
+}
+
+// parseInfluxdb2Config replaces cfg's username and password with the
+// token, and sets the InfluxDB 2.x parameters from values.
+func parseInfluxdb2Config(cfg *influxMonitorCfg, values url.Values) error {
+	cfg.Token = cfg.Username
+	cfg.Username = ""
+	cfg.Password = ""
+
+	cfg.Org = values.Get(orgParamName)
+	if cfg.Org == "" {
+		return errors.Errorf("influxdb config parameter %s is required for %s urls", orgParamName, influxdb2Scheme)
+	}
+
+	cfg.Precision = defaultInfluxdb2Precision
+	if precision := values.Get(precisionParamName); precision != "" {
+		if _, ok := influxdb2Precisions[precision]; !ok {
+			return errors.Errorf(`influxdb config parameter %s format error, valid precisions are "ns", "us", "ms", "s"`, precisionParamName)
+		}
+		cfg.Precision = precision
+	}
+
+	if gz := values.Get(gzipParamName); gz != "" {
+		var err error
+		cfg.Gzip, err = strconv.ParseBool(gz)
+		if err != nil {
+			return errors.Wrapf(err, "influxdb config parameter %s format error", gzipParamName)
+		}
+	}
+
+	scheme := "https"
+	if tls := values.Get(tlsParamName); tls != "" {
+		useTLS, err := strconv.ParseBool(tls)
+		if err != nil {
+			return errors.Wrapf(err, "influxdb config parameter %s format error", tlsParamName)
+		}
+		if !useTLS {
+			scheme = "http"
+		}
+	}
+	cfg.Addr = fmt.Sprintf("%s://%s", scheme, cfg.Host)
+
+	return nil
+}
+
+var errInfluxdb2Query = errors.New("queries are not supported by the influxdb2 monitoring client")
+
+// influxdb2Client is an influxdb.Client that writes points with the
+// InfluxDB 2.x `/api/v2/write` API, so that influxdbMonitor's batching
+// can be used with InfluxDB 2.x. Queries aren't supported.
+type influxdb2Client struct {
+	writeURL   string
+	pingURL    string
+	token      string
+	precision  string
+	gzip       bool
+	httpClient *http.Client
+}
+
+func newInfluxdb2Client(cfg *influxMonitorCfg) *influxdb2Client {
+	q := url.Values{
+		"org":       {cfg.Org},
+		"bucket":    {cfg.Database},
+		"precision": {cfg.Precision},
+	}
+
+	return &influxdb2Client{
+		writeURL:   cfg.Addr + "/api/v2/write?" + q.Encode(),
+		pingURL:    cfg.Addr + "/ping",
+		token:      cfg.Token,
+		precision:  cfg.Precision,
+		gzip:       cfg.Gzip,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Ping checks that InfluxDB is available, returning the time taken and
+// InfluxDB's version.
+func (c *influxdb2Client) Ping(timeout time.Duration) (time.Duration, string, error) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.pingURL, nil)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "couldn't create influxdb2 ping request")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "influxdb2 ping failed")
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return 0, "", errors.Errorf("influxdb2 ping failed: %s", resp.Status)
+	}
+
+	return time.Since(start), resp.Header.Get("X-Influxdb-Version"), nil
+}
+
+// Write writes bp's points to InfluxDB in line protocol. bp's database
+// and precision are ignored, points are written to the configured
+// bucket with the configured precision.
+func (c *influxdb2Client) Write(bp influxdb.BatchPoints) error {
+	var b bytes.Buffer
+
+	var w io.Writer = &b
+	var gz *gzip.Writer
+	if c.gzip {
+		gz = gzip.NewWriter(&b)
+		w = gz
+	}
+
+	precision := influxdb2Precisions[c.precision]
+	for _, pt := range bp.Points() {
+		if _, err := io.WriteString(w, pt.PrecisionString(precision)+"\n"); err != nil {
+			return errors.Wrap(err, "couldn't encode influxdb2 points")
+		}
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return errors.Wrap(err, "couldn't encode influxdb2 points")
+		}
+	}
+
+	req, err := http.NewRequest("POST", c.writeURL, &b)
+	if err != nil {
+		return errors.Wrap(err, "couldn't create influxdb2 write request")
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if c.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Token "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "influxdb2 write failed")
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("influxdb2 write failed: %s: %s", resp.Status, influxdb2ErrorMessage(body))
+	}
+	return nil
+}
+
+// influxdb2ErrorMessage returns the message of an InfluxDB 2.x JSON
+// error response (eg. `{"code":"unauthorized","message":"unauthorized access"}`),
+// or the body if it isn't JSON.
+func influxdb2ErrorMessage(body []byte) string {
+	var e struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &e); err == nil && e.Message != "" {
+		return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+	}
+	return strings.TrimSpace(string(body))
+}
+
+func (c *influxdb2Client) Query(influxdb.Query) (*influxdb.Response, error) {
+	return nil, errInfluxdb2Query
+}
+
+func (c *influxdb2Client) QueryAsChunk(influxdb.Query) (*influxdb.ChunkedResponse, error) {
+	return nil, errInfluxdb2Query
+}
+
+func (c *influxdb2Client) Close() error {
+	c.httpClient.CloseIdleConnections()
+	return nil
+}
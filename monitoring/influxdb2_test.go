@@ -0,0 +1,133 @@
+package monitoring
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+	influxdb "github.com/influxdata/influxdb1-client/v2"
+	"github.com/theplant/appkit/log"
+	"github.com/theplant/testingutils/errorassert"
+	"github.com/theplant/testingutils/fatalassert"
+)
+
+func TestParseInfluxMonitorConfig_Influxdb2(t *testing.T) {
+	cfg, err := parseInfluxMonitorConfig("influxdb2://my%2Ftoken@localhost:8086/metrics?org=acme&precision=ms&gzip=true&tls=false&service-name=api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errorassert.Equal(t, &influxMonitorCfg{
+		Scheme:             "influxdb2",
+		Host:               "localhost:8086",
+		Addr:               "http://localhost:8086",
+		Database:           "metrics",
+		BatchWriteInterval: defaultBatchWriteInterval,
+		BufferSize:         defaultBufferSize,
+		MaxBufferSize:      defaultMaxBufferSize,
+		ServiceName:        "api",
+		Org:                "acme",
+		Token:              "my/token",
+		Precision:          "ms",
+		Gzip:               true,
+	}, cfg)
+
+	cfg, err = parseInfluxMonitorConfig("influxdb2://token@localhost:8086/metrics?org=acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fatalassert.Equal(t, "https://localhost:8086", cfg.Addr)
+	fatalassert.Equal(t, "ns", cfg.Precision)
+
+	for config, expectedErrContains := range map[string]string{
+		"influxdb2://token@localhost:8086/metrics":                   "influxdb config parameter org is required",
+		"influxdb2://token@localhost:8086/metrics?org=a&precision=m": "influxdb config parameter precision format error",
+		"influxdb2://token@localhost:8086/metrics?org=a&gzip=maybe":  "influxdb config parameter gzip format error",
+	} {
+		_, err := parseInfluxMonitorConfig(InfluxMonitorConfig(config))
+		if err == nil || !strings.Contains(err.Error(), expectedErrContains) {
+			t.Errorf("%s: expected error containing %q, got %v", config, expectedErrContains, err)
+		}
+	}
+}
+
+func TestInfluxdb2Monitor(t *testing.T) {
+	var mu sync.Mutex
+	var points []models.Point
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if r.Method != "POST" || r.URL.Path != "/api/v2/write" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		for param, expected := range map[string]string{"org": "acme", "bucket": "metrics", "precision": "ms"} {
+			if v := r.URL.Query().Get(param); v != expected {
+				t.Errorf("expected %s %q, got %q", param, expected, v)
+			}
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Token s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"code":"unauthorized","message":"unauthorized access"}`)
+			return
+		}
+
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = gz
+		}
+		buf, _ := io.ReadAll(body)
+
+		parsed, err := models.ParsePointsWithPrecision(buf, time.Now(), "ms")
+		if err != nil {
+			t.Errorf("invalid line protocol %q: %v", buf, err)
+		}
+
+		mu.Lock()
+		points = append(points, parsed...)
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	addr := strings.TrimPrefix(server.URL, "http://")
+	monitor, closer, err := NewInfluxdbMonitor(InfluxMonitorConfig("influxdb2://s3cr3t@"+addr+"/metrics?org=acme&precision=ms&gzip=true&tls=false&service-name=api"), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	monitor.InsertRecord("request", 12.5, map[string]string{"path": "/users/{id}"}, nil, at)
+	closer()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	fatalassert.Equal(t, 1+selfMetricCount, len(points))
+	fatalassert.Equal(t, "request", string(points[0].Name()))
+	fatalassert.Equal(t, map[string]string{"path": "/users/{id}", "service": "api"}, points[0].Tags().Map())
+	fatalassert.Equal(t, at, points[0].Time().UTC())
+
+	// failed writes return InfluxDB's error message
+	client := newInfluxdb2Client(&influxMonitorCfg{Addr: server.URL, Org: "acme", Database: "metrics", Precision: "ms", Token: "wrong"})
+	bp, _ := influxdb.NewBatchPoints(influxdb.BatchPointsConfig{})
+	err = client.Write(bp)
+	if err == nil || !strings.Contains(err.Error(), "401 Unauthorized: unauthorized access (unauthorized)") {
+		t.Errorf("expected unauthorized error, got %v", err)
+	}
+}
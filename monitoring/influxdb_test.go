@@ -90,6 +90,28 @@ func TestParseInfluxMonitorConfig(t *testing.T) {
 			},
 		},
 
+		{
+			name:   "spool-dir, default spool-max-size",
+			config: "http://localhost:8086/local?spool-dir=/var/spool/influxdb",
+			expectedCfg: &influxMonitorCfg{
+				Scheme:             "http",
+				Host:               "localhost:8086",
+				Addr:               "http://localhost:8086",
+				Database:           "local",
+				BatchWriteInterval: defaultBatchWriteInterval,
+				BufferSize:         defaultBufferSize,
+				MaxBufferSize:      defaultMaxBufferSize,
+				SpoolDir:           "/var/spool/influxdb",
+				SpoolMaxSize:       defaultSpoolMaxSize,
+			},
+		},
+
+		{
+			name:                "spool-max-size without spool-dir error",
+			config:              "http://localhost:8086/local?spool-max-size=1000",
+			expectedErrContains: "spool-max-size requires spool-dir",
+		},
+
 		{
 			name:                "batch-write-interval format error, missing unit in duration",
 			config:              "http://localhost:8086/local?batch-write-interval=30",
@@ -131,30 +153,23 @@ func TestParseInfluxMonitorConfig(t *testing.T) {
 }
 
 func newMonitor(client influxdb.Client, bufferSize int, maxBufferSize int, serviceName string) (monitor *influxdbMonitor, closeFunc func()) {
-	monitor = &influxdbMonitor{
-		database: "test_database",
-		client:   client,
-		logger:   log.NewNopLogger(),
-
-		pointChan:          make(chan *influxdb.Point),
-		batchWriteInterval: time.Second * 1,
-		bufferSize:         bufferSize,
-		maxBufferSize:      maxBufferSize,
+	monitor = newInfluxdbMonitor(client, &influxMonitorCfg{
+		Database:           "test_database",
+		BatchWriteInterval: time.Second * 1,
+		BufferSize:         bufferSize,
+		MaxBufferSize:      maxBufferSize,
+		ServiceName:        serviceName,
+	}, log.NewNopLogger())
 
-		done: &sync.WaitGroup{},
+	monitor.start()
 
-		serviceName: serviceName,
-	}
-
-	running := make(chan struct{})
-	go monitor.batchWriteDaemon(running)
-
-	return monitor, func() {
-		close(running)
-		monitor.done.Wait()
-	}
+	return monitor, monitor.close
 }
 
+// selfMetricCount is the number of points about the monitor itself
+// written with each batch.
+const selfMetricCount = 5
+
 func insertRecords(monitor Monitor, callTimes int) {
 	for i := 0; i < callTimes; i++ {
 		monitor.InsertRecord("measurement", "value", nil, nil, time.Now())
@@ -192,22 +207,22 @@ func TestInfluxdbBatchWrite(t *testing.T) {
 	insertRecords(monitor, 1000)
 
 	// reach BufferSize
-	assertWriteCalls(t, mockedClient, 1, []int{5001})
+	assertWriteCalls(t, mockedClient, 1, []int{5000 + selfMetricCount})
 
 	insertRecords(monitor, 11000)
 
 	// reach BufferSize twice and remain 1000
-	assertWriteCalls(t, mockedClient, 3, []int{5001, 5001, 5001})
+	assertWriteCalls(t, mockedClient, 3, []int{5000 + selfMetricCount, 5000 + selfMetricCount, 5000 + selfMetricCount})
 
 	insertRecords(monitor, 1000)
 
 	// not reach BufferSize, len(points) = 2000
-	assertWriteCalls(t, mockedClient, 3, []int{5001, 5001, 5001})
+	assertWriteCalls(t, mockedClient, 3, []int{5000 + selfMetricCount, 5000 + selfMetricCount, 5000 + selfMetricCount})
 
 	time.Sleep(time.Second * 1)
 
 	// ticker is triggered
-	assertWriteCalls(t, mockedClient, 4, []int{5001, 5001, 5001, 2001})
+	assertWriteCalls(t, mockedClient, 4, []int{5000 + selfMetricCount, 5000 + selfMetricCount, 5000 + selfMetricCount, 2000 + selfMetricCount})
 }
 
 func TestInfluxdbBatchWrite__WriteFailed(t *testing.T) {
@@ -225,21 +240,21 @@ func TestInfluxdbBatchWrite__WriteFailed(t *testing.T) {
 	// nextWriteBufferSize = 10000
 	// len(points) = 5000
 
-	assertWriteCalls(t, mockedClient, 1, []int{5001})
+	assertWriteCalls(t, mockedClient, 1, []int{5000 + selfMetricCount})
 
 	insertRecords(monitor, 10000)
 
 	// nextWriteBufferSize = 16000
 	// len(points) = 15000
 
-	assertWriteCalls(t, mockedClient, 3, []int{5001, 10001, 15001})
+	assertWriteCalls(t, mockedClient, 3, []int{5000 + selfMetricCount, 10000 + selfMetricCount, 15000 + selfMetricCount})
 
 	insertRecords(monitor, 100)
 
 	// nextWriteBufferSize = 16000
 	// len(points) = 15100
 
-	assertWriteCalls(t, mockedClient, 3, []int{5001, 10001, 15001})
+	assertWriteCalls(t, mockedClient, 3, []int{5000 + selfMetricCount, 10000 + selfMetricCount, 15000 + selfMetricCount})
 
 	insertRecords(monitor, 2000)
 
@@ -247,7 +262,7 @@ func TestInfluxdbBatchWrite__WriteFailed(t *testing.T) {
 	// len(points) = 16000
 	// 16000 points is lost
 
-	assertWriteCalls(t, mockedClient, 4, []int{5001, 10001, 15001, 16001})
+	assertWriteCalls(t, mockedClient, 4, []int{5000 + selfMetricCount, 10000 + selfMetricCount, 15000 + selfMetricCount, 16000 + selfMetricCount})
 
 	time.Sleep(time.Second * 1)
 
@@ -256,7 +271,7 @@ func TestInfluxdbBatchWrite__WriteFailed(t *testing.T) {
 	// nextWriteBufferSize = 16000
 	// len(points) = 1100
 
-	assertWriteCalls(t, mockedClient, 5, []int{5001, 10001, 15001, 16001, 1101})
+	assertWriteCalls(t, mockedClient, 5, []int{5000 + selfMetricCount, 10000 + selfMetricCount, 15000 + selfMetricCount, 16000 + selfMetricCount, 1100 + selfMetricCount})
 
 	insertRecords(monitor, 10000)
 
@@ -264,7 +279,7 @@ func TestInfluxdbBatchWrite__WriteFailed(t *testing.T) {
 	// len(points) = 11100
 	// not trigger batch write
 
-	assertWriteCalls(t, mockedClient, 5, []int{5001, 10001, 15001, 16001, 1101})
+	assertWriteCalls(t, mockedClient, 5, []int{5000 + selfMetricCount, 10000 + selfMetricCount, 15000 + selfMetricCount, 16000 + selfMetricCount, 1100 + selfMetricCount})
 
 	// the influxdb is recover to normal
 
@@ -279,11 +294,11 @@ func TestInfluxdbBatchWrite__WriteFailed(t *testing.T) {
 	// nextWriteBufferSize = 5000
 	// len(points) = 16000
 
-	assertWriteCalls(t, mockedClient, 1, []int{16001})
+	assertWriteCalls(t, mockedClient, 1, []int{16000 + selfMetricCount})
 
 	insertRecords(monitor, 5000)
 
-	assertWriteCalls(t, mockedClient, 2, []int{16001, 5001})
+	assertWriteCalls(t, mockedClient, 2, []int{16000 + selfMetricCount, 5000 + selfMetricCount})
 }
 
 func TestInfluxdbBatchWrite__WriteFailed__BufferSizeAndMaxBufferSizeIsDefault(t *testing.T) {
@@ -298,17 +313,17 @@ func TestInfluxdbBatchWrite__WriteFailed__BufferSizeAndMaxBufferSizeIsDefault(t
 
 	insertRecords(monitor, 9000)
 
-	assertWriteCalls(t, mockedClient, 1, []int{5001})
+	assertWriteCalls(t, mockedClient, 1, []int{5000 + selfMetricCount})
 
 	insertRecords(monitor, 2000)
 
 	// 10000 points is lost
 
-	assertWriteCalls(t, mockedClient, 2, []int{5001, 10001})
+	assertWriteCalls(t, mockedClient, 2, []int{5000 + selfMetricCount, 10000 + selfMetricCount})
 
 	time.Sleep(time.Second)
 
-	assertWriteCalls(t, mockedClient, 3, []int{5001, 10001, 1001})
+	assertWriteCalls(t, mockedClient, 3, []int{5000 + selfMetricCount, 10000 + selfMetricCount, 1000 + selfMetricCount})
 }
 
 func TestServiceName(t *testing.T) {
@@ -366,3 +381,127 @@ func TestServiceName(t *testing.T) {
 	})
 	fatalassert.Equal(t, bp.Points()[1].Tags(), map[string]string{})
 }
+
+func TestInfluxdbMonitor_DropsWhenQueueFull(t *testing.T) {
+	writing := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	var mu sync.Mutex
+	var batches []influxdb.BatchPoints
+
+	mockedClient := &ClientMock{
+		WriteFunc: func(bp influxdb.BatchPoints) error {
+			select {
+			case writing <- struct{}{}:
+			default:
+			}
+			<-unblock
+			mu.Lock()
+			batches = append(batches, bp)
+			mu.Unlock()
+			return nil
+		},
+	}
+
+	monitor, cf := newMonitor(mockedClient, 1, 1, "")
+
+	// first point is written (and blocks the batching goroutine), the
+	// next minQueueSize are queued, and the rest are dropped
+	monitor.InsertRecord("measurement", "value", nil, nil, time.Now())
+	<-writing
+
+	done := make(chan struct{})
+	go func() {
+		insertRecords(monitor, minQueueSize+10)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("InsertRecord blocked when queue was full")
+	}
+
+	close(unblock)
+	cf()
+
+	// InsertRecord after close doesn't block or panic
+	monitor.InsertRecord("measurement", "value", nil, nil, time.Now())
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var dropped int64
+	var written int
+	for _, bp := range batches {
+		for _, pt := range bp.Points() {
+			switch pt.Name() {
+			case "measurement":
+				written++
+			case "influxdb-dropped":
+				fields, _ := pt.Fields()
+				dropped += fields["value"].(int64)
+			}
+		}
+	}
+
+	fatalassert.Equal(t, 1+minQueueSize, written)
+	fatalassert.Equal(t, int64(10), dropped)
+}
+
+func TestInfluxdbMonitor_Spool(t *testing.T) {
+	dir := t.TempDir()
+
+	var mu sync.Mutex
+	writeErr := errors.New("influxdb is down")
+	var written []string
+
+	mockedClient := &ClientMock{
+		WriteFunc: func(bp influxdb.BatchPoints) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if writeErr != nil {
+				return writeErr
+			}
+			for _, pt := range bp.Points() {
+				written = append(written, pt.Name())
+			}
+			return nil
+		},
+	}
+
+	monitor, cf := newMonitor(mockedClient, 2, 10, "")
+	monitor.spool, _ = newSpool(dir, defaultSpoolMaxSize, log.NewNopLogger())
+
+	// failed batch is spooled, and not kept in memory
+	monitor.InsertRecord("spooled", 1, nil, nil, time.Now())
+	monitor.InsertRecord("spooled", 2, nil, nil, time.Now())
+	time.Sleep(100 * time.Millisecond)
+
+	segments, _ := monitor.spool.segments()
+	fatalassert.Equal(t, 1, len(segments))
+
+	mu.Lock()
+	writeErr = nil
+	mu.Unlock()
+
+	// successful write starts replay
+	insertRecords(monitor, 2)
+	time.Sleep(100 * time.Millisecond)
+	cf()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var spooled, live int
+	for _, name := range written {
+		switch name {
+		case "spooled":
+			spooled++
+		case "measurement":
+			live++
+		}
+	}
+	fatalassert.Equal(t, 2, spooled)
+	fatalassert.Equal(t, 2, live)
+	fatalassert.Equal(t, true, monitor.spool.empty())
+}
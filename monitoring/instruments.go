@@ -0,0 +1,135 @@
+package monitoring
+
+import (
+	"context"
+	"time"
+)
+
+// Tags are the tag names of an instrument, or the tag values of a
+// metric recorded with it, as an array of up to 6 strings. As the
+// names and values have the same array type, recording a metric with
+// the wrong number of tag values is a compile error:
+//
+//	logins := monitoring.NewCounter("logins", [2]string{"method", "result"})
+//
+//	logins.Inc(ctx, [2]string{"password", "ok"})
+//	logins.Inc(ctx, [1]string{"password"}) // doesn't compile
+type Tags interface {
+	[0]string | [1]string | [2]string | [3]string | [4]string | [5]string | [6]string
+}
+
+// NoTags are the tags of an instrument without tags.
+type NoTags = [0]string
+
+func tagSlice[T Tags](tags T) []string {
+	switch t := any(tags).(type) {
+	case [1]string:
+		return t[:]
+	case [2]string:
+		return t[:]
+	case [3]string:
+		return t[:]
+	case [4]string:
+		return t[:]
+	case [5]string:
+		return t[:]
+	case [6]string:
+		return t[:]
+	}
+	return nil
+}
+
+// instrument is the name and tag names of an instrument.
+type instrument[T Tags] struct {
+	name string
+	keys []string
+}
+
+func newInstrument[T Tags](name string, keys T) instrument[T] {
+	return instrument[T]{name: name, keys: tagSlice(keys)}
+}
+
+// Name returns the measurement name of the instrument.
+func (i instrument[T]) Name() string {
+	return i.name
+}
+
+func (i instrument[T]) tags(values T) map[string]string {
+	if len(i.keys) == 0 {
+		return nil
+	}
+
+	tags := make(map[string]string, len(i.keys))
+	for n, v := range tagSlice(values) {
+		tags[i.keys[n]] = v
+	}
+	return tags
+}
+
+// Counter counts events (eg. logins), recorded with Monitor.Count.
+type Counter[T Tags] struct {
+	instrument[T]
+}
+
+// NewCounter creates a Counter for measurement name, with tags named
+// by keys.
+func NewCounter[T Tags](name string, keys T) Counter[T] {
+	return Counter[T]{newInstrument(name, keys)}
+}
+
+// Add counts delta events with the given tag values, using the
+// Monitor in ctx (see ForceContext).
+func (c Counter[T]) Add(ctx context.Context, delta float64, values T) {
+	ForceContext(ctx).Count(c.name, delta, c.tags(values), nil)
+}
+
+// Inc counts one event with the given tag values.
+func (c Counter[T]) Inc(ctx context.Context, values T) {
+	c.Add(ctx, 1, values)
+}
+
+// Gauge records the current value of something (eg. a queue's length),
+// recorded with Monitor.InsertRecord.
+type Gauge[T Tags] struct {
+	instrument[T]
+}
+
+// NewGauge creates a Gauge for measurement name, with tags named by
+// keys.
+func NewGauge[T Tags](name string, keys T) Gauge[T] {
+	return Gauge[T]{newInstrument(name, keys)}
+}
+
+// Set records value with the given tag values, using the Monitor in
+// ctx (see ForceContext).
+func (g Gauge[T]) Set(ctx context.Context, value float64, values T) {
+	ForceContext(ctx).InsertRecord(g.name, value, g.tags(values), nil, time.Now())
+}
+
+// Timer records durations in milliseconds (as for the `request`
+// measurement of WithMonitor), recorded with Monitor.InsertRecord.
+type Timer[T Tags] struct {
+	instrument[T]
+}
+
+// NewTimer creates a Timer for measurement name, with tags named by
+// keys.
+func NewTimer[T Tags](name string, keys T) Timer[T] {
+	return Timer[T]{newInstrument(name, keys)}
+}
+
+// Observe records d with the given tag values, using the Monitor in
+// ctx (see ForceContext).
+func (t Timer[T]) Observe(ctx context.Context, d time.Duration, values T) {
+	start := time.Now().Add(-d)
+	ForceContext(ctx).InsertRecord(t.name, float64(d)/float64(time.Millisecond), t.tags(values), nil, start)
+}
+
+// Time calls f, and records how long it took with the given tag
+// values. f's error is returned.
+func (t Timer[T]) Time(ctx context.Context, values T, f func() error) error {
+	start := time.Now()
+	err := f()
+	t.Observe(ctx, time.Since(start), values)
+	return err
+}
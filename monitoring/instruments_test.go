@@ -0,0 +1,44 @@
+package monitoring
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInstruments(t *testing.T) {
+	rm := &recordsMonitor{}
+	ctx := Context(context.Background(), rm)
+
+	logins := NewCounter("logins", [2]string{"method", "result"})
+	logins.Inc(ctx, [2]string{"password", "ok"})
+	logins.Add(ctx, 2, [2]string{"token", "failed"})
+
+	queue := NewGauge("queue-length", NoTags{})
+	queue.Set(ctx, 7, NoTags{})
+
+	query := NewTimer("query", [1]string{"table"})
+	query.Observe(ctx, 1500*time.Microsecond, [1]string{"users"})
+	errQuery := errors.New("timeout")
+	if err := query.Time(ctx, [1]string{"orders"}, func() error { return errQuery }); err != errQuery {
+		t.Errorf("expected Time to return f's error, got %v", err)
+	}
+
+	expected := []record{
+		{"logins", 1.0, map[string]string{"method": "password", "result": "ok"}, nil},
+		{"logins", 2.0, map[string]string{"method": "token", "result": "failed"}, nil},
+		{"queue-length", 7.0, nil, nil},
+		{"query", 1.5, map[string]string{"table": "users"}, nil},
+	}
+	if !reflect.DeepEqual(expected, rm.records[:4]) {
+		t.Errorf("expected %v, got %v", expected, rm.records)
+	}
+	if r := rm.find("query", "table", "orders"); r == nil {
+		t.Errorf("expected Time to record query duration")
+	}
+	if logins.Name() != "logins" {
+		t.Errorf("expected name logins, got %q", logins.Name())
+	}
+}
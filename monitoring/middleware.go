@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"regexp"
 	"strconv"
 	"time"
 
@@ -20,25 +19,98 @@ type key int
 const monitorKey key = iota
 
 // WithMonitor wraps the given http.Handler to:
-// 1. instrument requests via a Monitor
-// 2. install monitor in request context for use by later handlers
-func WithMonitor(m Monitor) func(h http.Handler) http.Handler {
+//
+//   - instrument requests via a Monitor
+//   - install monitor in request context for use by later handlers
+//   - install request tags (see contexts.SetRequestTag) in the request
+//     context, that are added to the request's tags
+//
+// Requests are tagged with the path of their route (eg.
+// `/users/{id}`) if WithMonitor is inside an http.ServeMux, or if they
+// are handled by a server.Router inside WithMonitor, or else with
+// their normalized path (see NormalizePath, WithPathNormalizer and
+// WithMaxPathTags). The pattern of a plain http.ServeMux inside
+// WithMonitor isn't seen by WithMonitor, as the mux sets it on its own
+// copy of the request: use a server.Router, which sets the route in
+// the request context (see contexts.Route).
+//
+// Besides the request's duration in milliseconds, request records have
+// fields:
+//
+//   - request_bytes: the bytes of the request body read by handlers
+//   - response_bytes: the bytes of the response body written
+//   - ttfb_ms: the time until the response started (its headers or
+//     first body bytes were written), to tell slow handlers from slow
+//     streaming responses
+//
+// The number of requests in flight is recorded in the
+// request-in-flight measurement, tagged with path, each time it
+// changes: when a request starts, when it is routed by a
+// server.Router, and when it finishes. Requests are counted by their
+// normalized path until they are routed.
+func WithMonitor(m Monitor, opts ...MiddlewareOption) func(h http.Handler) http.Handler {
+	options := MiddlewareOptions{}
+	for _, o := range opts {
+		o(&options)
+	}
+	paths := newPathTagger(options)
+	inFlight := &inFlight{m: m}
+
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
 			var recoveredStatusCode int
 
+			cw := &countingWriter{ResponseWriter: w}
+			w = cw.wrap()
+			var body *countingBody
+			flight := inFlight.start(paths.pathTag(r))
+
 			defer func() {
-				interval := time.Now().Sub(start)
-				go func() {
-					tags := tagsForRequest(r, recoveredStatusCode)
-					fields := fieldsForContext(r.Context())
-					m.InsertRecord("request", float64(interval/time.Millisecond), tags, fields, start)
-				}()
+				end := time.Now()
+				interval := end.Sub(start)
+				tags := tagsForRequest(r, paths.pathTag(r), recoveredStatusCode)
+				fields := fieldsForContext(r.Context())
+
+				// responses that weren't started by handlers are
+				// written after they return
+				firstByte := cw.firstByte
+				if firstByte.IsZero() {
+					firstByte = end
+				}
+				var requestBytes int64
+				if body != nil {
+					requestBytes = body.bytes
+				}
+				fields["request_bytes"] = requestBytes
+				fields["response_bytes"] = cw.bytes
+				fields["ttfb_ms"] = float64(firstByte.Sub(start)) / float64(time.Millisecond)
+
+				m.InsertRecord("request", float64(interval/time.Millisecond), tags, fields, start)
+				flight.finish()
 			}()
 
 			defer server.RecoverAndSetStatusCode(&recoveredStatusCode)
 
+			// Request tags let later handlers (eg. server.Timeout) add
+			// tags to the request record
+			r = r.WithContext(contexts.ContextWithRequestTags(r.Context()))
+			// ...and a server.Router set the request's route
+			r = r.WithContext(contexts.ContextWithRoute(r.Context()))
+
+			// r is a copy, so the caller's request keeps its body
+			if r.Body != nil && r.Body != http.NoBody {
+				body = &countingBody{ReadCloser: r.Body}
+				r.Body = body
+			}
+
+			// Requests routed by an outer http.ServeMux keep its route
+			if r.Pattern == "" {
+				contexts.OnRoute(r.Context(), func(pattern string) {
+					flight.route(patternPath(pattern))
+				})
+			}
+
 			h.ServeHTTP(w, r.WithContext(Context(r.Context(), m)))
 		})
 	}
@@ -67,8 +139,7 @@ func ForceContext(ctx context.Context) Monitor {
 	return NewLogMonitor(logger)
 }
 
-func tagsForRequest(r *http.Request, recoveredStatusCode int) map[string]string {
-	path := scrubPath(r.URL.Path)
+func tagsForRequest(r *http.Request, path string, recoveredStatusCode int) map[string]string {
 	tags := map[string]string{
 		"path":           path,
 		"request_method": r.Method,
@@ -81,6 +152,14 @@ func tagsForRequest(r *http.Request, recoveredStatusCode int) map[string]string
 
 	ctx := r.Context()
 
+	if requestTags, ok := contexts.RequestTags(ctx); ok {
+		for k, v := range requestTags {
+			if _, exists := tags[k]; !exists {
+				tags[k] = v
+			}
+		}
+	}
+
 	if recoveredStatusCode != 0 {
 		tags["response_code"] = strconv.Itoa(recoveredStatusCode)
 		return tags
@@ -111,9 +190,3 @@ func fieldsForContext(ctx context.Context) map[string]interface{} {
 
 	return fields
 }
-
-var idScrubber = regexp.MustCompile("[0-9]+")
-
-func scrubPath(path string) string {
-	return idScrubber.ReplaceAllString(path, ":id")
-}
@@ -0,0 +1,270 @@
+package monitoring
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theplant/appkit/contexts"
+	"github.com/theplant/appkit/server"
+)
+
+type recordingMonitor struct {
+	Monitor
+	tags chan map[string]string
+}
+
+func (m recordingMonitor) InsertRecord(measurement string, value interface{}, tags map[string]string, fields map[string]interface{}, t time.Time) {
+	if measurement == "request" {
+		m.tags <- tags
+	}
+}
+
+func TestWithMonitor_PathTag(t *testing.T) {
+	router := server.NewRouter()
+	router.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+
+	m := recordingMonitor{tags: make(chan map[string]string, 1)}
+	h := WithMonitor(m)(contexts.WithHTTPStatus(router))
+
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"/users/42", "/users/{id}"},
+		{"/unrouted/42", "/unrouted/:id"},
+	}
+
+	for _, c := range cases {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", c.path, nil))
+
+		select {
+		case tags := <-m.tags:
+			if tags["path"] != c.expected {
+				t.Errorf("%s: expected path tag %q, got %q", c.path, c.expected, tags["path"])
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no record inserted", c.path)
+		}
+	}
+}
+
+func TestWithMonitor_ServeMuxPattern(t *testing.T) {
+	m := recordingMonitor{tags: make(chan map[string]string, 1)}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /orders/{code}", WithMonitor(m)(contexts.WithHTTPStatus(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))))
+
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders/ABC-123", nil))
+
+	select {
+	case tags := <-m.tags:
+		if tags["path"] != "/orders/{code}" {
+			t.Errorf("expected path tag /orders/{code}, got %q", tags["path"])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no record inserted")
+	}
+}
+
+func TestWithMonitor_MaxPathTags(t *testing.T) {
+	m := recordingMonitor{tags: make(chan map[string]string, 1)}
+	h := WithMonitor(m, WithMaxPathTags(2))(contexts.WithHTTPStatus(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"/a/1", "/a/:id"},
+		{"/b/2", "/b/:id"},
+		{"/c/3", "other"},
+		{"/a/4", "/a/:id"},
+	}
+
+	for _, c := range cases {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", c.path, nil))
+
+		select {
+		case tags := <-m.tags:
+			if tags["path"] != c.expected {
+				t.Errorf("%s: expected path tag %q, got %q", c.path, c.expected, tags["path"])
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no record inserted", c.path)
+		}
+	}
+}
+
+func TestWithMonitor_SizesAndTTFB(t *testing.T) {
+	rm := &recordsMonitor{}
+	h := WithMonitor(rm)(contexts.WithHTTPStatus(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+
+		w.Write([]byte("hello"))
+		http.NewResponseController(w).Flush()
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(" world"))
+	})))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("0123456789")))
+
+	r := rm.find("request", "path", "/upload")
+	if r == nil {
+		t.Fatal("no request record inserted")
+	}
+	if r.fields["request_bytes"] != int64(10) {
+		t.Errorf("expected request_bytes 10, got %v", r.fields["request_bytes"])
+	}
+	if r.fields["response_bytes"] != int64(11) {
+		t.Errorf("expected response_bytes 11, got %v", r.fields["response_bytes"])
+	}
+	if ttfb, ok := r.fields["ttfb_ms"].(float64); !ok || ttfb >= 50 {
+		t.Errorf("expected ttfb_ms before the end of the streaming response, got %v", r.fields["ttfb_ms"])
+	}
+	if r.value.(float64) < 50 {
+		t.Errorf("expected duration to include the streaming response, got %v", r.value)
+	}
+}
+
+func TestWithMonitor_InFlight(t *testing.T) {
+	rm := &recordsMonitor{}
+
+	router := server.NewRouter()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	router.HandleFunc("GET /slow/{id}", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	router.HandleFunc("GET /fast", func(w http.ResponseWriter, r *http.Request) {})
+	h := WithMonitor(rm)(contexts.WithHTTPStatus(router))
+
+	done := make(chan struct{})
+	for _, path := range []string{"/slow/1", "/slow/2"} {
+		go func() {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+			done <- struct{}{}
+		}()
+		<-started
+	}
+
+	// inFlight returns the values recorded for path
+	inFlight := func(path string) []interface{} {
+		rm.mu.Lock()
+		defer rm.mu.Unlock()
+
+		var values []interface{}
+		for _, r := range rm.records {
+			if r.measurement == "request-in-flight" && r.tags["path"] == path {
+				values = append(values, r.value)
+			}
+		}
+		return values
+	}
+
+	// requests are counted by their normalized path until they
+	// are routed
+	if values := inFlight("/slow/{id}"); fmt.Sprint(values) != "[1 2]" {
+		t.Errorf("expected /slow/{id} requests 1 then 2 in flight, got %v", values)
+	}
+	if values := inFlight("/slow/:id"); fmt.Sprint(values) != "[1 0 1 0]" {
+		t.Errorf("expected /slow/:id requests moved to their route, got %v", values)
+	}
+
+	// other routes are counted separately
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	if values := inFlight("/fast"); fmt.Sprint(values) != "[1 0]" {
+		t.Errorf("expected /fast request 1 then 0 in flight, got %v", values)
+	}
+
+	close(release)
+	<-done
+	<-done
+
+	if values := inFlight("/slow/{id}"); fmt.Sprint(values) != "[1 2 1 0]" {
+		t.Errorf("expected /slow/{id} requests back to 0 in flight, got %v", values)
+	}
+}
+
+func TestWithMonitor_RequestBody(t *testing.T) {
+	h := WithMonitor(&recordsMonitor{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+
+	body := io.NopCloser(strings.NewReader("0123456789"))
+	r := httptest.NewRequest("POST", "/upload", body)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if r.Body != body {
+		t.Errorf("expected the request's body not to be replaced")
+	}
+}
+
+// hijackRecorder is a ResponseRecorder that implements http.Hijacker.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, nil
+}
+
+func TestWithMonitor_PreservesInterfaces(t *testing.T) {
+	var flusher, hijacker bool
+	var unwrapped http.ResponseWriter
+
+	h := WithMonitor(&recordsMonitor{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, flusher = w.(http.Flusher)
+		_, hijacker = w.(http.Hijacker)
+		if u, ok := w.(interface{ Unwrap() http.ResponseWriter }); ok {
+			unwrapped = u.Unwrap()
+		}
+	}))
+
+	cases := []struct {
+		w                 http.ResponseWriter
+		flusher, hijacker bool
+	}{
+		{httptest.NewRecorder(), true, false},
+		{hijackRecorder{httptest.NewRecorder()}, true, true},
+		{struct{ http.ResponseWriter }{httptest.NewRecorder()}, false, false},
+	}
+
+	for i, c := range cases {
+		h.ServeHTTP(c.w, httptest.NewRequest("GET", "/", nil))
+
+		if flusher != c.flusher || hijacker != c.hijacker {
+			t.Errorf("%d: expected http.Flusher %v and http.Hijacker %v, got %v and %v", i, c.flusher, c.hijacker, flusher, hijacker)
+		}
+		if unwrapped != c.w {
+			t.Errorf("%d: expected Unwrap to return the wrapped ResponseWriter", i)
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"/", "/"},
+		{"/api/v2/users/123/comments/456", "/api/v2/users/:id/comments/:id"},
+		{"/orders/9b2f6c1e-3d4a-4b8e-9f0a-1c2d3e4f5a6b", "/orders/:uuid"},
+		{"/commits/3f786850e387550fdab836ed7e6dc881de23001b", "/commits/:hex"},
+		{"/reset/dGhpcyBpcyBhIHRva2VuMTIz", "/reset/:token"},
+		{"/products/blue-winter-coat", "/products/blue-winter-coat"},
+		{"/docs/getting-started-with-appkit", "/docs/getting-started-with-appkit"},
+	}
+
+	for _, c := range cases {
+		if got := NormalizePath(c.path); got != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.path, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package monitoring
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/theplant/appkit/contexts"
+)
+
+// DefaultMaxPathTags is the default limit on the number of distinct
+// normalized request paths that WithMonitor will tag requests with.
+const DefaultMaxPathTags = 1000
+
+// OtherPathTag is the path tag of requests once the limit on distinct
+// paths has been reached.
+const OtherPathTag = "other"
+
+// PathNormalizer turns a request path into a path tag, replacing
+// parts of the path that identify a resource (eg. IDs) with
+// placeholders, so that requests to the same endpoint share a tag.
+type PathNormalizer func(path string) string
+
+// MiddlewareOptions are options for WithMonitor.
+type MiddlewareOptions struct {
+	// PathNormalizer normalizes the paths of requests that weren't
+	// handled by a route pattern. Defaults to NormalizePath.
+	PathNormalizer PathNormalizer
+
+	// MaxPathTags limits the number of distinct normalized paths.
+	// Requests with other paths are tagged with OtherPathTag.
+	// Defaults to DefaultMaxPathTags, negative for no limit.
+	MaxPathTags int
+}
+
+// MiddlewareOption configures WithMonitor.
+type MiddlewareOption func(*MiddlewareOptions)
+
+// WithPathNormalizer sets the PathNormalizer used by WithMonitor.
+func WithPathNormalizer(n PathNormalizer) MiddlewareOption {
+	return func(o *MiddlewareOptions) {
+		o.PathNormalizer = n
+	}
+}
+
+// WithMaxPathTags sets the limit on distinct normalized paths, see
+// MiddlewareOptions.MaxPathTags.
+func WithMaxPathTags(n int) MiddlewareOption {
+	return func(o *MiddlewareOptions) {
+		o.MaxPathTags = n
+	}
+}
+
+var (
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}$`)
+	hexSegment     = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	tokenSegment   = regexp.MustCompile(`^[A-Za-z0-9_\-+=]{20,}$`)
+)
+
+// NormalizePath replaces path segments that look like identifiers:
+//
+//   - numbers with `:id`, eg. `/users/123` => `/users/:id`
+//   - UUIDs with `:uuid`
+//   - hex strings of 16 or more characters (eg. hashes) with `:hex`
+//   - base64 (or base64url) strings of 20 or more characters,
+//     containing a digit, with `:token`
+//
+// Other segments, such as `v2` or `blue-winter-coat`, are kept.
+func NormalizePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		switch {
+		case s == "":
+		case numericSegment.MatchString(s):
+			segments[i] = ":id"
+		case uuidSegment.MatchString(s):
+			segments[i] = ":uuid"
+		case hexSegment.MatchString(s):
+			segments[i] = ":hex"
+		case tokenSegment.MatchString(s) && strings.ContainsAny(s, "0123456789"):
+			segments[i] = ":token"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// pathTagger tags requests with their route pattern, or their
+// normalized path, up to a limit of distinct normalized paths.
+type pathTagger struct {
+	normalize PathNormalizer
+	max       int
+
+	mu    sync.Mutex
+	paths map[string]bool
+}
+
+func newPathTagger(opts MiddlewareOptions) *pathTagger {
+	if opts.PathNormalizer == nil {
+		opts.PathNormalizer = NormalizePath
+	}
+	if opts.MaxPathTags == 0 {
+		opts.MaxPathTags = DefaultMaxPathTags
+	}
+
+	return &pathTagger{
+		normalize: opts.PathNormalizer,
+		max:       opts.MaxPathTags,
+		paths:     map[string]bool{},
+	}
+}
+
+// pathTag returns the path of the request's route pattern, without
+// the method (that is tagged separately). The pattern is taken from
+// r.Pattern, when WithMonitor is inside an http.ServeMux, or from
+// contexts.Route, set by a server.Router inside WithMonitor. Patterns
+// of plain http.ServeMuxes inside WithMonitor are set on requests
+// WithMonitor doesn't see, so they aren't tagged.
+//
+// Requests that weren't handled by a route are tagged with their
+// normalized path. Route patterns don't count towards the limit on
+// distinct paths, as there are a fixed number of them.
+func (p *pathTagger) pathTag(r *http.Request) string {
+	if route, ok := routePath(r); ok {
+		return route
+	}
+
+	path := p.normalize(r.URL.Path)
+	if p.max < 0 {
+		return path
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paths[path] {
+		return path
+	}
+	if len(p.paths) >= p.max {
+		return OtherPathTag
+	}
+	p.paths[path] = true
+	return path
+}
+
+// routePath returns the path of the request's route pattern (see
+// pathTag), or false if it hasn't been routed.
+func routePath(r *http.Request) (string, bool) {
+	route := r.Pattern
+	if route == "" {
+		route, _ = contexts.Route(r.Context())
+	}
+
+	if route == "" {
+		return "", false
+	}
+	return patternPath(route), true
+}
+
+// patternPath returns the path of a route pattern, without the method
+// (that is tagged separately).
+func patternPath(pattern string) string {
+	// Patterns are `[METHOD ][HOST]/[PATH]`
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		return strings.TrimSpace(path)
+	}
+	return pattern
+}
@@ -0,0 +1,409 @@
+package monitoring
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPrometheusBuckets are the default histogram buckets for
+// InsertRecord values. Request records are in milliseconds.
+var DefaultPrometheusBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// prometheusOverflowValue is the value of every label of the series
+// that values are recorded in once a metric has too many series.
+const prometheusOverflowValue = "other"
+
+// DefaultPrometheusMaxSeries is the default limit on the number of
+// label combinations of each metric.
+const DefaultPrometheusMaxSeries = 1000
+
+// PrometheusConfig is configuration for NewPrometheusMonitor.
+type PrometheusConfig struct {
+	// Namespace, if set, prefixes metric names, eg. `myapp` for
+	// `myapp_request`.
+	Namespace string
+
+	// ConstLabels are added to every metric, eg. `service`.
+	ConstLabels map[string]string
+
+	// Buckets are the histogram buckets for InsertRecord values.
+	// Defaults to DefaultPrometheusBuckets.
+	Buckets []float64
+
+	// MaxSeries limits the number of label combinations of each
+	// metric. Values with other label combinations are recorded with
+	// every label set to `other`, so totals stay correct. Defaults to
+	// DefaultPrometheusMaxSeries.
+	MaxSeries int
+}
+
+// PrometheusMonitor is a Monitor that keeps metrics in memory, to be
+// scraped by Prometheus from Handler:
+//
+//   - InsertRecord observes its value in a histogram named after the
+//     measurement
+//   - Count, CountError and CountSimple add their value to a counter
+//     named after the measurement, with a `_total` suffix
+//
+// Tags are used as labels, and fields are ignored. CountError adds
+// the error message as an `error` label, as the InfluxDB monitor does.
+type PrometheusMonitor struct {
+	namespace   string
+	constLabels []labelPair
+	buckets     []float64
+	maxSeries   int
+	start       time.Time
+
+	mu         sync.Mutex
+	histograms map[string]*promMetric
+	counters   map[string]*promMetric
+}
+
+type labelPair struct {
+	name, value string
+}
+
+type promMetric struct {
+	series map[string]*promSeries
+}
+
+type promSeries struct {
+	labels []labelPair
+
+	// counters only use sum
+	sum     float64
+	count   uint64
+	buckets []uint64
+}
+
+// NewPrometheusMonitor creates a PrometheusMonitor.
+func NewPrometheusMonitor(cfg PrometheusConfig) *PrometheusMonitor {
+	if cfg.Buckets == nil {
+		cfg.Buckets = DefaultPrometheusBuckets
+	}
+	if cfg.MaxSeries <= 0 {
+		cfg.MaxSeries = DefaultPrometheusMaxSeries
+	}
+
+	buckets := append([]float64(nil), cfg.Buckets...)
+	sort.Float64s(buckets)
+
+	return &PrometheusMonitor{
+		namespace:   sanitizeMetricName(cfg.Namespace),
+		constLabels: labelPairs(cfg.ConstLabels),
+		buckets:     buckets,
+		maxSeries:   cfg.MaxSeries,
+		start:       time.Now(),
+		histograms:  map[string]*promMetric{},
+		counters:    map[string]*promMetric{},
+	}
+}
+
+// InsertRecord is part of Monitor
+func (p *PrometheusMonitor) InsertRecord(measurement string, value interface{}, tags map[string]string, fields map[string]interface{}, t time.Time) {
+	v, ok := toFloat(value)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.series(p.histograms, p.metricName(measurement), tags)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(p.buckets))
+	}
+
+	s.sum += v
+	s.count++
+	for i, upper := range p.buckets {
+		if v <= upper {
+			s.buckets[i]++
+		}
+	}
+}
+
+// Count is part of Monitor
+func (p *PrometheusMonitor) Count(measurement string, value float64, tags map[string]string, fields map[string]interface{}) {
+	p.add(measurement, value, tags)
+}
+
+// CountError is part of Monitor
+func (p *PrometheusMonitor) CountError(measurement string, value float64, err error) {
+	p.add(measurement, value, map[string]string{"error": err.Error()})
+}
+
+// CountSimple is part of Monitor
+func (p *PrometheusMonitor) CountSimple(measurement string, value float64) {
+	p.add(measurement, value, nil)
+}
+
+func (p *PrometheusMonitor) add(measurement string, value float64, tags map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name := p.metricName(measurement)
+	if !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+
+	s := p.series(p.counters, name, tags)
+	s.sum += value
+}
+
+func (p *PrometheusMonitor) metricName(measurement string) string {
+	name := sanitizeMetricName(measurement)
+	if p.namespace != "" {
+		name = p.namespace + "_" + name
+	}
+	return name
+}
+
+// series returns the series of metric name with tags, or the
+// overflow series if the metric has too many series. Must be called
+// with p.mu held.
+func (p *PrometheusMonitor) series(metrics map[string]*promMetric, name string, tags map[string]string) *promSeries {
+	m, ok := metrics[name]
+	if !ok {
+		m = &promMetric{series: map[string]*promSeries{}}
+		metrics[name] = m
+	}
+
+	labels := labelPairs(tags)
+	// Constant labels take precedence over tags with the same name
+	labels = slices.DeleteFunc(labels, func(l labelPair) bool {
+		return slices.ContainsFunc(p.constLabels, func(c labelPair) bool { return c.name == l.name })
+	})
+	key := seriesKey(labels)
+
+	if s, ok := m.series[key]; ok {
+		return s
+	}
+
+	if len(m.series) >= p.maxSeries {
+		for i := range labels {
+			labels[i].value = prometheusOverflowValue
+		}
+		key = seriesKey(labels)
+		if s, ok := m.series[key]; ok {
+			return s
+		}
+	}
+
+	s := &promSeries{labels: labels}
+	m.series[key] = s
+	return s
+}
+
+// Handler serves metrics in the Prometheus text exposition format,
+// including Go runtime metrics.
+func (p *PrometheusMonitor) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		bw := bufio.NewWriter(w)
+		p.writeMetrics(bw)
+		p.writeRuntimeMetrics(bw)
+		_ = bw.Flush()
+	})
+}
+
+func (p *PrometheusMonitor) writeMetrics(w *bufio.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, name := range sortedKeys(p.counters) {
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		for _, s := range sortedSeries(p.counters[name]) {
+			p.writeSample(w, name, s.labels, nil, s.sum)
+		}
+	}
+
+	for _, name := range sortedKeys(p.histograms) {
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		for _, s := range sortedSeries(p.histograms[name]) {
+			for i, upper := range p.buckets {
+				le := labelPair{"le", formatFloat(upper)}
+				p.writeSample(w, name+"_bucket", s.labels, &le, float64(s.buckets[i]))
+			}
+			inf := labelPair{"le", "+Inf"}
+			p.writeSample(w, name+"_bucket", s.labels, &inf, float64(s.count))
+			p.writeSample(w, name+"_sum", s.labels, nil, s.sum)
+			p.writeSample(w, name+"_count", s.labels, nil, float64(s.count))
+		}
+	}
+}
+
+func (p *PrometheusMonitor) writeRuntimeMetrics(w *bufio.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		p.writeSample(w, name, nil, nil, value)
+	}
+	counter := func(name, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		p.writeSample(w, name, nil, nil, value)
+	}
+
+	fmt.Fprintf(w, "# HELP go_info Information about the Go environment.\n# TYPE go_info gauge\n")
+	version := labelPair{"version", runtime.Version()}
+	p.writeSample(w, "go_info", nil, &version, 1)
+
+	gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	gauge("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(ms.Alloc))
+	gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(ms.HeapInuse))
+	gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(ms.HeapObjects))
+	gauge("go_memstats_sys_bytes", "Number of bytes obtained from system.", float64(ms.Sys))
+	counter("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", float64(ms.TotalAlloc))
+	counter("go_gc_cycles_total", "Number of completed GC cycles.", float64(ms.NumGC))
+	counter("go_gc_pause_seconds_total", "Total GC pause time.", float64(ms.PauseTotalNs)/1e9)
+	gauge("process_start_time_seconds", "Start time of the process since unix epoch in seconds.", float64(p.start.UnixNano())/1e9)
+}
+
+func (p *PrometheusMonitor) writeSample(w *bufio.Writer, name string, labels []labelPair, extra *labelPair, value float64) {
+	w.WriteString(name)
+
+	all := make([]labelPair, 0, len(p.constLabels)+len(labels)+1)
+	all = append(all, p.constLabels...)
+	all = append(all, labels...)
+	if extra != nil {
+		all = append(all, *extra)
+	}
+
+	if len(all) > 0 {
+		w.WriteByte('{')
+		for i, l := range all {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l.name)
+			w.WriteString(`="`)
+			w.WriteString(labelValueEscaper.Replace(l.value))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// labelPairs returns tags as labels with valid names, sorted by name.
+func labelPairs(tags map[string]string) []labelPair {
+	labels := make([]labelPair, 0, len(tags))
+	for k, v := range tags {
+		labels = append(labels, labelPair{sanitizeLabelName(k), v})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+func seriesKey(labels []labelPair) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.name)
+		b.WriteByte(0)
+		b.WriteString(l.value)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func sortedKeys(m map[string]*promMetric) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedSeries(m *promMetric) []*promSeries {
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	series := make([]*promSeries, len(keys))
+	for i, k := range keys {
+		series[i] = m.series[k]
+	}
+	return series
+}
+
+// sanitizeMetricName replaces characters that aren't valid in
+// Prometheus metric names (eg. `-` in `influxdb-queue-length`) with
+// `_`.
+func sanitizeMetricName(name string) string {
+	return sanitizeName(name, true)
+}
+
+func sanitizeLabelName(name string) string {
+	return sanitizeName(name, false)
+}
+
+func sanitizeName(name string, colons bool) string {
+	if name == "" {
+		return ""
+	}
+
+	b := []byte(name)
+	for i, c := range b {
+		valid := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' ||
+			(colons && c == ':') ||
+			(i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case time.Duration:
+		return float64(v / time.Millisecond), true
+	}
+	return 0, false
+}
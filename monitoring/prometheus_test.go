@@ -0,0 +1,85 @@
+package monitoring
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, p *PrometheusMonitor) string {
+	rw := httptest.NewRecorder()
+	p.Handler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rw.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	return rw.Body.String()
+}
+
+func expectLines(t *testing.T, out string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, out)
+		}
+	}
+}
+
+func TestPrometheusMonitor(t *testing.T) {
+	p := NewPrometheusMonitor(PrometheusConfig{
+		Namespace:   "app",
+		ConstLabels: map[string]string{"service": "test"},
+		Buckets:     []float64{100, 10},
+	})
+
+	tags := map[string]string{"path": "/users/{id}", "request_method": "GET", "service": "ignored"}
+	p.InsertRecord("request", 5, tags, map[string]interface{}{"req_id": "1"}, time.Now())
+	p.InsertRecord("request", 50.5, tags, nil, time.Now())
+	p.InsertRecord("request", 500*time.Millisecond, tags, nil, time.Now())
+	p.InsertRecord("request", "not a number", tags, nil, time.Now())
+
+	p.Count("influxdb-queue-length", 2, map[string]string{"quote": `a "b"`}, nil)
+	p.CountSimple("logins_total", 1)
+	p.CountSimple("logins_total", 1)
+	p.CountError("login_error", 1, errors.New("wrong password"))
+
+	out := scrape(t, p)
+
+	expectLines(t, out,
+		`# TYPE app_request histogram`,
+		`app_request_bucket{service="test",path="/users/{id}",request_method="GET",le="10"} 1`,
+		`app_request_bucket{service="test",path="/users/{id}",request_method="GET",le="100"} 2`,
+		`app_request_bucket{service="test",path="/users/{id}",request_method="GET",le="+Inf"} 3`,
+		`app_request_sum{service="test",path="/users/{id}",request_method="GET"} 555.5`,
+		`app_request_count{service="test",path="/users/{id}",request_method="GET"} 3`,
+
+		`# TYPE app_influxdb_queue_length_total counter`,
+		`app_influxdb_queue_length_total{service="test",quote="a \"b\""} 2`,
+		`app_logins_total{service="test"} 2`,
+		`app_login_error_total{service="test",error="wrong password"} 1`,
+
+		`# TYPE go_goroutines gauge`,
+		`# TYPE go_gc_cycles_total counter`,
+	)
+}
+
+func TestPrometheusMonitor_MaxSeries(t *testing.T) {
+	p := NewPrometheusMonitor(PrometheusConfig{MaxSeries: 2})
+
+	for _, id := range []string{"1", "2", "3", "4", "1"} {
+		p.Count("hits", 1, map[string]string{"id": id}, nil)
+	}
+
+	out := scrape(t, p)
+
+	expectLines(t, out,
+		`hits_total{id="1"} 2`,
+		`hits_total{id="2"} 1`,
+		`hits_total{id="other"} 2`,
+	)
+	if strings.Contains(out, `id="3"`) {
+		t.Errorf("expected id 3 to be folded into other:\n%s", out)
+	}
+}
@@ -0,0 +1,100 @@
+package monitoring
+
+import "sync/atomic"
+
+// ring is a bounded, lock-free multi-producer/multi-consumer queue
+// (Dmitry Vyukov's bounded MPMC queue). Each slot has a sequence
+// number that tells producers and consumers whether the slot is free
+// for the current lap around the ring.
+type ring[T any] struct {
+	mask  uint64
+	slots []ringSlot[T]
+
+	// head is the position of the next push, tail of the next pop
+	head atomic.Uint64
+	tail atomic.Uint64
+}
+
+type ringSlot[T any] struct {
+	seq atomic.Uint64
+	val T
+}
+
+// newRing creates a ring with capacity of at least size, rounded up
+// to a power of two.
+func newRing[T any](size int) *ring[T] {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+
+	r := &ring[T]{
+		mask:  uint64(n - 1),
+		slots: make([]ringSlot[T], n),
+	}
+	for i := range r.slots {
+		r.slots[i].seq.Store(uint64(i))
+	}
+	return r
+}
+
+// push adds v to the ring, or returns false without blocking if the
+// ring is full.
+func (r *ring[T]) push(v T) bool {
+	for {
+		pos := r.head.Load()
+		slot := &r.slots[pos&r.mask]
+
+		switch diff := int64(slot.seq.Load()) - int64(pos); {
+		case diff == 0:
+			if r.head.CompareAndSwap(pos, pos+1) {
+				slot.val = v
+				slot.seq.Store(pos + 1)
+				return true
+			}
+		case diff < 0:
+			// slot not yet popped from the previous lap
+			return false
+		}
+		// another producer claimed the slot, try again
+	}
+}
+
+// pop removes the oldest value from the ring, or returns false if the
+// ring is empty.
+func (r *ring[T]) pop() (T, bool) {
+	var zero T
+	for {
+		pos := r.tail.Load()
+		slot := &r.slots[pos&r.mask]
+
+		switch diff := int64(slot.seq.Load()) - int64(pos+1); {
+		case diff == 0:
+			if r.tail.CompareAndSwap(pos, pos+1) {
+				v := slot.val
+				slot.val = zero
+				slot.seq.Store(pos + r.mask + 1)
+				return v, true
+			}
+		case diff < 0:
+			return zero, false
+		}
+		// another consumer claimed the slot, try again
+	}
+}
+
+// len returns the (approximate, when used concurrently) number of
+// values in the ring.
+func (r *ring[T]) len() int {
+	tail := r.tail.Load()
+	head := r.head.Load()
+	if head < tail {
+		return 0
+	}
+	return int(head - tail)
+}
+
+// cap returns the capacity of the ring.
+func (r *ring[T]) cap() int {
+	return len(r.slots)
+}
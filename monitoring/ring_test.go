@@ -0,0 +1,87 @@
+package monitoring
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	r := newRing[int](3)
+	if r.cap() != 4 {
+		t.Fatalf("expected capacity rounded up to 4, got %d", r.cap())
+	}
+
+	for i := 0; i < 4; i++ {
+		if !r.push(i) {
+			t.Fatalf("push %d failed", i)
+		}
+	}
+	if r.push(4) {
+		t.Fatalf("expected push to full ring to fail")
+	}
+	if r.len() != 4 {
+		t.Fatalf("expected len 4, got %d", r.len())
+	}
+
+	// wrap around
+	for lap := 0; lap < 3; lap++ {
+		for i := 0; i < 4; i++ {
+			v, ok := r.pop()
+			if !ok || v != lap*4+i {
+				t.Fatalf("expected %d, got %d (%v)", lap*4+i, v, ok)
+			}
+			r.push((lap+1)*4 + i)
+		}
+	}
+
+	for r.len() > 0 {
+		r.pop()
+	}
+	if _, ok := r.pop(); ok {
+		t.Fatalf("expected pop from empty ring to fail")
+	}
+}
+
+func TestRing_Concurrent(t *testing.T) {
+	const producers, perProducer = 8, 10000
+
+	r := newRing[int](1024)
+	var wg sync.WaitGroup
+	var pushed, popped [producers]int
+
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				if r.push(p) {
+					pushed[p]++
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for {
+		if v, ok := r.pop(); ok {
+			popped[v]++
+			continue
+		}
+		select {
+		case <-done:
+			for v, ok := r.pop(); ok; v, ok = r.pop() {
+				popped[v]++
+			}
+			if pushed != popped {
+				t.Fatalf("pushed %v, but popped %v", pushed, popped)
+			}
+			return
+		default:
+		}
+	}
+}
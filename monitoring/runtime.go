@@ -0,0 +1,266 @@
+package monitoring
+
+import (
+	"math"
+	"os"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRuntimeCollectorInterval is how often a RuntimeCollector
+// samples metrics, unless configured otherwise.
+const DefaultRuntimeCollectorInterval = 30 * time.Second
+
+// runtimeGauges are runtime/metrics samples recorded as-is with
+// InsertRecord.
+var runtimeGauges = map[string]string{
+	"/sched/goroutines:goroutines":       "runtime-goroutines",
+	"/sched/gomaxprocs:threads":          "runtime-gomaxprocs",
+	"/memory/classes/heap/objects:bytes": "runtime-heap-bytes",
+	"/gc/heap/objects:objects":           "runtime-heap-objects",
+	"/gc/heap/goal:bytes":                "runtime-heap-goal-bytes",
+	"/memory/classes/total:bytes":        "runtime-memory-bytes",
+}
+
+// runtimeCounters are cumulative runtime/metrics samples, of which the
+// increase since the previous sample is recorded with Count.
+var runtimeCounters = map[string]string{
+	"/gc/cycles/total:gc-cycles": "runtime-gc-cycles",
+	"/gc/heap/allocs:bytes":      "runtime-alloc-bytes",
+}
+
+const runtimeGCPauses = "/sched/pauses/total/gc:seconds"
+
+// Linux's USER_HZ, the unit of CPU times in /proc/self/stat
+const clockTicksPerSecond = 100
+
+// RuntimeCollector periodically samples Go runtime metrics (from
+// runtime/metrics) and process metrics (from /proc/self, on Linux),
+// and records them with a Monitor:
+//
+//   - runtime-goroutines, runtime-gomaxprocs, runtime-heap-bytes,
+//     runtime-heap-objects, runtime-heap-goal-bytes and
+//     runtime-memory-bytes (memory mapped by the Go runtime) are
+//     recorded with InsertRecord.
+//   - runtime-gc-pause-max-ms, the longest GC pause since the previous
+//     sample (as the upper bound of the runtime's pause histogram
+//     bucket), is recorded with InsertRecord if there were GC pauses.
+//   - runtime-gc-cycles, runtime-alloc-bytes and process-cpu-seconds
+//     are counted with Count, as the increase since the previous
+//     sample.
+//   - process-open-fds and process-resident-memory-bytes are recorded
+//     with InsertRecord.
+//
+// The first sample only records gauges: cumulative metrics are
+// recorded from the second, rather than as totals since the process
+// started.
+type RuntimeCollector struct {
+	monitor  Monitor
+	interval time.Duration
+
+	mu      sync.Mutex
+	samples []metrics.Sample
+	// previous values of cumulative metrics, once collected
+	collected bool
+	counters  map[string]uint64
+	pauses    []uint64
+	cpu       float64
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	running   chan struct{}
+	done      chan struct{}
+}
+
+// NewRuntimeCollector creates a RuntimeCollector that records metrics
+// with m every interval (default DefaultRuntimeCollectorInterval) once
+// started.
+func NewRuntimeCollector(m Monitor, interval time.Duration) *RuntimeCollector {
+	if interval <= 0 {
+		interval = DefaultRuntimeCollectorInterval
+	}
+
+	supported := map[string]bool{}
+	for _, d := range metrics.All() {
+		supported[d.Name] = true
+	}
+
+	var samples []metrics.Sample
+	for _, names := range []map[string]string{runtimeGauges, runtimeCounters, {runtimeGCPauses: ""}} {
+		for name := range names {
+			if supported[name] {
+				samples = append(samples, metrics.Sample{Name: name})
+			}
+		}
+	}
+
+	return &RuntimeCollector{
+		monitor:  m,
+		interval: interval,
+		samples:  samples,
+		counters: map[string]uint64{},
+		running:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start starts a goroutine that collects metrics immediately, and then
+// every interval until Stop is called.
+func (c *RuntimeCollector) Start() {
+	c.startOnce.Do(func() {
+		go func() {
+			defer close(c.done)
+
+			t := time.NewTicker(c.interval)
+			defer t.Stop()
+
+			c.Collect()
+			for {
+				select {
+				case <-t.C:
+					c.Collect()
+				case <-c.running:
+					return
+				}
+			}
+		}()
+	})
+}
+
+// Stop stops the goroutine started by Start, and waits for it to
+// finish.
+func (c *RuntimeCollector) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.running)
+		c.startOnce.Do(func() { close(c.done) })
+		<-c.done
+	})
+}
+
+// Collect samples and records metrics once.
+func (c *RuntimeCollector) Collect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	metrics.Read(c.samples)
+
+	for _, s := range c.samples {
+		switch {
+		case runtimeGauges[s.Name] != "":
+			if v, ok := sampleValue(s); ok {
+				c.monitor.InsertRecord(runtimeGauges[s.Name], v, nil, nil, now)
+			}
+
+		case runtimeCounters[s.Name] != "":
+			if s.Value.Kind() != metrics.KindUint64 {
+				continue
+			}
+			v := s.Value.Uint64()
+			if previous := c.counters[s.Name]; c.collected && v > previous {
+				c.monitor.Count(runtimeCounters[s.Name], float64(v-previous), nil, nil)
+			}
+			c.counters[s.Name] = v
+
+		case s.Name == runtimeGCPauses:
+			if s.Value.Kind() != metrics.KindFloat64Histogram {
+				continue
+			}
+			if pause, ok := c.maxPause(s.Value.Float64Histogram()); ok && c.collected {
+				c.monitor.InsertRecord("runtime-gc-pause-max-ms", pause*1000, nil, nil, now)
+			}
+		}
+	}
+
+	c.collectProcess(now)
+	c.collected = true
+}
+
+func sampleValue(s metrics.Sample) (float64, bool) {
+	switch s.Value.Kind() {
+	case metrics.KindUint64:
+		return float64(s.Value.Uint64()), true
+	case metrics.KindFloat64:
+		return s.Value.Float64(), true
+	}
+	return 0, false
+}
+
+// maxPause returns the upper bound (in seconds) of the highest bucket
+// of h with pauses since the previous sample.
+func (c *RuntimeCollector) maxPause(h *metrics.Float64Histogram) (float64, bool) {
+	previous := c.pauses
+	c.pauses = append(c.pauses[:0:0], h.Counts...)
+
+	if len(previous) != len(h.Counts) {
+		previous = make([]uint64, len(h.Counts))
+	}
+
+	for i := len(h.Counts) - 1; i >= 0; i-- {
+		if h.Counts[i] > previous[i] {
+			// bucket i is [Buckets[i], Buckets[i+1])
+			upper := h.Buckets[i+1]
+			if math.IsInf(upper, 1) {
+				upper = h.Buckets[i]
+			}
+			return upper, true
+		}
+	}
+	return 0, false
+}
+
+// collectProcess records process metrics from /proc/self, if
+// available.
+func (c *RuntimeCollector) collectProcess(now time.Time) {
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		c.monitor.InsertRecord("process-open-fds", len(fds), nil, nil, now)
+	}
+
+	if statm, err := os.ReadFile("/proc/self/statm"); err == nil {
+		// size resident shared text lib data dt, in pages
+		if fields := strings.Fields(string(statm)); len(fields) > 1 {
+			if pages, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				c.monitor.InsertRecord("process-resident-memory-bytes", pages*uint64(os.Getpagesize()), nil, nil, now)
+			}
+		}
+	}
+
+	if cpu, ok := processCPUSeconds(); ok {
+		if delta := cpu - c.cpu; c.collected && delta > 0 {
+			c.monitor.Count("process-cpu-seconds", delta, nil, nil)
+		}
+		c.cpu = cpu
+	}
+}
+
+// processCPUSeconds returns the user and system CPU time of the
+// process, from /proc/self/stat.
+func processCPUSeconds() (float64, bool) {
+	stat, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return 0, false
+	}
+
+	// the command (2nd field) is in parentheses, and may contain
+	// spaces
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return 0, false
+	}
+	// fields from the 3rd (state), utime and stime are the 14th and
+	// 15th
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 13 {
+		return 0, false
+	}
+
+	utime, err1 := strconv.ParseUint(fields[11], 10, 64)
+	stime, err2 := strconv.ParseUint(fields[12], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, false
+	}
+	return float64(utime+stime) / clockTicksPerSecond, true
+}
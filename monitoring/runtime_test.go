@@ -0,0 +1,64 @@
+package monitoring
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRuntimeCollector(t *testing.T) {
+	rm := &recordsMonitor{}
+	c := NewRuntimeCollector(rm, time.Hour)
+
+	c.Collect()
+
+	for _, measurement := range []string{"runtime-goroutines", "runtime-heap-bytes", "runtime-memory-bytes"} {
+		if r := rm.find(measurement, "", ""); r == nil || r.value.(float64) <= 0 {
+			t.Errorf("expected positive %s, got %v", measurement, r)
+		}
+	}
+
+	// cumulative metrics aren't recorded by the first sample
+	for _, measurement := range []string{"runtime-gc-cycles", "runtime-alloc-bytes", "runtime-gc-pause-max-ms", "process-cpu-seconds"} {
+		if r := rm.find(measurement, "", ""); r != nil {
+			t.Errorf("expected no %s in first sample, got %v", measurement, r)
+		}
+	}
+
+	if _, err := os.Stat("/proc/self/stat"); err == nil {
+		for _, measurement := range []string{"process-open-fds", "process-resident-memory-bytes"} {
+			if rm.find(measurement, "", "") == nil {
+				t.Errorf("expected %s", measurement)
+			}
+		}
+	}
+
+	// counters record the increase since the previous sample
+	rm.records = nil
+	runtime.GC()
+	c.Collect()
+
+	r := rm.find("runtime-gc-cycles", "", "")
+	if r == nil || r.value.(float64) < 1 {
+		t.Errorf("expected GC cycle to be counted, got %v", r)
+	}
+	if rm.find("runtime-gc-pause-max-ms", "", "") == nil {
+		t.Errorf("expected GC pause to be recorded")
+	}
+}
+
+func TestRuntimeCollector_StartStop(t *testing.T) {
+	rm := &recordsMonitor{}
+	c := NewRuntimeCollector(rm, time.Hour)
+	c.Start()
+	c.Stop()
+	c.Stop()
+
+	if rm.find("runtime-goroutines", "", "") == nil {
+		t.Errorf("expected metrics to be collected on start")
+	}
+
+	// stopping a collector that wasn't started doesn't block
+	NewRuntimeCollector(rm, time.Hour).Stop()
+}
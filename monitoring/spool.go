@@ -0,0 +1,196 @@
+package monitoring
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+	influxdb "github.com/influxdata/influxdb1-client/v2"
+	"github.com/pkg/errors"
+	"github.com/theplant/appkit/log"
+)
+
+const (
+	// default limit on the total size of spooled segments, 100MiB
+	defaultSpoolMaxSize = 100 << 20
+
+	spoolSegmentExt = ".lp"
+)
+
+// spool persists batches of points that couldn't be written to
+// InfluxDB as segment files (in line protocol) in dir, so that they
+// can be replayed when InfluxDB is available again. When the total
+// size of segments is larger than maxSize, the oldest segments are
+// removed.
+//
+// spool isn't safe for concurrent use, it is only used by
+// influxdbMonitor.batchWriteDaemon.
+type spool struct {
+	dir     string
+	maxSize int64
+	logger  log.Logger
+
+	// seq is the sequence number of the newest segment, segments are
+	// named with zero-padded sequence numbers so that they sort
+	// oldest first
+	seq uint64
+}
+
+type spoolSegment struct {
+	name string
+	size int64
+}
+
+func newSpool(dir string, maxSize int64, logger log.Logger) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrapf(err, "couldn't create influxdb spool directory %v", dir)
+	}
+
+	s := &spool{
+		dir:     dir,
+		maxSize: maxSize,
+		logger:  logger,
+	}
+
+	// continue numbering after segments spooled by a previous process
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		newest := strings.TrimSuffix(segments[len(segments)-1].name, spoolSegmentExt)
+		s.seq, _ = strconv.ParseUint(newest, 10, 64)
+	}
+
+	return s, nil
+}
+
+// segments returns the spooled segments, oldest first.
+func (s *spool) segments() ([]spoolSegment, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read influxdb spool directory %v", s.dir)
+	}
+
+	var segments []spoolSegment
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), spoolSegmentExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// removed since ReadDir
+			continue
+		}
+		segments = append(segments, spoolSegment{name: entry.Name(), size: info.Size()})
+	}
+	return segments, nil
+}
+
+// empty returns true if there are no spooled segments.
+func (s *spool) empty() bool {
+	segments, err := s.segments()
+	return err != nil || len(segments) == 0
+}
+
+// write persists points as a new segment, then removes the oldest
+// segments if the spool is larger than maxSize.
+func (s *spool) write(points []*influxdb.Point) error {
+	var b bytes.Buffer
+	for _, pt := range points {
+		b.WriteString(pt.String())
+		b.WriteByte('\n')
+	}
+
+	s.seq++
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.seq, spoolSegmentExt))
+
+	// write to a temporary file first, so that a crash can't leave a
+	// partial segment
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, b.Bytes(), 0o644); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "couldn't write influxdb spool segment %v", tmp)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "couldn't write influxdb spool segment %v", name)
+	}
+
+	return s.evict()
+}
+
+// evict removes the oldest segments until the spool is no larger than
+// maxSize.
+func (s *spool) evict() error {
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, segment := range segments {
+		size += segment.size
+	}
+
+	var evicted int
+	for _, segment := range segments {
+		if size <= s.maxSize {
+			break
+		}
+		if err := s.remove(segment.name); err != nil {
+			return err
+		}
+		size -= segment.size
+		evicted++
+	}
+
+	if evicted > 0 {
+		_ = s.logger.Warn().Log(
+			"msg", fmt.Sprintf("influxdb spool larger than %d bytes, removed %d oldest segments", s.maxSize, evicted),
+			"spool_dir", s.dir,
+			"evicted", evicted,
+		)
+	}
+	return nil
+}
+
+// oldest returns the name and points of the oldest segment, or a blank
+// name if the spool is empty.
+func (s *spool) oldest() (string, []*influxdb.Point, error) {
+	segments, err := s.segments()
+	if err != nil || len(segments) == 0 {
+		return "", nil, err
+	}
+
+	name := segments[0].name
+	buf, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return name, nil, errors.Wrapf(err, "couldn't read influxdb spool segment %v", name)
+	}
+
+	// points spooled without a timestamp get the time of replay
+	parsed, err := models.ParsePointsWithPrecision(buf, time.Now().UTC(), "n")
+	if err != nil {
+		return name, nil, errors.Wrapf(err, "couldn't parse influxdb spool segment %v", name)
+	}
+
+	points := make([]*influxdb.Point, len(parsed))
+	for i, pt := range parsed {
+		points[i] = influxdb.NewPointFrom(pt)
+	}
+	return name, points, nil
+}
+
+// remove removes the named segment.
+func (s *spool) remove(name string) error {
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "couldn't remove influxdb spool segment %v", name)
+	}
+	return nil
+}
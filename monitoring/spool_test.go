@@ -0,0 +1,80 @@
+package monitoring
+
+import (
+	"testing"
+	"time"
+
+	influxdb "github.com/influxdata/influxdb1-client/v2"
+	"github.com/theplant/appkit/log"
+	"github.com/theplant/testingutils/fatalassert"
+)
+
+func spoolPoints(t *testing.T, values ...int) []*influxdb.Point {
+	t.Helper()
+	var points []*influxdb.Point
+	for _, v := range values {
+		pt, err := influxdb.NewPoint("request", map[string]string{"path": "/a b"}, map[string]interface{}{"value": v}, time.Unix(0, int64(v)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, pt)
+	}
+	return points
+}
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := newSpool(dir, defaultSpoolMaxSize, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fatalassert.Equal(t, true, s.empty())
+
+	fatalassert.Equal(t, nil, s.write(spoolPoints(t, 1, 2)))
+	fatalassert.Equal(t, nil, s.write(spoolPoints(t, 3)))
+
+	// a new spool continues numbering after existing segments
+	s, err = newSpool(dir, defaultSpoolMaxSize, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fatalassert.Equal(t, nil, s.write(spoolPoints(t, 4)))
+
+	var replayed []string
+	for !s.empty() {
+		name, points, err := s.oldest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pt := range points {
+			replayed = append(replayed, pt.String())
+		}
+		fatalassert.Equal(t, nil, s.remove(name))
+	}
+
+	var expected []string
+	for _, pt := range spoolPoints(t, 1, 2, 3, 4) {
+		expected = append(expected, pt.String())
+	}
+	fatalassert.Equal(t, expected, replayed)
+}
+
+func TestSpool_Evict(t *testing.T) {
+	segmentSize := int64(len(spoolPoints(t, 1)[0].String()) + 1)
+
+	s, err := newSpool(t.TempDir(), 2*segmentSize, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 4; i++ {
+		fatalassert.Equal(t, nil, s.write(spoolPoints(t, i)))
+	}
+
+	segments, _ := s.segments()
+	fatalassert.Equal(t, 2, len(segments))
+
+	_, points, _ := s.oldest()
+	fatalassert.Equal(t, spoolPoints(t, 3)[0].String(), points[0].String())
+}
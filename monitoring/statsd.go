@@ -0,0 +1,420 @@
+package monitoring
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/theplant/appkit/log"
+)
+
+// StatsdMonitorConfig type for configuration of Monitor that sends
+// metrics to a StatsD (or DogStatsD) agent
+type StatsdMonitorConfig string
+
+type statsdMonitorCfg struct {
+	Addr          string
+	Prefix        string
+	FlushInterval time.Duration
+	MaxPacketSize int
+	MaxTimings    int
+	Timings       string
+	ServiceName   string
+}
+
+const (
+	defaultStatsdFlushInterval = time.Second
+	// 1500 byte Ethernet MTU - 20 byte IPv4 header - 8 byte UDP header,
+	// with some headroom for IP options/tunnels
+	defaultStatsdMaxPacketSize = 1432
+	defaultStatsdMaxTimings    = 10000
+	defaultStatsdTimings       = "request,http-client-request"
+
+	flushIntervalParamName = "flush-interval"
+	maxPacketSizeParamName = "max-packet-size"
+	maxTimingsParamName    = "max-timings"
+	prefixParamName        = "prefix"
+	timingsParamName       = "timings"
+)
+
+func parseStatsdMonitorConfig(config StatsdMonitorConfig) (*statsdMonitorCfg, error) {
+	monitorURL := string(config)
+
+	u, err := url.Parse(monitorURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse statsd url %v", monitorURL)
+	} else if u.Scheme != "statsd" {
+		return nil, errors.Errorf("statsd monitoring url %v must have statsd scheme", monitorURL)
+	} else if u.Port() == "" {
+		return nil, errors.Errorf("statsd monitoring url %v has no port", monitorURL)
+	}
+
+	values := u.Query()
+
+	flushInterval := defaultStatsdFlushInterval
+	if interval := values.Get(flushIntervalParamName); interval != "" {
+		flushInterval, err = time.ParseDuration(interval)
+		if err != nil || flushInterval <= 0 {
+			return nil, errors.Errorf(`statsd config parameter %s format error, must be a positive duration, eg. "1s"`, flushIntervalParamName)
+		}
+	}
+
+	maxPacketSize, err := getStatsdSize(values, maxPacketSizeParamName, defaultStatsdMaxPacketSize)
+	if err != nil {
+		return nil, err
+	}
+
+	maxTimings, err := getStatsdSize(values, maxTimingsParamName, defaultStatsdMaxTimings)
+	if err != nil {
+		return nil, err
+	}
+
+	timings := defaultStatsdTimings
+	if values.Has(timingsParamName) {
+		timings = values.Get(timingsParamName)
+	}
+
+	return &statsdMonitorCfg{
+		Addr:          u.Host,
+		Prefix:        values.Get(prefixParamName),
+		FlushInterval: flushInterval,
+		MaxPacketSize: maxPacketSize,
+		MaxTimings:    maxTimings,
+		Timings:       timings,
+		ServiceName:   values.Get(serviceNameParamName),
+	}, nil
+}
+
+func getStatsdSize(values url.Values, key string, defaultValue int) (int, error) {
+	size := values.Get(key)
+	if size == "" {
+		return defaultValue, nil
+	}
+
+	number, err := strconv.Atoi(size)
+	if err != nil || number <= 0 {
+		return 0, errors.Errorf("statsd config parameter %s format error, must be a positive number", key)
+	}
+	return number, nil
+}
+
+// NewStatsdMonitor creates a Monitor that sends metrics to a StatsD
+// agent over UDP. config URL syntax is
+// `statsd://<host>:<port>?prefix=name.&flush-interval=timeDuration&max-packet-size=number&max-timings=number&timings=names&service-name=name`
+//
+// InsertRecord values of the timings measurements (eg. `request`
+// durations, in milliseconds) are sent as timings (`|ms`), and other
+// InsertRecord values (eg. runtime-goroutines or request-in-flight)
+// as gauges (`|g`). Count, CountError and CountSimple are sent as
+// counters (`|c`). Tags are sent with DogStatsD syntax
+// (`|#key:value`). CountError adds the error message as an `error`
+// tag.
+//
+// All parameters are optional:
+//
+//   - prefix is prepended to metric names as-is (eg. `myapp.`).
+//   - flush-interval, default 1s: counters with the same name and tags
+//     are summed, and sent with buffered timings and the last value of
+//     each gauge every flush-interval.
+//   - max-packet-size, default 1432 bytes: metrics are batched into UDP
+//     packets of up to max-packet-size.
+//   - max-timings, default 10000: timings recorded when max-timings
+//     are buffered are dropped.
+//   - timings, default `request,http-client-request`: comma-separated
+//     measurements (or prefixes ending with `*`) sent as timings. Add
+//     the measurements of any Timers.
+//   - service-name: if set then all metrics will add tag
+//     service:service-name.
+//
+// The second return value is a function that will send buffered
+// metrics, and stop the flushing goroutine.
+func NewStatsdMonitor(config StatsdMonitorConfig, logger log.Logger) (Monitor, func(), error) {
+	cfg, err := parseStatsdMonitorConfig(config)
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		return nil, func() {}, errors.Wrapf(err, "couldn't connect to statsd agent at %v", cfg.Addr)
+	}
+
+	logger = logger.With(
+		"context", "appkit/monitoring.statsd",
+		"addr", cfg.Addr,
+	)
+
+	monitor := &statsdMonitor{
+		conn:          conn,
+		logger:        logger,
+		prefix:        cfg.Prefix,
+		maxPacketSize: cfg.MaxPacketSize,
+		maxTimings:    cfg.MaxTimings,
+		timingNames:   splitStatsdTimings(cfg.Timings),
+		counters:      map[string]float64{},
+		gauges:        map[string]float64{},
+	}
+	if cfg.ServiceName != "" {
+		monitor.serviceTag = "service:" + sanitizeStatsdTag(cfg.ServiceName)
+	}
+
+	running := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		t := time.NewTicker(cfg.FlushInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				monitor.flush()
+			case <-running:
+				monitor.flush()
+				return
+			}
+		}
+	}()
+
+	_ = logger.Info().Log(
+		"msg", fmt.Sprintf("statsd instrumentation writing to %s", cfg.Addr),
+		"prefix", cfg.Prefix,
+		"flush-interval", cfg.FlushInterval.String(),
+		"max-packet-size", cfg.MaxPacketSize,
+		"service-name", cfg.ServiceName,
+	)
+
+	var once sync.Once
+	return monitor, func() {
+		once.Do(func() {
+			_ = logger.Debug().Log(
+				"msg", "closing statsd monitor",
+			)
+			close(running)
+			<-done
+			conn.Close()
+		})
+	}, nil
+}
+
+type statsdMonitor struct {
+	conn          net.Conn
+	logger        log.Logger
+	prefix        string
+	serviceTag    string
+	maxPacketSize int
+	maxTimings    int
+	timingNames   []string
+
+	mu sync.Mutex
+	// counters and gauges are keyed by metric name and tags, eg.
+	// `logins|#method:password`
+	counters map[string]float64
+	gauges   map[string]float64
+	timings  []string
+	dropped  int
+}
+
+func splitStatsdTimings(timings string) []string {
+	var names []string
+	for _, name := range strings.Split(timings, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (s *statsdMonitor) isTiming(measurement string) bool {
+	for _, pattern := range s.timingNames {
+		if matchMeasurement(pattern, measurement) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *statsdMonitor) InsertRecord(measurement string, value interface{}, tags map[string]string, fields map[string]interface{}, at time.Time) {
+	v, ok := toFloat(value)
+	if !ok {
+		return
+	}
+
+	if !s.isTiming(measurement) {
+		key := s.key(measurement, tags, "")
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.gauges[key] = v
+		return
+	}
+
+	line := s.key(measurement, tags, strconv.FormatFloat(v, 'f', -1, 64)+"|ms")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.timings) >= s.maxTimings {
+		s.dropped++
+		return
+	}
+	s.timings = append(s.timings, line)
+}
+
+func (s *statsdMonitor) Count(measurement string, value float64, tags map[string]string, fields map[string]interface{}) {
+	s.add(measurement, value, tags)
+}
+
+// CountError counts value in measurement, with the given error's
+// message stored in an `error` tag.
+func (s *statsdMonitor) CountError(measurement string, value float64, err error) {
+	s.add(measurement, value, map[string]string{"error": err.Error()})
+}
+
+func (s *statsdMonitor) CountSimple(measurement string, value float64) {
+	s.add(measurement, value, nil)
+}
+
+func (s *statsdMonitor) add(measurement string, value float64, tags map[string]string) {
+	key := s.key(measurement, tags, "")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counters[key] += value
+}
+
+// key formats a metric line, with value (eg. `12|ms`) inserted after
+// the name, or left out if value is blank.
+func (s *statsdMonitor) key(measurement string, tags map[string]string, value string) string {
+	var b strings.Builder
+	b.WriteString(sanitizeStatsdName(s.prefix + measurement))
+	if value != "" {
+		b.WriteByte(':')
+		b.WriteString(value)
+	}
+
+	pairs := make([]string, 0, len(tags)+1)
+	if s.serviceTag != "" {
+		pairs = append(pairs, s.serviceTag)
+	}
+	for k, v := range tags {
+		if k == "service" && s.serviceTag != "" {
+			continue
+		}
+		pairs = append(pairs, sanitizeStatsdTagKey(k)+":"+sanitizeStatsdTag(v))
+	}
+	sort.Strings(pairs)
+
+	if len(pairs) > 0 {
+		b.WriteString("|#")
+		b.WriteString(strings.Join(pairs, ","))
+	}
+	return b.String()
+}
+
+// flush sends aggregated counters, gauges and buffered timings,
+// batched into packets of up to maxPacketSize.
+func (s *statsdMonitor) flush() {
+	s.mu.Lock()
+	counters, gauges, timings, dropped := s.counters, s.gauges, s.timings, s.dropped
+	s.counters = map[string]float64{}
+	s.gauges = map[string]float64{}
+	s.timings = nil
+	s.dropped = 0
+	s.mu.Unlock()
+
+	if dropped > 0 {
+		_ = s.logger.Warn().Log(
+			"msg", fmt.Sprintf("dropped %d statsd timings, more than %d timings buffered", dropped, s.maxTimings),
+			"dropped", dropped,
+		)
+	}
+
+	lines := timings
+	for key, value := range counters {
+		lines = append(lines, statsdLine(key, value, "c"))
+	}
+	for key, value := range gauges {
+		if value < 0 {
+			// a signed gauge value changes the gauge by that much,
+			// so it is reset first
+			lines = append(lines, statsdLine(key, 0, "g"))
+		}
+		lines = append(lines, statsdLine(key, value, "g"))
+	}
+
+	var packet bytes.Buffer
+	var errs int
+	var lastErr error
+
+	send := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := s.conn.Write(packet.Bytes()); err != nil {
+			errs++
+			lastErr = err
+		}
+		packet.Reset()
+	}
+
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > s.maxPacketSize {
+			send()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	send()
+
+	if errs > 0 {
+		_ = s.logger.Warn().Log(
+			"msg", fmt.Sprintf("couldn't send %d statsd packets: %v", errs, lastErr),
+			"err", lastErr,
+			"during", "statsdMonitor.flush",
+		)
+	}
+}
+
+// statsdLine formats a metric line from key (see statsdMonitor.key,
+// `name|#tags` or `name`), value and metric type.
+func statsdLine(key string, value float64, typ string) string {
+	name, tags, _ := strings.Cut(key, "|")
+	line := name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + typ
+	if tags != "" {
+		line += "|" + tags
+	}
+	return line
+}
+
+var statsdNameSanitizer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", " ", "_", "\n", "_")
+
+func sanitizeStatsdName(name string) string {
+	return statsdNameSanitizer.Replace(name)
+}
+
+var statsdTagSanitizer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// sanitizeStatsdTag replaces characters that would break DogStatsD tag
+// syntax.
+func sanitizeStatsdTag(tag string) string {
+	return statsdTagSanitizer.Replace(tag)
+}
+
+// sanitizeStatsdTagKey also replaces colons, the key/value separator.
+func sanitizeStatsdTagKey(key string) string {
+	return strings.ReplaceAll(sanitizeStatsdTag(key), ":", "_")
+}
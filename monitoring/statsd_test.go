@@ -0,0 +1,144 @@
+package monitoring
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theplant/appkit/log"
+)
+
+// listenUDP returns a local UDP listener, and a function that returns
+// the packets received until no more arrive.
+func listenUDP(t *testing.T) (*net.UDPConn, func() []string) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, func() []string {
+		var packets []string
+		buf := make([]byte, 65536)
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, err := conn.Read(buf)
+			if err != nil {
+				return packets
+			}
+			packets = append(packets, string(buf[:n]))
+		}
+	}
+}
+
+func TestParseStatsdMonitorConfig(t *testing.T) {
+	cfg, err := parseStatsdMonitorConfig("statsd://localhost:8125?prefix=app.&flush-interval=5s&max-packet-size=512&service-name=svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := statsdMonitorCfg{
+		Addr:          "localhost:8125",
+		Prefix:        "app.",
+		FlushInterval: 5 * time.Second,
+		MaxPacketSize: 512,
+		MaxTimings:    defaultStatsdMaxTimings,
+		Timings:       defaultStatsdTimings,
+		ServiceName:   "svc",
+	}
+	if *cfg != expected {
+		t.Errorf("expected %+v, got %+v", expected, *cfg)
+	}
+
+	cfg, err = parseStatsdMonitorConfig("statsd://localhost:8125?timings=request,jobs-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Timings != "request,jobs-*" {
+		t.Errorf("expected timings request,jobs-*, got %q", cfg.Timings)
+	}
+
+	for _, invalid := range []string{
+		"statsd://localhost",
+		"udp://localhost:8125",
+		"statsd://localhost:8125?flush-interval=soon",
+		"statsd://localhost:8125?max-packet-size=0",
+	} {
+		if _, err := parseStatsdMonitorConfig(StatsdMonitorConfig(invalid)); err == nil {
+			t.Errorf("%s: expected error", invalid)
+		}
+	}
+}
+
+func TestStatsdMonitor(t *testing.T) {
+	conn, packets := listenUDP(t)
+
+	monitor, closer, err := NewStatsdMonitor(StatsdMonitorConfig(fmt.Sprintf("statsd://%s?prefix=app.&flush-interval=1h&service-name=svc&timings=request,jobs-*", conn.LocalAddr())), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := map[string]string{"path": "/users/{id}", "request_method": "GET", "via": "a,b|c"}
+	monitor.InsertRecord("request", 12.5, tags, map[string]interface{}{"req_id": "1"}, time.Now())
+	monitor.InsertRecord("jobs-export", 100, nil, nil, time.Now())
+	// gauges send their last value
+	monitor.InsertRecord("runtime-goroutines", 10, nil, nil, time.Now())
+	monitor.InsertRecord("runtime-goroutines", 12, nil, nil, time.Now())
+	monitor.InsertRecord("request-in-flight", 0, map[string]string{"path": "/"}, nil, time.Now())
+	monitor.InsertRecord("balance", -5, nil, nil, time.Now())
+	monitor.Count("logins", 1, map[string]string{"method": "password"}, nil)
+	monitor.Count("logins", 2, map[string]string{"method": "password"}, nil)
+	monitor.CountSimple("signups", 1)
+	monitor.CountError("errors", 1, errors.New("wrong io: EOF"))
+
+	// flush on close
+	closer()
+
+	lines := strings.Split(strings.Join(packets(), "\n"), "\n")
+	sort.Strings(lines)
+
+	expected := []string{
+		"app.balance:-5|g|#service:svc",
+		"app.balance:0|g|#service:svc",
+		"app.errors:1|c|#error:wrong io: EOF,service:svc",
+		"app.jobs-export:100|ms|#service:svc",
+		"app.logins:3|c|#method:password,service:svc",
+		"app.request-in-flight:0|g|#path:/,service:svc",
+		"app.request:12.5|ms|#path:/users/{id},request_method:GET,service:svc,via:a_b_c",
+		"app.runtime-goroutines:12|g|#service:svc",
+		"app.signups:1|c|#service:svc",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestStatsdMonitor_Batching(t *testing.T) {
+	conn, packets := listenUDP(t)
+
+	monitor, closer, err := NewStatsdMonitor(StatsdMonitorConfig(fmt.Sprintf("statsd://%s?flush-interval=1h&max-packet-size=100&max-timings=20", conn.LocalAddr())), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 30; i++ {
+		monitor.InsertRecord("request", i, nil, nil, time.Now())
+	}
+	closer()
+
+	var lines int
+	for _, p := range packets() {
+		if len(p) > 100 {
+			t.Errorf("packet of %d bytes is larger than max-packet-size", len(p))
+		}
+		lines += len(strings.Split(p, "\n"))
+	}
+
+	if lines != 20 {
+		t.Errorf("expected 20 timings (the rest dropped), got %d", lines)
+	}
+}
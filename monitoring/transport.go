@@ -0,0 +1,208 @@
+package monitoring
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transport is an http.RoundTripper that records outbound requests in
+// an `http-client-request` measurement, with the request's latency
+// (until response headers are received) in milliseconds as value, so
+// that slow or failing upstream dependencies can be found.
+//
+// Records are tagged with:
+//
+//   - host: the request URL's host (eg. `api.example.com:443`)
+//   - request_method
+//   - status_class: `2xx`, `3xx`, `4xx`, `5xx`, or `error` if the
+//     request failed
+//   - error: if the request failed, where it failed: `dns`,
+//     `connect`, `tls`, `timeout`, `canceled`, or `other`
+//
+// and have dns_ms, connect_ms, tls_ms and ttfb_ms fields with the
+// durations of the phases of the request (if they happened), and a
+// reused field that is true if an idle connection was reused.
+//
+// Transport can wrap (or be wrapped by) logtracing.HTTPTransport:
+//
+//	client := &http.Client{
+//		Transport: &monitoring.Transport{
+//			RoundTripper: &logtracing.HTTPTransport{
+//				BaseName:     "payments",
+//				RoundTripper: http.DefaultTransport,
+//			},
+//		},
+//	}
+type Transport struct {
+	// RoundTripper makes requests, http.DefaultTransport if nil.
+	RoundTripper http.RoundTripper
+
+	// Monitor records requests, if nil the request context's Monitor
+	// is used (see ForceContext).
+	Monitor Monitor
+}
+
+// RoundTrip is part of http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	monitor := t.Monitor
+	if monitor == nil {
+		monitor = ForceContext(req.Context())
+	}
+
+	trace := &clientTrace{start: time.Now()}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+
+	resp, err := rt.RoundTrip(req)
+	latency := time.Since(trace.start)
+
+	tags := map[string]string{
+		"host":           req.URL.Host,
+		"request_method": req.Method,
+	}
+	if err != nil {
+		tags["status_class"] = "error"
+		tags["error"] = trace.errorClass(err)
+	} else {
+		tags["status_class"] = strconv.Itoa(resp.StatusCode/100) + "xx"
+	}
+
+	monitor.InsertRecord("http-client-request", float64(latency)/float64(time.Millisecond), tags, trace.fields(), trace.start)
+
+	return resp, err
+}
+
+// clientTrace records the timing and errors of the phases of a
+// request. Its hooks may be called concurrently (eg. when dialing
+// several addresses).
+type clientTrace struct {
+	start time.Time
+
+	mu                     sync.Mutex
+	dnsStart, dnsDone      time.Time
+	connectStart, connDone time.Time
+	tlsStart, tlsDone      time.Time
+	firstByte              time.Time
+	reused                 bool
+	dnsErr, connectErr     error
+	tlsErr                 error
+}
+
+func (c *clientTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.dnsStart = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.dnsDone = time.Now()
+			c.dnsErr = info.Err
+		},
+		ConnectStart: func(string, string) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.connectStart.IsZero() {
+				c.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(_, _ string, err error) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			// when dialing several addresses, one success is enough
+			if err == nil || c.connDone.IsZero() {
+				c.connDone = time.Now()
+				c.connectErr = err
+			}
+		},
+		TLSHandshakeStart: func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.tlsDone = time.Now()
+			c.tlsErr = err
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.reused = info.Reused
+		},
+		GotFirstResponseByte: func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.firstByte = time.Now()
+		},
+	}
+}
+
+func (c *clientTrace) fields() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fields := map[string]interface{}{"reused": c.reused}
+
+	ms := func(field string, start, end time.Time) {
+		if !start.IsZero() && !end.IsZero() {
+			fields[field] = float64(end.Sub(start)) / float64(time.Millisecond)
+		}
+	}
+	ms("dns_ms", c.dnsStart, c.dnsDone)
+	ms("connect_ms", c.connectStart, c.connDone)
+	ms("tls_ms", c.tlsStart, c.tlsDone)
+	ms("ttfb_ms", c.start, c.firstByte)
+
+	return fields
+}
+
+// errorClass returns where the request failed with err.
+func (c *clientTrace) errorClass(err error) string {
+	c.mu.Lock()
+	dnsErr, connectErr, tlsErr := c.dnsErr, c.connectErr, c.tlsErr
+	c.mu.Unlock()
+
+	var dnsError *net.DNSError
+	var opError *net.OpError
+	var certError *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var recordHeaderError tls.RecordHeaderError
+
+	switch {
+	case dnsErr != nil || errors.As(err, &dnsError):
+		return "dns"
+	case connectErr != nil || (errors.As(err, &opError) && opError.Op == "dial"):
+		return "connect"
+	case tlsErr != nil || errors.As(err, &certError) || errors.As(err, &unknownAuthority) || errors.As(err, &recordHeaderError):
+		return "tls"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case isTimeout(err):
+		return "timeout"
+	}
+	return "other"
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
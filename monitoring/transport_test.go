@@ -0,0 +1,111 @@
+package monitoring
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theplant/appkit/logtracing"
+)
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error":
+			w.WriteHeader(http.StatusBadGateway)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+
+	// a closed port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	rm := &recordsMonitor{}
+	client := &http.Client{
+		Transport: &Transport{
+			RoundTripper: &logtracing.HTTPTransport{BaseName: "test", RoundTripper: http.DefaultTransport},
+		},
+	}
+	ctx := Context(context.Background(), rm)
+
+	get := func(ctx context.Context, url string) {
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	get(ctx, server.URL+"/ok")
+	get(ctx, server.URL+"/error")
+	get(ctx, "http://"+closedAddr+"/")
+	get(ctx, tlsServer.URL+"/")
+	get(timeoutCtx, server.URL+"/slow")
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	expected := []map[string]string{
+		{"host": host, "request_method": "GET", "status_class": "2xx"},
+		{"host": host, "request_method": "GET", "status_class": "5xx"},
+		{"host": closedAddr, "request_method": "GET", "status_class": "error", "error": "connect"},
+		{"host": strings.TrimPrefix(tlsServer.URL, "https://"), "request_method": "GET", "status_class": "error", "error": "tls"},
+		{"host": host, "request_method": "GET", "status_class": "error", "error": "timeout"},
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if len(rm.records) != len(expected) {
+		t.Fatalf("expected %d records, got %v", len(expected), rm.records)
+	}
+	for i, r := range rm.records {
+		if r.measurement != "http-client-request" {
+			t.Errorf("unexpected measurement %q", r.measurement)
+		}
+		for k, v := range expected[i] {
+			if r.tags[k] != v {
+				t.Errorf("record %d: expected %s %q, got %q", i, k, v, r.tags[k])
+			}
+		}
+	}
+
+	if _, ok := rm.records[0].fields["ttfb_ms"]; !ok {
+		t.Errorf("expected ttfb_ms field, got %v", rm.records[0].fields)
+	}
+	if _, ok := rm.records[0].fields["connect_ms"]; !ok {
+		t.Errorf("expected connect_ms field, got %v", rm.records[0].fields)
+	}
+	if rm.records[1].fields["reused"] != true {
+		t.Errorf("expected second request to reuse connection, got %v", rm.records[1].fields)
+	}
+}
+
+func TestTransport_ErrorClass(t *testing.T) {
+	c := &clientTrace{}
+	for err, expected := range map[error]string{
+		&net.DNSError{Err: "no such host", Name: "example.invalid"}: "dns",
+		&net.OpError{Op: "dial", Err: context.DeadlineExceeded}:     "connect",
+		context.Canceled:         "canceled",
+		context.DeadlineExceeded: "timeout",
+		http.ErrBodyNotAllowed:   "other",
+	} {
+		if class := c.errorClass(err); class != expected {
+			t.Errorf("%v: expected %s, got %s", err, expected, class)
+		}
+	}
+}
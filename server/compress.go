@@ -0,0 +1,482 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/theplant/appkit/logtracing"
+)
+
+// Encoder creates a writer that compresses everything written to it
+// into w, using the given compression level. Level 0 means "use the
+// encoder's default level".
+type Encoder func(w io.Writer, level int) (io.WriteCloser, error)
+
+// CompressConfig is configuration for the Compress middleware.
+type CompressConfig struct {
+	// Level is the compression level passed to the encoder. Zero
+	// uses each encoder's default level.
+	Level int
+
+	// MinSize is the minimum size (in bytes) of a response body
+	// that will be compressed. Smaller responses are sent as-is,
+	// because compressing them isn't worth the CPU (or can even
+	// make them bigger). Defaults to 1024.
+	MinSize int
+
+	// SkipContentTypes is a list of media types that won't be
+	// compressed because they are already compressed. Entries
+	// ending in `/*` match a whole type (eg. `video/*`). Defaults to
+	// DefaultSkipContentTypes.
+	SkipContentTypes []string
+
+	// Encoders adds (or replaces) content-codings that can be
+	// negotiated with the client, keyed by content-coding token. gzip
+	// and deflate are always available. Brotli isn't in the standard
+	// library, so to enable it, register an encoder under "br", eg.
+	// with github.com/andybalholm/brotli:
+	//
+	//	Encoders: map[string]server.Encoder{
+	//		"br": func(w io.Writer, level int) (io.WriteCloser, error) {
+	//			return brotli.NewWriterLevel(w, level), nil
+	//		},
+	//	}
+	Encoders map[string]Encoder
+}
+
+// DefaultSkipContentTypes are the media types that Compress won't
+// compress if CompressConfig.SkipContentTypes is nil.
+var DefaultSkipContentTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"video/*",
+	"audio/*",
+	"font/woff",
+	"font/woff2",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/zstd",
+}
+
+const defaultCompressMinSize = 1024
+
+var defaultEncoders = map[string]Encoder{
+	"gzip": func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	},
+	// The "deflate" content-coding is the zlib format (RFC 1950),
+	// not raw deflate.
+	"deflate": func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level == 0 {
+			level = zlib.DefaultCompression
+		}
+		return zlib.NewWriterLevel(w, level)
+	},
+}
+
+// encodingPreference orders content-codings the client accepts with
+// equal quality. Unknown codings sort after these.
+var encodingPreference = []string{"br", "gzip", "deflate"}
+
+// Compress is middleware that compresses response bodies using the
+// best content-coding that the client accepts in `Accept-Encoding`.
+//
+// Responses are sent uncompressed when they are smaller than
+// MinSize, when their Content-Type is in SkipContentTypes, when the
+// handler already set a Content-Encoding, when the response is
+// marked `Cache-Control: no-transform`, when the response has no
+// body (HEAD, 204, 304), or when it is a byte range (206, or with a
+// Content-Range header), as ranges are of the uncompressed body.
+// Compressed responses drop `Accept-Ranges`, for the same reason.
+//
+// Compress adds `Vary: Accept-Encoding` to responses, and turns any
+// ETag set on a compressed response into a weak ETag (`W/"..."`),
+// because the compressed bytes are not byte-for-byte the same
+// representation. To have the ETag calculated from the uncompressed
+// body, put ETag inside Compress:
+//
+//	Compose(ETag, Compress(CompressConfig{}))
+//
+// Flushing the response (eg. for server-sent events) flushes the
+// encoder first, so streamed responses keep working.
+//
+// The raw and compressed sizes of compressed responses are recorded
+// on the request's logtracing span (see LogRequest).
+func Compress(cfg CompressConfig) Middleware {
+	if cfg.MinSize <= 0 {
+		cfg.MinSize = defaultCompressMinSize
+	}
+	if cfg.SkipContentTypes == nil {
+		cfg.SkipContentTypes = DefaultSkipContentTypes
+	}
+
+	encoders := map[string]Encoder{}
+	for coding, e := range defaultEncoders {
+		encoders[coding] = e
+	}
+	for coding, e := range cfg.Encoders {
+		encoders[strings.ToLower(coding)] = e
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), encoders)
+
+			cw := &compressWriter{
+				ResponseWriter: w,
+				request:        r,
+				config:         &cfg,
+				encoding:       encoding,
+				encoder:        encoders[encoding],
+			}
+
+			h.ServeHTTP(cw, r)
+			cw.end()
+		})
+	}
+}
+
+// negotiateEncoding returns the content-coding with the highest
+// quality value in acceptEncoding that has an encoder, or "" if none
+// is acceptable.
+func negotiateEncoding(acceptEncoding string, encoders map[string]Encoder) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, q := parseQuality(part)
+		if coding != "" {
+			accepted[coding] = q
+		}
+	}
+
+	var candidates []string
+	for coding := range encoders {
+		q, ok := accepted[coding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > 0 {
+			candidates = append(candidates, coding)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	quality := func(coding string) float64 {
+		if q, ok := accepted[coding]; ok {
+			return q
+		}
+		return accepted["*"]
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		qi, qj := quality(candidates[i]), quality(candidates[j])
+		if qi != qj {
+			return qi > qj
+		}
+		pi, pj := preferenceIndex(candidates[i]), preferenceIndex(candidates[j])
+		if pi != pj {
+			return pi < pj
+		}
+		return candidates[i] < candidates[j]
+	})
+
+	return candidates[0]
+}
+
+// parseQuality parses one element of an `Accept-Encoding` header, eg.
+// `gzip;q=0.8`.
+func parseQuality(part string) (string, float64) {
+	params := strings.Split(part, ";")
+	coding := strings.ToLower(strings.TrimSpace(params[0]))
+
+	q := 1.0
+	for _, p := range params[1:] {
+		p = strings.TrimSpace(p)
+		if !strings.HasPrefix(p, "q=") {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimPrefix(p, "q="), 64)
+		if err != nil {
+			return coding, 0
+		}
+		q = v
+	}
+
+	return coding, q
+}
+
+func preferenceIndex(coding string) int {
+	for i, c := range encodingPreference {
+		if c == coding {
+			return i
+		}
+	}
+	return len(encodingPreference)
+}
+
+func skipContentType(contentType string, skip []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+
+	for _, s := range skip {
+		if strings.HasSuffix(s, "/*") {
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(s, "*")) {
+				return true
+			}
+		} else if mediaType == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+////////////////////////////////////////////////////////////
+
+// compressWriter buffers the start of the response until it knows
+// whether the body is big enough to be worth compressing, then either
+// sends everything through the encoder or passes it through as-is.
+type compressWriter struct {
+	http.ResponseWriter
+	request  *http.Request
+	config   *CompressConfig
+	encoding string
+	encoder  Encoder
+
+	code    int
+	buf     []byte
+	decided bool
+
+	// encoded is nil if the response is not being compressed
+	encoded io.WriteCloser
+	counter *countingWriter
+	rawSize int64
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.decided || w.code != 0 {
+		return
+	}
+
+	// Informational responses (eg. 103 Early Hints) don't end the
+	// header, pass them straight through.
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	w.code = code
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+
+	if !w.decided {
+		w.buf = append(w.buf, data...)
+		if len(w.buf) < w.config.MinSize {
+			return len(data), nil
+		}
+
+		buf := w.buf
+		w.buf = nil
+		if err := w.decide(true, buf); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	return w.write(data)
+}
+
+// Flush implements http.Flusher. If the response hasn't started yet,
+// it is started (and compressed if allowed, whatever its current
+// size), since a flushing handler is streaming and more data will
+// follow.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if w.code == 0 {
+			w.code = http.StatusOK
+		}
+		buf := w.buf
+		w.buf = nil
+		if err := w.decide(true, buf); err != nil {
+			return
+		}
+	}
+
+	if f, ok := w.encoded.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the wrapped ResponseWriter to http.ResponseController.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) write(data []byte) (int, error) {
+	if w.encoded == nil {
+		return w.ResponseWriter.Write(data)
+	}
+
+	n, err := w.encoded.Write(data)
+	w.rawSize += int64(n)
+	return n, err
+}
+
+// decide sends the response header, compressing the body if
+// sizeOK and the response is eligible, and then writes buf.
+func (w *compressWriter) decide(sizeOK bool, buf []byte) error {
+	w.decided = true
+
+	header := w.Header()
+
+	if !headerContainsToken(header, "Vary", "Accept-Encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if sizeOK && w.compressible(buf) {
+		encoded, err := w.start()
+		if err == nil {
+			w.encoded = encoded
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.code)
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	_, err := w.write(buf)
+	return err
+}
+
+func (w *compressWriter) compressible(buf []byte) bool {
+	header := w.Header()
+
+	if w.encoder == nil ||
+		w.request.Method == http.MethodHead ||
+		w.code < http.StatusOK ||
+		w.code == http.StatusNoContent ||
+		w.code == http.StatusNotModified ||
+		w.code == http.StatusPartialContent ||
+		header.Get("Content-Range") != "" ||
+		header.Get("Content-Encoding") != "" ||
+		headerContainsToken(header, "Cache-Control", "no-transform") {
+		return false
+	}
+
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		if len(buf) == 0 {
+			return false
+		}
+		// net/http would sniff the content type from the first
+		// bytes written, which will be compressed.
+		contentType = http.DetectContentType(buf)
+		header.Set("Content-Type", contentType)
+	}
+
+	return !skipContentType(contentType, w.config.SkipContentTypes)
+}
+
+func (w *compressWriter) start() (io.WriteCloser, error) {
+	w.counter = &countingWriter{Writer: w.ResponseWriter}
+
+	encoded, err := w.encoder(w.counter, w.config.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	header := w.Header()
+	header.Set("Content-Encoding", w.encoding)
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+
+	return encoded, nil
+}
+
+func (w *compressWriter) end() {
+	if !w.decided {
+		if w.code == 0 {
+			// Nothing written, let net/http send its default
+			// response.
+			return
+		}
+		buf := w.buf
+		w.buf = nil
+		_ = w.decide(len(buf) >= w.config.MinSize, buf)
+	}
+
+	if w.encoded == nil {
+		return
+	}
+
+	_ = w.encoded.Close()
+
+	logtracing.AppendSpanKVs(w.request.Context(),
+		"response.content_encoding", w.encoding,
+		"response.raw_size", w.rawSize,
+		"response.compressed_size", w.counter.n,
+	)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	n, err := c.Writer.Write(data)
+	c.n += int64(n)
+	return n, err
+}
+
+// headerContainsToken reports whether the comma-separated header
+// values for key contain token (case-insensitively).
+func headerContainsToken(header http.Header, key, token string) bool {
+	for _, v := range header.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
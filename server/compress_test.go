@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var bigBody = strings.Repeat("appkit compress middleware ", 100)
+
+func serveCompressed(t *testing.T, h http.Handler, acceptEncoding string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	rw := httptest.NewRecorder()
+	Compress(CompressConfig{})(h).ServeHTTP(rw, req)
+	return rw
+}
+
+func bodyHandler(contentType, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		_, _ = io.WriteString(w, body)
+	})
+}
+
+func TestCompressGzip(t *testing.T) {
+	rw := serveCompressed(t, bodyHandler("application/json", bigBody), "gzip, deflate")
+
+	if enc := rw.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding: want gzip, got %q", enc)
+	}
+	if vary := rw.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("Vary: want Accept-Encoding, got %q", vary)
+	}
+
+	zr, err := gzip.NewReader(rw.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(body) != bigBody {
+		t.Errorf("decompressed body doesn't match original")
+	}
+}
+
+func TestCompressNegotiatesQuality(t *testing.T) {
+	rw := serveCompressed(t, bodyHandler("text/plain", bigBody), "gzip;q=0.5, deflate")
+
+	if enc := rw.Header().Get("Content-Encoding"); enc != "deflate" {
+		t.Fatalf("Content-Encoding: want deflate, got %q", enc)
+	}
+
+	zr, err := zlib.NewReader(rw.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, _ := io.ReadAll(zr)
+	if string(body) != bigBody {
+		t.Errorf("decompressed body doesn't match original")
+	}
+
+	rw = serveCompressed(t, bodyHandler("text/plain", bigBody), "gzip;q=0, identity")
+	if enc := rw.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Content-Encoding: want none, got %q", enc)
+	}
+}
+
+func TestCompressSkips(t *testing.T) {
+	cases := map[string]struct {
+		handler        http.Handler
+		acceptEncoding string
+		body           string
+	}{
+		"no accept-encoding": {bodyHandler("text/plain", bigBody), "", bigBody},
+		"small body":         {bodyHandler("text/plain", "small"), "gzip", "small"},
+		"compressed type":    {bodyHandler("image/png", bigBody), "gzip", bigBody},
+		"already encoded": {http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "br")
+			_, _ = io.WriteString(w, bigBody)
+		}), "gzip", bigBody},
+		"no-transform": {http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-transform")
+			_, _ = io.WriteString(w, bigBody)
+		}), "gzip", bigBody},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			rw := serveCompressed(t, c.handler, c.acceptEncoding)
+
+			if enc := rw.Header().Get("Content-Encoding"); enc == "gzip" {
+				t.Errorf("response shouldn't be compressed")
+			}
+			if rw.Body.String() != c.body {
+				t.Errorf("unexpected body %q", rw.Body.String())
+			}
+			if vary := rw.Header().Get("Vary"); vary != "Accept-Encoding" {
+				t.Errorf("Vary: want Accept-Encoding, got %q", vary)
+			}
+		})
+	}
+}
+
+func TestCompressWeakensETag(t *testing.T) {
+	h := Compose(ETag, Compress(CompressConfig{}))(bodyHandler("text/plain", bigBody))
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	etag := rw.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("ETag: want weak ETag, got %q", etag)
+	}
+
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", etag)
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusNotModified {
+		t.Errorf("status: want 304, got %d", rw.Code)
+	}
+	if rw.Body.Len() != 0 {
+		t.Errorf("304 response should have no body, got %d bytes", rw.Body.Len())
+	}
+}
+
+func TestCompressRange(t *testing.T) {
+	h := Compress(CompressConfig{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "body.txt", time.Time{}, strings.NewReader(bigBody))
+	}))
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-99")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusPartialContent {
+		t.Fatalf("status: want 206, got %d", rw.Code)
+	}
+	if enc := rw.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Content-Encoding: want none, got %q", enc)
+	}
+	if rw.Body.String() != bigBody[:100] {
+		t.Errorf("unexpected body %q", rw.Body.String())
+	}
+
+	// ranges of compressed responses aren't advertised
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if enc := rw.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding: want gzip, got %q", enc)
+	}
+	if ranges := rw.Header().Get("Accept-Ranges"); ranges != "" {
+		t.Errorf("Accept-Ranges: want none, got %q", ranges)
+	}
+}
+
+func TestCompressFlush(t *testing.T) {
+	flushed := make(chan []byte, 1)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+		flushed <- append([]byte{}, w.(interface{ Unwrap() http.ResponseWriter }).Unwrap().(*httptest.ResponseRecorder).Body.Bytes()...)
+	})
+
+	rw := serveCompressed(t, h, "gzip")
+
+	if enc := rw.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding: want gzip, got %q", enc)
+	}
+	if !rw.Flushed {
+		t.Errorf("response wasn't flushed")
+	}
+
+	// The flushed prefix of the stream must already decode to the
+	// event, without waiting for the end of the response.
+	zr, err := gzip.NewReader(bytes.NewReader(<-flushed))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf := make([]byte, len("data: hello\n\n"))
+	if _, err := io.ReadFull(zr, buf); err != nil {
+		t.Fatalf("unexpected error reading flushed data: %v", err)
+	}
+	if string(buf) != "data: hello\n\n" {
+		t.Errorf("unexpected flushed data %q", buf)
+	}
+}
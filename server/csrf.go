@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/theplant/appkit/log"
+	"github.com/theplant/appkit/sessions"
+)
+
+// CSRFTokenConfig is configuration for the CSRFProtect middleware.
+type CSRFTokenConfig struct {
+	// SessionKey is the session key that the CSRF secret is stored
+	// under. Defaults to `csrf_secret`.
+	SessionKey string
+
+	// FormField is the form field that tokens are read from.
+	// Defaults to `csrf_token`.
+	FormField string
+
+	// Header is the request header that tokens are read from (before
+	// falling back to FormField), for requests made by JS. Defaults
+	// to `X-CSRF-Token`.
+	Header string
+
+	// ExemptPaths are http.ServeMux patterns (eg. `POST
+	// /webhooks/`) of routes that aren't protected, such as webhooks
+	// called by other services.
+	ExemptPaths []string
+}
+
+const csrfSecretSize = 32
+
+// CSRFProtect is middleware that protects HTML form applications
+// against CSRF with synchronizer tokens, for apps that can't use the
+// custom header check of SecureMiddleware.
+//
+// A random secret is stored in the request's session (so
+// sessions.WithSession must run before CSRFProtect; with the cookie
+// session store, this makes it a signed double-submit cookie). Get a
+// token for the request with CSRFToken (or a hidden form field with
+// CSRFTemplateField), and send it back in the FormField form field,
+// or the Header header. Tokens are masked with a random one-time pad
+// every time they are generated, so they can't be recovered from
+// compressed responses (BREACH).
+//
+// Requests with unsafe methods (anything other than `GET`, `HEAD`,
+// `OPTIONS` and `TRACE`) without a valid token are rejected with
+// `403 Forbidden`.
+func CSRFProtect(cfg CSRFTokenConfig) Middleware {
+	if cfg.SessionKey == "" {
+		cfg.SessionKey = "csrf_secret"
+	}
+	if cfg.FormField == "" {
+		cfg.FormField = "csrf_token"
+	}
+	if cfg.Header == "" {
+		cfg.Header = "X-CSRF-Token"
+	}
+
+	exempt := newRouteMatcher(cfg.ExemptPaths)
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := exempt.match(r); ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := r.Context()
+			logger := log.ForceContext(ctx).With("during", "appkit/server.CSRFProtect")
+
+			secret, err := csrfSecret(ctx, cfg.SessionKey, !isSafeMethod(r.Method))
+			if err != nil {
+				logger.Error().Log(
+					"msg", fmt.Sprintf("error getting CSRF secret from session: %v", err),
+					"err", err,
+				)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			if !isSafeMethod(r.Method) {
+				token := r.Header.Get(cfg.Header)
+				if token == "" {
+					token = r.PostFormValue(cfg.FormField)
+				}
+
+				if reason := verifyCSRFToken(secret, token); reason != "" {
+					logger.Warn().Log(
+						"msg", "CSRF failure: "+reason,
+						"client_ip", clientIP(r),
+					)
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+			}
+
+			ctx = context.WithValue(ctx, csrfSecretKey, &csrfState{secret: secret, field: cfg.FormField})
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+type csrfState struct {
+	secret []byte
+	field  string
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// csrfSecret returns the CSRF secret stored in the session, creating
+// one if there is none, unless existing is true.
+func csrfSecret(ctx context.Context, key string, existing bool) ([]byte, error) {
+	// sessions.Get returns an error if the key is missing, so the
+	// error is only reported by Put if there's no session
+	if encoded, err := sessions.Get(ctx, key); err == nil {
+		if secret, err := base64.RawURLEncoding.DecodeString(encoded); err == nil && len(secret) == csrfSecretSize {
+			return secret, nil
+		}
+	}
+
+	if existing {
+		// Nothing to compare the token to
+		return nil, nil
+	}
+
+	secret := make([]byte, csrfSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	if err := sessions.Put(ctx, key, base64.RawURLEncoding.EncodeToString(secret)); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// verifyCSRFToken returns why token is invalid, or "" if it is valid.
+func verifyCSRFToken(secret []byte, token string) string {
+	if secret == nil {
+		return "no CSRF secret in session"
+	}
+	if token == "" {
+		return "request missing CSRF token"
+	}
+
+	masked, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(masked) != 2*csrfSecretSize {
+		return "malformed CSRF token"
+	}
+
+	if subtle.ConstantTimeCompare(xorBytes(masked[:csrfSecretSize], masked[csrfSecretSize:]), secret) != 1 {
+		return "CSRF token does not match session"
+	}
+
+	return ""
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// CSRFToken returns a CSRF token for the request, to be sent back
+// with unsafe requests. A different (masked) token is returned every
+// time, but all tokens for the same session are valid. Returns "" if
+// CSRFProtect isn't installed (or the request is exempt).
+func CSRFToken(ctx context.Context) string {
+	state, ok := ctx.Value(csrfSecretKey).(*csrfState)
+	if !ok {
+		return ""
+	}
+
+	mask := make([]byte, csrfSecretSize)
+	if _, err := rand.Read(mask); err != nil {
+		panic(fmt.Sprintf("appkit/server.CSRFToken: error generating CSRF token: %v", err))
+	}
+
+	return base64.RawURLEncoding.EncodeToString(append(mask, xorBytes(mask, state.secret)...))
+}
+
+// CSRFTemplateField returns a hidden form field with a CSRF token for
+// the request, for use in HTML templates.
+func CSRFTemplateField(ctx context.Context) template.HTML {
+	state, ok := ctx.Value(csrfSecretKey).(*csrfState)
+	if !ok {
+		return ""
+	}
+
+	return template.HTML(fmt.Sprintf(
+		`<input type="hidden" name="%s" value="%s">`,
+		template.HTMLEscapeString(state.field),
+		CSRFToken(ctx),
+	))
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/theplant/appkit/log"
+	"github.com/theplant/appkit/sessions"
+)
+
+func csrfProtected() http.Handler {
+	return Compose(
+		CSRFProtect(CSRFTokenConfig{ExemptPaths: []string{"POST /webhooks/"}}),
+		sessions.WithSession(&sessions.CookieStoreConfig{
+			Name: "test",
+			Key:  "6bude5uOm9eZV280BjP6f6a5bEj7fg2PWl6GysY68CmXfOv8NFZ9O6ZIpbllQPtr",
+		}),
+		log.WithLogger(log.NewNopLogger()),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, CSRFToken(r.Context()))
+	}))
+}
+
+// getCSRFToken makes a GET request, and returns a token and the
+// session cookies.
+func getCSRFToken(t *testing.T, h http.Handler) (string, []*http.Cookie) {
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+
+	if rw.Code != 200 || rw.Body.String() == "" {
+		t.Fatalf("unexpected response %d %q", rw.Code, rw.Body.String())
+	}
+
+	cookies := rw.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("no session cookie")
+	}
+
+	return rw.Body.String(), cookies
+}
+
+func postForm(h http.Handler, path string, form url.Values, header http.Header, cookies []*http.Cookie) int {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw.Code
+}
+
+func TestCSRFProtect(t *testing.T) {
+	h := csrfProtected()
+
+	token, cookies := getCSRFToken(t, h)
+	otherToken, otherCookies := getCSRFToken(t, h)
+
+	cases := []struct {
+		desc     string
+		path     string
+		form     url.Values
+		header   http.Header
+		cookies  []*http.Cookie
+		wantCode int
+	}{
+		{
+			desc:     "form field",
+			form:     url.Values{"csrf_token": {token}},
+			cookies:  cookies,
+			wantCode: 200,
+		},
+		{
+			desc:     "header",
+			header:   http.Header{"X-Csrf-Token": {token}},
+			cookies:  cookies,
+			wantCode: 200,
+		},
+		{
+			desc:     "missing token",
+			cookies:  cookies,
+			wantCode: 403,
+		},
+		{
+			desc:     "malformed token",
+			form:     url.Values{"csrf_token": {"garbage"}},
+			cookies:  cookies,
+			wantCode: 403,
+		},
+		{
+			desc:     "token from another session",
+			form:     url.Values{"csrf_token": {otherToken}},
+			cookies:  cookies,
+			wantCode: 403,
+		},
+		{
+			desc:     "token from other session's cookie",
+			form:     url.Values{"csrf_token": {otherToken}},
+			cookies:  otherCookies,
+			wantCode: 200,
+		},
+		{
+			desc:     "no session",
+			form:     url.Values{"csrf_token": {token}},
+			wantCode: 403,
+		},
+		{
+			desc:     "exempt path",
+			path:     "/webhooks/github",
+			wantCode: 200,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			path := c.path
+			if path == "" {
+				path = "/"
+			}
+
+			if code := postForm(h, path, c.form, c.header, c.cookies); code != c.wantCode {
+				t.Errorf("status: want %d, got %d", c.wantCode, code)
+			}
+		})
+	}
+}
+
+func TestCSRFTokenMasked(t *testing.T) {
+	h := csrfProtected()
+	token, cookies := getCSRFToken(t, h)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if rw.Body.String() == token {
+		t.Error("tokens should be masked differently for every request")
+	}
+
+	if code := postForm(h, "/", url.Values{"csrf_token": {rw.Body.String()}}, nil, cookies); code != 200 {
+		t.Errorf("status: want 200, got %d", code)
+	}
+}
+
+func TestCSRFTemplateField(t *testing.T) {
+	var field string
+	h := Compose(
+		CSRFProtect(CSRFTokenConfig{FormField: "authenticity_token"}),
+		sessions.WithSession(&sessions.CookieStoreConfig{
+			Name: "test",
+			Key:  "6bude5uOm9eZV280BjP6f6a5bEj7fg2PWl6GysY68CmXfOv8NFZ9O6ZIpbllQPtr",
+		}),
+		log.WithLogger(log.NewNopLogger()),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		field = string(CSRFTemplateField(r.Context()))
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if !strings.HasPrefix(field, `<input type="hidden" name="authenticity_token" value="`) {
+		t.Errorf("unexpected field %q", field)
+	}
+}
@@ -7,7 +7,12 @@ import (
 
 type key int
 
-const headerKey key = iota
+const (
+	headerKey key = iota
+	cspNonceKey
+	csrfSecretKey
+	csrfExemptKey
+)
 
 func WithHeader(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
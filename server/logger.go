@@ -5,7 +5,6 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"runtime"
 	"strconv"
@@ -40,6 +39,8 @@ func LogRequest(h http.Handler) http.Handler {
 			}
 		}
 		ctx, span := logtracing.StartSpan(r.Context(), fmt.Sprintf("%s %s", r.Method, r.URL.Path), opts...)
+		// A Router will set the matched route, see below
+		ctx = contexts.ContextWithRoute(ctx)
 		r = r.WithContext(ctx)
 		span.AppendKVs(
 			logtracing.HTTPServerKVs(r)...,
@@ -54,6 +55,13 @@ func LogRequest(h http.Handler) http.Handler {
 		)
 
 		defer func() {
+			if route, ok := contexts.Route(r.Context()); ok {
+				span.SetName(routeSpanName(r.Method, route))
+				span.AppendKVs(
+					"http.route", route,
+				)
+			}
+
 			status, _ := contexts.HTTPStatus(r.Context())
 			span.AppendKVs(
 				"http.status", status,
@@ -94,6 +102,17 @@ func LogRequest(h http.Handler) http.Handler {
 	})
 }
 
+// routeSpanName names a request's span after its route pattern, eg.
+// `GET /users/{id}`, adding the method if the pattern doesn't have
+// one.
+func routeSpanName(method, route string) string {
+	// Patterns are `[METHOD ][HOST]/[PATH]`
+	if strings.Contains(route, " ") {
+		return route
+	}
+	return method + " " + route
+}
+
 // Adapted from gin-gonic/gin/context.go and gin-gonic/gin/recovery.go
 
 var (
@@ -103,19 +122,10 @@ var (
 	slash     = []byte("/")
 )
 
+// clientIP returns the client IP resolved by contexts.WithClientIP,
+// or by contexts.DefaultClientIPResolver.
 func clientIP(r *http.Request) string {
-	clientIP := r.Header.Get("X-Forwarded-For")
-	if index := strings.IndexByte(clientIP, ','); index >= 0 {
-		clientIP = clientIP[0:index]
-	}
-	clientIP = strings.TrimSpace(clientIP)
-	if len(clientIP) > 0 {
-		return clientIP
-	}
-	if ip, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr)); err == nil {
-		return ip
-	}
-	return ""
+	return contexts.ResolveClientIP(r)
 }
 
 // stack returns a nicely formated stack frame, skipping skip frames
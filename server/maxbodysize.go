@@ -0,0 +1,290 @@
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/theplant/appkit/log"
+	"github.com/theplant/appkit/logtracing"
+)
+
+// DefaultMaxDecodedBodySize is the limit on the size of decoded
+// request bodies, used when neither MaxBodySizeConfig.MaxDecodedSize
+// nor a body size limit is configured for a request.
+const DefaultMaxDecodedBodySize = 32 << 20
+
+// MaxBodySizeConfig is configuration for the MaxBodySize middleware.
+type MaxBodySizeConfig struct {
+	// Default is the maximum size in bytes of request bodies that
+	// don't match any of Routes. Zero means no limit.
+	Default int64
+
+	// Routes sets limits for specific routes, keyed by
+	// http.ServeMux pattern (eg. `POST /uploads/{id}` or
+	// `/imports/`). A zero limit disables the limit for the route.
+	Routes map[string]int64
+
+	// DecodeGzip transparently decodes request bodies sent with
+	// `Content-Encoding: gzip`, so that handlers read the decoded
+	// body. The body size limit applies to the encoded body.
+	DecodeGzip bool
+
+	// MaxDecodedSize is the maximum size in bytes of decoded request
+	// bodies, to protect against decompression bombs. Defaults to the
+	// body size limit for the request, or
+	// DefaultMaxDecodedBodySize if the request has no limit.
+	MaxDecodedSize int64
+}
+
+// MaxBodySize is middleware that limits the size of request bodies.
+//
+// Requests with a `Content-Length` over the limit are rejected with
+// `413 Request Entity Too Large` without calling the handler. Other
+// requests have their body wrapped so that reading past the limit
+// returns an *http.MaxBytesError, and the client gets a 413 response
+// (unless the handler has already started its response, in which
+// case the response is left as-is). Anything the handler writes after
+// the 413 response is discarded.
+//
+// Rejected requests are recorded on the request's logtracing span as
+// `request.body_limit` and `request.rejected_size` (for bodies
+// without a `Content-Length`, the number of bytes read when the limit
+// was hit).
+func MaxBodySize(cfg MaxBodySizeConfig) Middleware {
+	var patterns []string
+	for pattern := range cfg.Routes {
+		patterns = append(patterns, pattern)
+	}
+	routes := newRouteMatcher(patterns)
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := cfg.Default
+			if pattern, ok := routes.match(r); ok {
+				limit = cfg.Routes[pattern]
+			}
+
+			decode := cfg.DecodeGzip && isGzipEncoded(r.Header)
+
+			if (limit <= 0 && !decode) || r.Body == nil || r.Body == http.NoBody {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			if limit > 0 && r.ContentLength > limit {
+				rejectBody(w, r, limit, r.ContentLength)
+				return
+			}
+
+			bw := &bodyLimitWriter{ResponseWriter: w}
+			r2 := r.Clone(r.Context())
+
+			body := r.Body
+			if limit > 0 {
+				body = &limitedBody{
+					ReadCloser: body,
+					remaining:  limit,
+					limit:      limit,
+					exceeded: func(read int64) {
+						if bw.reject() {
+							rejectBody(w, r, limit, read)
+						}
+					},
+				}
+			}
+
+			if decode {
+				maxDecoded := cfg.MaxDecodedSize
+				if maxDecoded <= 0 {
+					maxDecoded = limit
+				}
+				if maxDecoded <= 0 {
+					maxDecoded = DefaultMaxDecodedBodySize
+				}
+
+				zr, err := gzip.NewReader(body)
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					// the body was rejected while reading the gzip
+					// header
+					_ = body.Close()
+					return
+				} else if err != nil {
+					_ = body.Close()
+					log.ForceContext(r.Context()).Warn().Log(
+						"msg", fmt.Sprintf("invalid gzip request body: %v", err),
+						"during", "appkit/server.MaxBodySize",
+						"err", err,
+					)
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+
+				body = &limitedBody{
+					ReadCloser: &gzipBody{Reader: zr, body: body},
+					remaining:  maxDecoded,
+					limit:      maxDecoded,
+					exceeded: func(read int64) {
+						if bw.reject() {
+							rejectBody(w, r, maxDecoded, read)
+						}
+					},
+				}
+
+				r2.Header.Del("Content-Encoding")
+				r2.Header.Del("Content-Length")
+				r2.ContentLength = -1
+			}
+
+			r2.Body = body
+			h.ServeHTTP(bw, r2)
+		})
+	}
+}
+
+func isGzipEncoded(h http.Header) bool {
+	encodings := h.Values("Content-Encoding")
+	return len(encodings) == 1 && strings.EqualFold(strings.TrimSpace(encodings[0]), "gzip")
+}
+
+func rejectBody(w http.ResponseWriter, r *http.Request, limit, size int64) {
+	ctx := r.Context()
+
+	logtracing.AppendSpanKVs(ctx,
+		"request.body_limit", limit,
+		"request.rejected_size", size,
+	)
+	log.ForceContext(ctx).Warn().Log(
+		"msg", fmt.Sprintf("request body of %d bytes exceeds limit of %d bytes", size, limit),
+		"during", "appkit/server.MaxBodySize",
+		"body_limit", limit,
+		"rejected_size", size,
+	)
+
+	header := w.Header()
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	// The rest of the body won't be read, so the connection can't be
+	// reused.
+	header.Set("Connection", "close")
+	http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+}
+
+// limitedBody is like the reader returned by http.MaxBytesReader,
+// but calls exceeded (once) when the limit is hit, instead of
+// closing the connection.
+type limitedBody struct {
+	io.ReadCloser
+
+	remaining int64
+	limit     int64
+	err       error
+	exceeded  func(read int64)
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// Reading (at least) one byte more than remaining tells whether
+	// the body is over the limit or exactly at it.
+	n, err := l.ReadCloser.Read(p)
+	if int64(n) <= l.remaining {
+		l.remaining -= int64(n)
+		l.err = err
+		return n, err
+	}
+
+	read := l.limit - l.remaining + int64(n)
+	n = int(l.remaining)
+	l.remaining = 0
+	l.err = &http.MaxBytesError{Limit: l.limit}
+	l.exceeded(read)
+	return n, l.err
+}
+
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g *gzipBody) Close() error {
+	err := g.Reader.Close()
+	if e := g.body.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// bodyLimitWriter discards the handler's response once the request
+// has been rejected.
+type bodyLimitWriter struct {
+	http.ResponseWriter
+
+	mu       sync.Mutex
+	started  bool
+	rejected bool
+}
+
+// reject returns true if the response hasn't started yet, in which
+// case the caller should send the rejection response.
+func (w *bodyLimitWriter) reject() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.started || w.rejected {
+		return false
+	}
+	w.rejected = true
+	return true
+}
+
+func (w *bodyLimitWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.rejected {
+		return
+	}
+	if code >= 200 || code == http.StatusSwitchingProtocols {
+		w.started = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *bodyLimitWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.rejected {
+		return len(b), nil
+	}
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyLimitWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.rejected {
+		return
+	}
+	w.started = true
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying
+// http.ResponseWriter.
+func (w *bodyLimitWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
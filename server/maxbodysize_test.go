@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/theplant/appkit/log"
+)
+
+// echoHandler echoes the request body, or responds with 400 Bad
+// Request if the body can't be read.
+func echoHandler(readErr *error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if readErr != nil {
+			*readErr = err
+		}
+		if err != nil {
+			http.Error(w, "bad body", http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(body)
+	})
+}
+
+func serveMaxBodySize(cfg MaxBodySizeConfig, h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	Compose(
+		MaxBodySize(cfg),
+		log.WithLogger(log.NewNopLogger()),
+	)(h).ServeHTTP(rw, req)
+	return rw
+}
+
+// streamedRequest creates a request with an unknown Content-Length.
+func streamedRequest(method, path, body string) *http.Request {
+	req := httptest.NewRequest(method, path, io.NopCloser(strings.NewReader(body)))
+	req.ContentLength = -1
+	return req
+}
+
+func gzipped(t *testing.T, s string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if _, err := io.WriteString(zw, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestMaxBodySize(t *testing.T) {
+	cfg := MaxBodySizeConfig{
+		Default: 10,
+		Routes: map[string]int64{
+			"POST /uploads/": 100,
+			"POST /free":     0,
+		},
+	}
+
+	cases := []struct {
+		desc     string
+		req      *http.Request
+		wantCode int
+		wantBody string
+	}{
+		{
+			desc:     "within limit",
+			req:      httptest.NewRequest("POST", "/", strings.NewReader("0123456789")),
+			wantCode: 200,
+			wantBody: "0123456789",
+		},
+		{
+			desc:     "Content-Length over limit",
+			req:      httptest.NewRequest("POST", "/", strings.NewReader("0123456789a")),
+			wantCode: 413,
+			wantBody: "Request Entity Too Large\n",
+		},
+		{
+			desc:     "streamed within limit",
+			req:      streamedRequest("POST", "/", "0123456789"),
+			wantCode: 200,
+			wantBody: "0123456789",
+		},
+		{
+			desc:     "streamed over limit",
+			req:      streamedRequest("POST", "/", "0123456789a"),
+			wantCode: 413,
+			wantBody: "Request Entity Too Large\n",
+		},
+		{
+			desc:     "route limit",
+			req:      httptest.NewRequest("POST", "/uploads/1", strings.NewReader(strings.Repeat("a", 100))),
+			wantCode: 200,
+			wantBody: strings.Repeat("a", 100),
+		},
+		{
+			desc:     "no limit for route",
+			req:      httptest.NewRequest("POST", "/free", strings.NewReader(strings.Repeat("a", 1000))),
+			wantCode: 200,
+			wantBody: strings.Repeat("a", 1000),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			rw := serveMaxBodySize(cfg, echoHandler(nil), c.req)
+
+			if rw.Code != c.wantCode {
+				t.Errorf("status: want %d, got %d", c.wantCode, rw.Code)
+			}
+			if rw.Body.String() != c.wantBody {
+				t.Errorf("body: want %q, got %q", c.wantBody, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestMaxBodySizeReadError(t *testing.T) {
+	var readErr error
+	serveMaxBodySize(MaxBodySizeConfig{Default: 5}, echoHandler(&readErr), streamedRequest("POST", "/", "0123456789"))
+
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(readErr, &maxBytesErr) || maxBytesErr.Limit != 5 {
+		t.Errorf("want *http.MaxBytesError with limit 5, got %v", readErr)
+	}
+}
+
+func TestMaxBodySizeAfterResponseStarted(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "started")
+		_, _ = io.Copy(io.Discard, r.Body)
+	})
+
+	rw := serveMaxBodySize(MaxBodySizeConfig{Default: 5}, h, streamedRequest("POST", "/", "0123456789"))
+
+	if rw.Code != 200 || rw.Body.String() != "started" {
+		t.Errorf("unexpected response %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestMaxBodySizeDecodeGzip(t *testing.T) {
+	payload := strings.Repeat("a", 1000)
+
+	var gotEncoding string
+	var gotLength int64
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEncoding = r.Header.Get("Content-Encoding")
+		gotLength = r.ContentLength
+		echoHandler(nil).ServeHTTP(w, r)
+	})
+
+	req := httptest.NewRequest("POST", "/", gzipped(t, payload))
+	req.Header.Set("Content-Encoding", "gzip")
+
+	rw := serveMaxBodySize(MaxBodySizeConfig{DecodeGzip: true, Default: 100, MaxDecodedSize: 1000}, h, req)
+
+	if rw.Code != 200 || rw.Body.String() != payload {
+		t.Errorf("unexpected response %d %q", rw.Code, rw.Body.String())
+	}
+	if gotEncoding != "" {
+		t.Errorf("Content-Encoding should be removed, got %q", gotEncoding)
+	}
+	if gotLength != -1 {
+		t.Errorf("ContentLength: want -1, got %d", gotLength)
+	}
+}
+
+func TestMaxBodySizeDecompressionBomb(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", gzipped(t, strings.Repeat("a", 1<<20)))
+	req.Header.Set("Content-Encoding", "gzip")
+
+	var readErr error
+	rw := serveMaxBodySize(MaxBodySizeConfig{DecodeGzip: true, Default: 10000}, echoHandler(&readErr), req)
+
+	if rw.Code != 413 {
+		t.Errorf("status: want 413, got %d", rw.Code)
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(readErr, &maxBytesErr) || maxBytesErr.Limit != 10000 {
+		t.Errorf("want *http.MaxBytesError with limit 10000, got %v", readErr)
+	}
+}
+
+func TestMaxBodySizeRejectedSize(t *testing.T) {
+	buf := &bytes.Buffer{}
+	h := Compose(
+		MaxBodySize(MaxBodySizeConfig{Default: 100}),
+		log.WithLogger(log.Logger{Logger: kitlog.NewLogfmtLogger(buf)}),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = r.Body.Read(make([]byte, 300))
+	}))
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, streamedRequest("POST", "/", strings.Repeat("a", 1000)))
+
+	if rw.Code != 413 {
+		t.Errorf("status: want 413, got %d", rw.Code)
+	}
+	// the bytes read when the limit was hit
+	if !strings.Contains(buf.String(), "rejected_size=300") {
+		t.Errorf("log should contain rejected_size=300, got %q", buf.String())
+	}
+}
+
+func TestMaxBodySizeGzipHeaderOverLimit(t *testing.T) {
+	req := streamedRequest("POST", "/", gzipped(t, "hello").String())
+	req.Header.Set("Content-Encoding", "gzip")
+
+	called := false
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	// the limit is hit while reading the gzip header
+	rw := serveMaxBodySize(MaxBodySizeConfig{DecodeGzip: true, Default: 5}, h, req)
+
+	if rw.Code != 413 || rw.Body.String() != http.StatusText(413)+"\n" {
+		t.Errorf("unexpected response %d %q", rw.Code, rw.Body.String())
+	}
+	if called {
+		t.Error("handler should not be called")
+	}
+}
+
+func TestMaxBodySizeInvalidGzip(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", strings.NewReader("not gzip"))
+	req.Header.Set("Content-Encoding", "gzip")
+
+	called := false
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	rw := serveMaxBodySize(MaxBodySizeConfig{DecodeGzip: true}, h, req)
+
+	if rw.Code != 400 {
+		t.Errorf("status: want 400, got %d", rw.Code)
+	}
+	if called {
+		t.Error("handler should not be called")
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rs/cors"
+)
+
+// OriginMatcher matches request origins (eg. the `Origin` header)
+// against a list of allowed origins. Each allowed origin is one of:
+//
+//   - An exact origin, eg. `https://example.com` or
+//     `http://localhost:3000`.
+//
+//   - A wildcard subdomain origin, eg. `https://*.example.com`, that
+//     matches origins with the same scheme and port, and a host with
+//     one or more labels in place of the `*` (eg.
+//     `https://pr-123.example.com`, but not `https://example.com`).
+//
+//   - A regular expression prefixed with `regexp:`, eg.
+//     `regexp:https://pr-[0-9]+\.preview\.example\.com`. The
+//     expression must match the whole origin.
+//
+//   - `*`, which allows any origin for CORS, as
+//     `Access-Control-Allow-Origin: *` (see AllowsAll). Browsers
+//     refuse that for requests with credentials. `*` isn't matched by
+//     Match, so it doesn't pass SecureMiddleware's CSRF origin check.
+//
+// Origins are compared case-insensitively.
+type OriginMatcher struct {
+	all       bool
+	exact     map[string]bool
+	wildcards []wildcardOrigin
+	regexps   []*regexp.Regexp
+}
+
+type wildcardOrigin struct {
+	// scheme is eg. `https://`
+	scheme string
+	// suffix is eg. `.example.com:8443`
+	suffix string
+}
+
+// NewOriginMatcher creates an OriginMatcher, returning an error if an
+// origin is invalid.
+func NewOriginMatcher(origins []string) (*OriginMatcher, error) {
+	m := &OriginMatcher{exact: map[string]bool{}}
+
+	for _, origin := range origins {
+		origin = strings.TrimSpace(origin)
+
+		switch {
+		case origin == "":
+			continue
+
+		case origin == "*":
+			m.all = true
+
+		case strings.HasPrefix(origin, "regexp:"):
+			re, err := regexp.Compile(`^(?i:` + strings.TrimPrefix(origin, "regexp:") + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("invalid origin regexp %q: %w", origin, err)
+			}
+			m.regexps = append(m.regexps, re)
+
+		case strings.Contains(origin, "*"):
+			scheme, host, ok := strings.Cut(strings.ToLower(origin), "://")
+			if !ok || !strings.HasPrefix(host, "*.") || strings.Count(host, "*") != 1 || strings.Contains(host, "/") {
+				return nil, fmt.Errorf("invalid wildcard origin %q, must be like https://*.example.com", origin)
+			}
+			m.wildcards = append(m.wildcards, wildcardOrigin{
+				scheme: scheme + "://",
+				suffix: strings.TrimPrefix(host, "*"),
+			})
+
+		default:
+			m.exact[normalizeOrigin(origin)] = true
+		}
+	}
+
+	return m, nil
+}
+
+// AllowsAll returns true if the allowed origins include `*`.
+func (m *OriginMatcher) AllowsAll() bool {
+	return m.all
+}
+
+// CORSOptions sets the allowed origins of opts: `*` if the allowed
+// origins include `*` (so that rs/cors sends
+// `Access-Control-Allow-Origin: *`, rather than reflecting the
+// request's origin), or else Match.
+func (m *OriginMatcher) CORSOptions(opts cors.Options) cors.Options {
+	if m.all {
+		opts.AllowedOrigins = []string{"*"}
+		opts.AllowOriginFunc = nil
+	} else {
+		opts.AllowedOrigins = nil
+		opts.AllowOriginFunc = m.Match
+	}
+	return opts
+}
+
+// Match returns true if origin is one of the allowed origins, other
+// than `*`.
+func (m *OriginMatcher) Match(origin string) bool {
+	if origin == "" {
+		return false
+	}
+
+	origin = normalizeOrigin(origin)
+
+	if m.exact[origin] {
+		return true
+	}
+
+	for _, w := range m.wildcards {
+		if !strings.HasPrefix(origin, w.scheme) {
+			continue
+		}
+		host := strings.TrimPrefix(origin, w.scheme)
+		if sub, ok := strings.CutSuffix(host, w.suffix); ok && isSubdomainLabels(sub) {
+			return true
+		}
+	}
+
+	for _, re := range m.regexps {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func normalizeOrigin(origin string) string {
+	return strings.TrimSuffix(strings.ToLower(origin), "/")
+}
+
+// isSubdomainLabels returns true if s is one or more non-empty DNS
+// labels, eg. `pr-123` or `a.b`.
+func isSubdomainLabels(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package server
+
+import "testing"
+
+func TestOriginMatcher(t *testing.T) {
+	m, err := NewOriginMatcher([]string{
+		"https://example.com",
+		"http://localhost:3000/",
+		"https://*.preview.example.com",
+		"https://*.example.org:8443",
+		`regexp:https://pr-[0-9]+\.example\.net`,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://example.com", true},
+		{"HTTPS://Example.com", true},
+		{"http://example.com", false},
+		{"https://example.com:8443", false},
+		{"http://localhost:3000", true},
+		{"https://pr-123.preview.example.com", true},
+		{"https://a.b.preview.example.com", true},
+		{"https://preview.example.com", false},
+		{"http://pr-123.preview.example.com", false},
+		{"https://evil.com/.preview.example.com", false},
+		{"https://pr-1.preview.example.com.evil.com", false},
+		{"https://a.example.org:8443", true},
+		{"https://a.example.org", false},
+		{"https://pr-7.example.net", true},
+		{"https://pr-7.example.net.evil.com", false},
+		{"https://xpr-7.example.net", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		if got := m.Match(c.origin); got != c.want {
+			t.Errorf("%q: want %v, got %v", c.origin, c.want, got)
+		}
+	}
+}
+
+func TestOriginMatcherAll(t *testing.T) {
+	m, err := NewOriginMatcher([]string{"*"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !m.AllowsAll() {
+		t.Error("* should allow all origins")
+	}
+	// ...via `Access-Control-Allow-Origin: *`, not by matching
+	if m.Match("https://anything.example.com") {
+		t.Error("* shouldn't match origins")
+	}
+}
+
+func TestOriginMatcherInvalid(t *testing.T) {
+	for _, origin := range []string{
+		"https://example.*.com",
+		"https://*example.com",
+		"https://*.*.example.com",
+		"regexp:https://(",
+	} {
+		if _, err := NewOriginMatcher([]string{origin}); err == nil {
+			t.Errorf("%q: expected error", origin)
+		}
+	}
+}
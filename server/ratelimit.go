@@ -0,0 +1,383 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/theplant/appkit/log"
+	"github.com/theplant/appkit/logtracing"
+)
+
+// CountMonitor is the part of monitoring.Monitor that server
+// middleware uses to count events. (This package can't use
+// monitoring.Monitor directly, as monitoring depends on server.)
+type CountMonitor interface {
+	Count(measurement string, value float64, tags map[string]string, fields map[string]interface{})
+}
+
+// RateLimitKeyFunc returns the key that a request is rate limited
+// by. Requests with the same key share a quota. Returning false
+// exempts the request from rate limiting.
+type RateLimitKeyFunc func(r *http.Request) (string, bool)
+
+// RateLimitByClientIP rate limits requests by client IP address.
+func RateLimitByClientIP(r *http.Request) (string, bool) {
+	ip := clientIP(r)
+	return "ip:" + ip, ip != ""
+}
+
+// RateLimitByBasicAuthUser rate limits requests by HTTP basic auth
+// username. Requests without basic auth credentials are not rate
+// limited.
+func RateLimitByBasicAuthUser(r *http.Request) (string, bool) {
+	username, _, ok := r.BasicAuth()
+	return "user:" + username, ok && username != ""
+}
+
+// RateLimitResult is the outcome of a rate limit check.
+type RateLimitResult struct {
+	Allowed bool
+
+	// Limit is the size of the quota
+	Limit int
+
+	// Remaining is the number of requests left in the quota
+	Remaining int
+
+	// Reset is the time until the quota is completely restored
+	Reset time.Duration
+
+	// RetryAfter is the time until a rejected request would be
+	// allowed
+	RetryAfter time.Duration
+}
+
+// RateLimitState is the per-key state kept in a RateLimitStore. What
+// the values mean depends on the RateLimitAlgorithm.
+type RateLimitState struct {
+	Time  time.Time
+	Value float64
+	Prev  float64
+}
+
+// RateLimitStore keeps the state of rate limits. Implement this to
+// share rate limits between several instances of a service (eg. in
+// Redis).
+type RateLimitStore interface {
+	// Update atomically replaces the state stored under key with
+	// the result of update, which is passed the current state (the
+	// zero RateLimitState if there is none), and returns the new
+	// state. The state should expire ttl after it was last updated.
+	//
+	// update may be called more than once (eg. by a store using
+	// optimistic concurrency control), only the state returned by
+	// the last call is stored.
+	Update(ctx context.Context, key string, ttl time.Duration, update func(RateLimitState) RateLimitState) (RateLimitState, error)
+}
+
+// RateLimitAlgorithm decides whether a request with the given key is
+// allowed, keeping its state in store.
+type RateLimitAlgorithm interface {
+	Allow(ctx context.Context, store RateLimitStore, key string, now time.Time) (RateLimitResult, error)
+}
+
+////////////////////////////////////////////////////////////
+// Algorithms
+
+// TokenBucket allows Limit requests Per time period on average, with
+// bursts of up to Burst requests.
+type TokenBucket struct {
+	Limit int
+	Per   time.Duration
+
+	// Burst is the size of the bucket. Defaults to Limit.
+	Burst int
+}
+
+func (tb TokenBucket) validate() error {
+	if tb.Limit <= 0 || tb.Per <= 0 {
+		return fmt.Errorf("token bucket needs a positive Limit and Per, got %d per %v", tb.Limit, tb.Per)
+	}
+	return nil
+}
+
+// Allow is part of RateLimitAlgorithm
+func (tb TokenBucket) Allow(ctx context.Context, store RateLimitStore, key string, now time.Time) (RateLimitResult, error) {
+	capacity := float64(tb.Burst)
+	if tb.Burst <= 0 {
+		capacity = float64(tb.Limit)
+	}
+	// tokens per second
+	rate := float64(tb.Limit) / tb.Per.Seconds()
+	ttl := seconds(capacity / rate)
+
+	var result RateLimitResult
+
+	_, err := store.Update(ctx, key, ttl, func(s RateLimitState) RateLimitState {
+		tokens := capacity
+		if !s.Time.IsZero() {
+			tokens = math.Min(capacity, s.Value+now.Sub(s.Time).Seconds()*rate)
+		}
+
+		result = RateLimitResult{Limit: int(capacity)}
+
+		if tokens >= 1 {
+			tokens--
+			result.Allowed = true
+		} else {
+			result.RetryAfter = seconds((1 - tokens) / rate)
+		}
+
+		result.Remaining = int(tokens)
+		result.Reset = seconds((capacity - tokens) / rate)
+
+		return RateLimitState{Time: now, Value: tokens}
+	})
+
+	return result, err
+}
+
+// SlidingWindow allows Limit requests in any Window. It approximates
+// the number of requests in the sliding window by weighting the count
+// of the previous fixed window by how much it overlaps the sliding
+// window.
+type SlidingWindow struct {
+	Limit  int
+	Window time.Duration
+}
+
+func (sw SlidingWindow) validate() error {
+	if sw.Limit <= 0 || sw.Window <= 0 {
+		return fmt.Errorf("sliding window needs a positive Limit and Window, got %d per %v", sw.Limit, sw.Window)
+	}
+	return nil
+}
+
+// Allow is part of RateLimitAlgorithm
+func (sw SlidingWindow) Allow(ctx context.Context, store RateLimitStore, key string, now time.Time) (RateLimitResult, error) {
+	limit := float64(sw.Limit)
+	windowStart := now.Truncate(sw.Window)
+	elapsed := now.Sub(windowStart)
+	// weight of the previous window
+	weight := 1 - float64(elapsed)/float64(sw.Window)
+
+	var result RateLimitResult
+
+	_, err := store.Update(ctx, key, 2*sw.Window, func(s RateLimitState) RateLimitState {
+		var current, previous float64
+		switch {
+		case s.Time.Equal(windowStart):
+			current, previous = s.Value, s.Prev
+		case s.Time.Equal(windowStart.Add(-sw.Window)):
+			previous = s.Value
+		}
+
+		count := previous*weight + current
+
+		result = RateLimitResult{Limit: sw.Limit}
+
+		if count+1 <= limit {
+			current++
+			count++
+			result.Allowed = true
+		} else if previous > 0 && current+1 <= limit {
+			// Wait until enough of the previous window has slid out
+			// of the sliding window.
+			wait := time.Duration((1-(limit-1-current)/previous)*float64(sw.Window)) - elapsed
+			result.RetryAfter = wait
+		} else {
+			result.RetryAfter = sw.Window - elapsed
+		}
+
+		result.Remaining = int(math.Max(0, math.Floor(limit-count)))
+		result.Reset = sw.Window - elapsed
+		if previous > 0 {
+			result.Reset += sw.Window
+		}
+
+		return RateLimitState{Time: windowStart, Value: current, Prev: previous}
+	})
+
+	return result, err
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+////////////////////////////////////////////////////////////
+// In-memory store
+
+type memoryRateLimitEntry struct {
+	state   RateLimitState
+	expires time.Time
+}
+
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	entries   map[string]memoryRateLimitEntry
+	lastSweep time.Time
+}
+
+// memoryStoreSweepInterval is how often expired keys are removed from
+// the in-memory store.
+const memoryStoreSweepInterval = time.Minute
+
+// NewMemoryRateLimitStore creates a RateLimitStore that keeps rate
+// limits in memory, so they are not shared between instances of a
+// service.
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{
+		entries:   map[string]memoryRateLimitEntry{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Update is part of RateLimitStore
+func (m *memoryRateLimitStore) Update(_ context.Context, key string, ttl time.Duration, update func(RateLimitState) RateLimitState) (RateLimitState, error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.lastSweep) > memoryStoreSweepInterval {
+		for k, e := range m.entries {
+			if now.After(e.expires) {
+				delete(m.entries, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	var state RateLimitState
+	if e, ok := m.entries[key]; ok && !now.After(e.expires) {
+		state = e.state
+	}
+
+	state = update(state)
+	m.entries[key] = memoryRateLimitEntry{state: state, expires: now.Add(ttl)}
+
+	return state, nil
+}
+
+////////////////////////////////////////////////////////////
+// Middleware
+
+// RateLimitConfig is configuration for the RateLimit middleware.
+type RateLimitConfig struct {
+	// Name identifies the rate limit, to allow several rate limits
+	// to share a Store, and is used to tag metrics. Defaults to
+	// "default".
+	Name string
+
+	// Algorithm is required, eg. TokenBucket or SlidingWindow.
+	Algorithm RateLimitAlgorithm
+
+	// Key returns the key to rate limit a request by. Defaults to
+	// RateLimitByClientIP.
+	Key RateLimitKeyFunc
+
+	// Store defaults to a new in-memory store.
+	Store RateLimitStore
+
+	// Monitor, if set, counts rejected requests in the
+	// `rate_limited` measurement (pass a monitoring.Monitor).
+	Monitor CountMonitor
+}
+
+// RateLimit is middleware that limits the rate of requests per key
+// (by default, per client IP).
+//
+// Responses get `RateLimit-Limit`, `RateLimit-Remaining` and
+// `RateLimit-Reset` headers (as in the IETF RateLimit header fields
+// draft). Requests over the limit get `429 Too Many Requests` with a
+// `Retry-After` header, are recorded on the logtracing span as
+// `rate_limited=1`, and are counted in the Monitor.
+//
+// If the store fails, requests are allowed.
+//
+// RateLimit will panic if no algorithm is configured, or if a
+// TokenBucket or SlidingWindow has no positive Limit and Per/Window.
+func RateLimit(cfg RateLimitConfig) Middleware {
+	if cfg.Algorithm == nil {
+		panic("appkit/server.RateLimit: no rate limit algorithm configured")
+	}
+	if v, ok := cfg.Algorithm.(interface{ validate() error }); ok {
+		if err := v.validate(); err != nil {
+			panic(fmt.Sprintf("appkit/server.RateLimit: %v", err))
+		}
+	}
+	if cfg.Name == "" {
+		cfg.Name = "default"
+	}
+	if cfg.Key == nil {
+		cfg.Key = RateLimitByClientIP
+	}
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryRateLimitStore()
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := cfg.Key(r)
+			if !ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := r.Context()
+
+			result, err := cfg.Algorithm.Allow(ctx, cfg.Store, cfg.Name+":"+key, time.Now())
+			if err != nil {
+				log.ForceContext(ctx).Error().Log(
+					"msg", fmt.Sprintf("error checking rate limit, allowing request: %v", err),
+					"during", "appkit/server.RateLimit",
+					"rate_limit", cfg.Name,
+					"err", err,
+				)
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			header := w.Header()
+			header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+			if result.Allowed {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			logtracing.AppendSpanKVs(ctx,
+				"rate_limited", 1,
+				"rate_limit", cfg.Name,
+			)
+			log.ForceContext(ctx).Warn().Log(
+				"msg", "request rate limited",
+				"during", "appkit/server.RateLimit",
+				"rate_limit", cfg.Name,
+				"rate_limit_key", key,
+			)
+			if cfg.Monitor != nil {
+				cfg.Monitor.Count("rate_limited", 1, map[string]string{"rate_limit": cfg.Name}, nil)
+			}
+
+			retryAfter := ceilSeconds(result.RetryAfter)
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			header.Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		})
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/theplant/appkit/log"
+)
+
+type countMonitor struct {
+	counts map[string]float64
+}
+
+func (m *countMonitor) Count(measurement string, value float64, tags map[string]string, fields map[string]interface{}) {
+	m.counts[measurement+":"+tags["rate_limit"]] += value
+}
+
+func rateLimited(cfg RateLimitConfig) http.Handler {
+	return Compose(
+		RateLimit(cfg),
+		log.WithLogger(log.NewNopLogger()),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+func requestFrom(ip string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = ip + ":1234"
+	return req
+}
+
+func TestRateLimitTokenBucket(t *testing.T) {
+	monitor := &countMonitor{counts: map[string]float64{}}
+	h := rateLimited(RateLimitConfig{
+		Algorithm: TokenBucket{Limit: 1, Per: time.Hour, Burst: 2},
+		Monitor:   monitor,
+	})
+
+	for i, want := range []int{200, 200, 429} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, requestFrom("10.0.0.1"))
+
+		if rw.Code != want {
+			t.Fatalf("request %d: want %d, got %d", i, want, rw.Code)
+		}
+		if rw.Header().Get("RateLimit-Limit") != "2" {
+			t.Errorf("request %d: RateLimit-Limit: want 2, got %q", i, rw.Header().Get("RateLimit-Limit"))
+		}
+		if want == 429 {
+			if rw.Header().Get("RateLimit-Remaining") != "0" {
+				t.Errorf("RateLimit-Remaining: want 0, got %q", rw.Header().Get("RateLimit-Remaining"))
+			}
+			if rw.Header().Get("Retry-After") != "3600" {
+				t.Errorf("Retry-After: want 3600, got %q", rw.Header().Get("Retry-After"))
+			}
+		}
+	}
+
+	// Other clients have their own quota
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, requestFrom("10.0.0.2"))
+	if rw.Code != 200 {
+		t.Errorf("other client: want 200, got %d", rw.Code)
+	}
+
+	if monitor.counts["rate_limited:default"] != 1 {
+		t.Errorf("rate_limited count: want 1, got %v", monitor.counts["rate_limited:default"])
+	}
+}
+
+func TestRateLimitTokenBucketRefill(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	tb := TokenBucket{Limit: 10, Per: time.Second}
+	ctx := context.Background()
+	now := time.Now()
+
+	for i := 0; i < 10; i++ {
+		if res, _ := tb.Allow(ctx, store, "k", now); !res.Allowed {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+	if res, _ := tb.Allow(ctx, store, "k", now); res.Allowed {
+		t.Fatal("bucket should be empty")
+	}
+
+	// One token every 100ms
+	res, _ := tb.Allow(ctx, store, "k", now.Add(150*time.Millisecond))
+	if !res.Allowed {
+		t.Error("request should be allowed after refill")
+	}
+	if res.Remaining != 0 {
+		t.Errorf("remaining: want 0, got %d", res.Remaining)
+	}
+}
+
+func TestRateLimitSlidingWindow(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	sw := SlidingWindow{Limit: 4, Window: time.Minute}
+	ctx := context.Background()
+	start := time.Now().Truncate(time.Minute)
+
+	for i := 0; i < 4; i++ {
+		if res, _ := sw.Allow(ctx, store, "k", start.Add(time.Second)); !res.Allowed {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+
+	res, _ := sw.Allow(ctx, store, "k", start.Add(30*time.Second))
+	if res.Allowed {
+		t.Fatal("request over the limit should be rejected")
+	}
+	if res.RetryAfter != 30*time.Second {
+		t.Errorf("retry after: want 30s, got %v", res.RetryAfter)
+	}
+
+	// Half way through the next window, half of the previous
+	// window's requests still count.
+	next := start.Add(time.Minute + 30*time.Second)
+	for i := 0; i < 2; i++ {
+		if res, _ := sw.Allow(ctx, store, "k", next); !res.Allowed {
+			t.Fatalf("request %d in next window should be allowed", i)
+		}
+	}
+	if res, _ := sw.Allow(ctx, store, "k", next); res.Allowed {
+		t.Error("request over the sliding limit should be rejected")
+	}
+}
+
+func TestRateLimitKeyFunc(t *testing.T) {
+	h := rateLimited(RateLimitConfig{
+		Algorithm: TokenBucket{Limit: 1, Per: time.Hour},
+		Key:       RateLimitByBasicAuthUser,
+	})
+
+	// No basic auth => not rate limited
+	for i := 0; i < 3; i++ {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, requestFrom("10.0.0.1"))
+		if rw.Code != 200 {
+			t.Fatalf("anonymous request %d: want 200, got %d", i, rw.Code)
+		}
+		if rw.Header().Get("RateLimit-Limit") != "" {
+			t.Errorf("anonymous request shouldn't have rate limit headers")
+		}
+	}
+
+	for i, want := range []int{200, 429} {
+		req := requestFrom("10.0.0.1")
+		req.SetBasicAuth("alice", "secret")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != want {
+			t.Fatalf("request %d: want %d, got %d", i, want, rw.Code)
+		}
+	}
+}
+
+func TestRateLimitInvalidAlgorithm(t *testing.T) {
+	for _, alg := range []RateLimitAlgorithm{
+		nil,
+		TokenBucket{Limit: 10},
+		TokenBucket{Per: time.Second},
+		SlidingWindow{Limit: 10},
+		SlidingWindow{Limit: -1, Window: time.Minute},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%#v: expected panic", alg)
+				}
+			}()
+			RateLimit(RateLimitConfig{Algorithm: alg})
+		}()
+	}
+}
+
+func TestMemoryRateLimitStoreExpiry(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	ctx := context.Background()
+
+	_, _ = store.Update(ctx, "k", time.Millisecond, func(s RateLimitState) RateLimitState {
+		return RateLimitState{Value: 1}
+	})
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, _ = store.Update(ctx, "k", time.Minute, func(s RateLimitState) RateLimitState {
+		if s.Value != 0 {
+			t.Errorf("expired state should be reset, got %v", s)
+		}
+		return s
+	})
+}
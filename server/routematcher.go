@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+)
+
+// routeMatcher matches requests against a set of http.ServeMux
+// patterns (eg. `GET /users/{id}`, or `/webhooks/` for a whole
+// subtree), so that per-route middleware configuration uses the same
+// syntax, and the same precedence rules, as routing.
+type routeMatcher struct {
+	mux *http.ServeMux
+}
+
+// newRouteMatcher will panic if a pattern is invalid or conflicts
+// with another pattern, like http.ServeMux.Handle.
+func newRouteMatcher(patterns []string) *routeMatcher {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	for _, p := range patterns {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+
+	return &routeMatcher{mux: mux}
+}
+
+// match returns the most specific pattern matching r, or false if no
+// pattern matches. A nil routeMatcher matches nothing.
+func (m *routeMatcher) match(r *http.Request) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+
+	_, pattern := m.mux.Handler(r)
+	return pattern, pattern != ""
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/theplant/appkit/contexts"
+)
+
+// Router is a thin layer over http.ServeMux that adds route groups
+// with their own middleware, and named routes.
+//
+// The pattern of the route that handles a request is set with
+// contexts.SetRoute, so that LogRequest names request spans after the
+// route (eg. `GET /users/{id}`) and monitoring.WithMonitor tags
+// requests with it, instead of the raw request path.
+//
+//	r := server.NewRouter()
+//	r.HandleFunc("GET /{$}", home).Name("home")
+//
+//	admin := r.Group("/admin", requireAdmin)
+//	admin.HandleFunc("GET /users/{id}", showUser).Name("admin.user")
+//
+//	u, err := r.URL("admin.user", "id", "42") // => /admin/users/42
+type Router struct {
+	mux   *http.ServeMux
+	names *routeNames
+
+	parent     *Router
+	prefix     string
+	middleware []Middleware
+	hasRoutes  bool
+}
+
+type routeNames struct {
+	mu     sync.RWMutex
+	routes map[string]*Route
+}
+
+// NewRouter creates an empty Router.
+func NewRouter() *Router {
+	return &Router{
+		mux:   http.NewServeMux(),
+		names: &routeNames{routes: map[string]*Route{}},
+	}
+}
+
+// Use adds middleware to routes added to the router (and its groups)
+// after Use is called. As with Compose, the first middleware is the
+// innermost. Middleware of a group runs inside the middleware of its
+// parent.
+//
+// Use panics if routes have already been added to the router.
+func (rt *Router) Use(middleware ...Middleware) {
+	if rt.hasRoutes {
+		panic("appkit/server.Router.Use: middleware must be added before routes")
+	}
+	rt.middleware = append(rt.middleware, middleware...)
+}
+
+// Group creates a group of routes with a common path prefix (eg.
+// `/admin`, or "" for no prefix) and middleware, in addition to the
+// middleware of rt.
+func (rt *Router) Group(prefix string, middleware ...Middleware) *Router {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		panic(fmt.Sprintf("appkit/server.Router.Group: prefix %q must start with /", prefix))
+	}
+
+	return &Router{
+		mux:        rt.mux,
+		names:      rt.names,
+		parent:     rt,
+		prefix:     rt.prefix + prefix,
+		middleware: middleware,
+	}
+}
+
+// Handle registers h for an http.ServeMux pattern (eg. `GET
+// /users/{id}`). The pattern's path is prefixed with the group's
+// prefix. Like http.ServeMux.Handle, Handle panics if the pattern is
+// invalid, or conflicts with another route.
+func (rt *Router) Handle(pattern string, h http.Handler) *Route {
+	method, host, path := splitPattern(pattern)
+	if !strings.HasPrefix(path, "/") {
+		panic(fmt.Sprintf("appkit/server.Router.Handle: invalid pattern %q, path must start with /", pattern))
+	}
+	path = rt.prefix + path
+
+	full := host + path
+	if method != "" {
+		full = method + " " + full
+	}
+
+	for r := rt; r != nil; r = r.parent {
+		r.hasRoutes = true
+		h = Compose(r.middleware...)(h)
+	}
+
+	rt.mux.Handle(full, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contexts.SetRoute(r.Context(), r.Pattern)
+		h.ServeHTTP(w, r)
+	}))
+
+	return &Route{pattern: full, path: path, names: rt.names}
+}
+
+// HandleFunc registers f for an http.ServeMux pattern, see Handle.
+func (rt *Router) HandleFunc(pattern string, f func(http.ResponseWriter, *http.Request)) *Route {
+	return rt.Handle(pattern, http.HandlerFunc(f))
+}
+
+// ServeHTTP dispatches the request to the route that best matches
+// it, as http.ServeMux.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mux.ServeHTTP(w, r)
+}
+
+// URL builds the path of the route called name, with the route's
+// wildcards replaced by params, given as name/value pairs (eg. `"id",
+// "42"`). Values are path-escaped, except for slashes in the values
+// of `{name...}` wildcards.
+func (rt *Router) URL(name string, params ...string) (string, error) {
+	rt.names.mu.RLock()
+	route, ok := rt.names.routes[name]
+	rt.names.mu.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("no route named %q", name)
+	}
+	return route.URL(params...)
+}
+
+// Route is a route registered with a Router.
+type Route struct {
+	pattern string
+	path    string
+	names   *routeNames
+}
+
+// Pattern returns the route's full http.ServeMux pattern, including
+// the prefix of its group.
+func (r *Route) Pattern() string {
+	return r.pattern
+}
+
+// Name names the route, for building its URL with Router.URL. Panics
+// if another route has the same name.
+func (r *Route) Name(name string) *Route {
+	r.names.mu.Lock()
+	defer r.names.mu.Unlock()
+
+	if existing, ok := r.names.routes[name]; ok {
+		panic(fmt.Sprintf("appkit/server.Route.Name: %q is already the name of %q", name, existing.pattern))
+	}
+	r.names.routes[name] = r
+	return r
+}
+
+// URL builds the route's path, see Router.URL.
+func (r *Route) URL(params ...string) (string, error) {
+	if len(params)%2 != 0 {
+		return "", fmt.Errorf("route %q: params must be name/value pairs", r.pattern)
+	}
+
+	values := make(map[string]string, len(params)/2)
+	for i := 0; i < len(params); i += 2 {
+		values[params[i]] = params[i+1]
+	}
+
+	segments := strings.Split(r.path, "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			continue
+		}
+
+		wildcard := segment[1 : len(segment)-1]
+		if wildcard == "$" {
+			segments[i] = ""
+			continue
+		}
+
+		wildcard, rest := strings.CutSuffix(wildcard, "...")
+		value, ok := values[wildcard]
+		if !ok {
+			return "", fmt.Errorf("route %q: missing param %q", r.pattern, wildcard)
+		}
+		delete(values, wildcard)
+
+		if rest {
+			parts := strings.Split(value, "/")
+			for j, part := range parts {
+				parts[j] = url.PathEscape(part)
+			}
+			segments[i] = strings.Join(parts, "/")
+		} else {
+			segments[i] = url.PathEscape(value)
+		}
+	}
+
+	for name := range values {
+		return "", fmt.Errorf("route %q: unknown param %q", r.pattern, name)
+	}
+
+	return strings.Join(segments, "/"), nil
+}
+
+// splitPattern splits an http.ServeMux pattern, `[METHOD ][HOST]/[PATH]`.
+func splitPattern(pattern string) (method, host, path string) {
+	rest := strings.TrimSpace(pattern)
+	if i := strings.IndexAny(rest, " \t"); i >= 0 {
+		method, rest = rest[:i], strings.TrimLeft(rest[i:], " \t")
+	}
+
+	i := strings.Index(rest, "/")
+	if i < 0 {
+		return method, rest, ""
+	}
+	return method, rest[:i], rest[i:]
+}
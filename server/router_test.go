@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/theplant/appkit/log"
+)
+
+// header returns middleware that appends value to the X-Middleware
+// response header.
+func header(value string) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Middleware", value)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func testRouter() *Router {
+	router := NewRouter()
+	router.Use(header("root"))
+
+	write := func(s string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, s+" "+r.PathValue("id")+r.PathValue("path"))
+		}
+	}
+
+	router.HandleFunc("GET /{$}", write("home")).Name("home")
+	router.HandleFunc("GET /users/{id}", write("user")).Name("user")
+
+	admin := router.Group("/admin", header("admin"))
+	admin.Use(header("admin-outer"))
+	admin.HandleFunc("GET /users/{id}", write("admin user")).Name("admin.user")
+	admin.HandleFunc("GET /files/{path...}", write("file")).Name("admin.file")
+
+	return router
+}
+
+func TestRouter(t *testing.T) {
+	router := testRouter()
+
+	cases := []struct {
+		method, path string
+		code         int
+		body         string
+		middleware   []string
+	}{
+		{"GET", "/", 200, "home ", []string{"root"}},
+		{"GET", "/users/1", 200, "user 1", []string{"root"}},
+		{"GET", "/admin/users/2", 200, "admin user 2", []string{"root", "admin-outer", "admin"}},
+		{"GET", "/admin/files/a/b.txt", 200, "file a/b.txt", []string{"root", "admin-outer", "admin"}},
+		{"POST", "/users/1", 405, "", nil},
+		{"GET", "/missing", 404, "", nil},
+	}
+
+	for _, c := range cases {
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, httptest.NewRequest(c.method, c.path, nil))
+
+		if rw.Code != c.code {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.path, c.code, rw.Code)
+			continue
+		}
+		if c.code != 200 {
+			continue
+		}
+		if rw.Body.String() != c.body {
+			t.Errorf("%s %s: expected body %q, got %q", c.method, c.path, c.body, rw.Body.String())
+		}
+		if got := strings.Join(rw.Header()["X-Middleware"], ","); got != strings.Join(c.middleware, ",") {
+			t.Errorf("%s %s: expected middleware %v, got %v", c.method, c.path, c.middleware, got)
+		}
+	}
+}
+
+func TestRouter_URL(t *testing.T) {
+	router := testRouter()
+
+	cases := []struct {
+		name     string
+		params   []string
+		expected string
+		err      bool
+	}{
+		{"home", nil, "/", false},
+		{"user", []string{"id", "42"}, "/users/42", false},
+		{"admin.user", []string{"id", "a b/c"}, "/admin/users/a%20b%2Fc", false},
+		{"admin.file", []string{"path", "docs/a b.txt"}, "/admin/files/docs/a%20b.txt", false},
+		{"user", nil, "", true},
+		{"user", []string{"id"}, "", true},
+		{"user", []string{"id", "1", "other", "2"}, "", true},
+		{"missing", nil, "", true},
+	}
+
+	for _, c := range cases {
+		u, err := router.URL(c.name, c.params...)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s %v: expected error, got %q", c.name, c.params, u)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s %v: %v", c.name, c.params, err)
+		} else if u != c.expected {
+			t.Errorf("%s %v: expected %q, got %q", c.name, c.params, c.expected, u)
+		}
+	}
+}
+
+func TestRouter_Panics(t *testing.T) {
+	expectPanic := func(name string, f func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s: expected panic", name)
+			}
+		}()
+		f()
+	}
+
+	expectPanic("Use after routes", func() {
+		testRouter().Use(header("late"))
+	})
+	expectPanic("duplicate name", func() {
+		testRouter().HandleFunc("GET /other", nil).Name("home")
+	})
+	expectPanic("conflicting route", func() {
+		testRouter().Group("/admin").HandleFunc("GET /users/{name}", nil)
+	})
+	expectPanic("invalid prefix", func() {
+		testRouter().Group("admin")
+	})
+}
+
+func TestRouter_LogRequestSpanName(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.Logger{Logger: kitlog.NewLogfmtLogger(buf)}
+
+	h := Compose(LogRequest, log.WithLogger(logger))(testRouter())
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin/users/42", nil))
+
+	out := buf.String()
+	if !strings.Contains(out, `span.context="GET /admin/users/{id}"`) {
+		t.Errorf("expected span named after route, got %s", out)
+	}
+	if !strings.Contains(out, `http.route="GET /admin/users/{id}"`) {
+		t.Errorf("expected http.route, got %s", out)
+	}
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -8,6 +10,7 @@ import (
 
 	"github.com/rs/cors"
 	"github.com/theplant/appkit/log"
+	"github.com/theplant/appkit/logtracing"
 )
 
 // CrossSiteConfig is configuration for cross-site request protection:
@@ -18,6 +21,10 @@ type CrossSiteConfig struct {
 	// `https://` prefix) that are allowed to make requests to the
 	// server. Used to reject requests for CSRF, and to control
 	// browser behaviour with CORS (deny access to response body).
+	//
+	// Wildcard subdomains (`https://*.preview.example.com`) and
+	// regular expressions (`regexp:https://pr-[0-9]+\.example\.com`)
+	// are also allowed, see OriginMatcher.
 	RawAllowedOrigins string `required:"true"`
 
 	// AllowCredentials configures whether CORS requests are allowed to send "credentials":
@@ -46,6 +53,18 @@ type CrossSiteConfig struct {
 	//    browser will proceed with the real request.
 	//
 	CSRFRequiredHeader string `required:"true" default:"X-Csrf"`
+
+	// VerifySafeMethods applies the CSRF checks to requests with safe
+	// methods (`GET`, `HEAD`, `OPTIONS` and `TRACE`) too. By default,
+	// only requests with unsafe methods are checked, as requests with
+	// safe methods shouldn't change anything.
+	VerifySafeMethods bool
+
+	// RawExemptPaths is comma-separated list of http.ServeMux
+	// patterns (eg. `/webhooks/` for all paths under `/webhooks/`, or
+	// `POST /callbacks/{provider}`) of routes that are exempt from the
+	// CSRF checks, such as webhooks called by third parties.
+	RawExemptPaths string
 }
 
 // SecureMiddleware is middleware to (currently) enforce CORS and CSRF
@@ -59,6 +78,14 @@ type CrossSiteConfig struct {
 // > 1. Check standard headers to verify the request is same origin
 // > 2. AND Check CSRF token
 //
+// Requests that fail the CSRF checks are rejected with `400 Bad
+// Request` and a JSON body with a reason code:
+//
+//	{"error":{"code":"origin_not_allowed","message":"..."}}
+//
+// The reason code is also recorded on the request's logtracing span
+// as `csrf.reject_reason`.
+//
 // [1]: https://www.owasp.org/index.php/Cross-Site_Request_Forgery_(CSRF)_Prevention_Cheat_Sheet
 func SecureMiddleware(logger log.Logger, cs CrossSiteConfig) Middleware {
 	logger = logger.With("context", "appkit/server.SecureMiddleware")
@@ -68,17 +95,83 @@ func SecureMiddleware(logger log.Logger, cs CrossSiteConfig) Middleware {
 		allowedOrigins[i] = strings.TrimSpace(allowedOrigin)
 	}
 
+	origins, err := NewOriginMatcher(allowedOrigins)
+	if err != nil {
+		panic(fmt.Sprintf("appkit/server.SecureMiddleware: %v", err))
+	}
+
+	var exemptPaths []string
+	for _, p := range strings.Split(cs.RawExemptPaths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			exemptPaths = append(exemptPaths, p)
+		}
+	}
+
 	return Compose(
 		verifyHeader(logger, cs.CSRFRequiredHeader),
-		verifyOrigin(allowedOrigins, logger),
-		corsPolicy(allowedOrigins, cs, logger),
+		verifyOrigin(allowedOrigins, origins, logger),
+		csrfExemptions(cs.VerifySafeMethods, exemptPaths, logger),
+		corsPolicy(allowedOrigins, origins, cs, logger),
 	)
 }
 
+// CSRF rejection reason codes
+const (
+	csrfMissingHeader    = "missing_csrf_header"
+	csrfMissingOrigin    = "missing_origin"
+	csrfOriginNotAllowed = "origin_not_allowed"
+)
+
+type crossSiteError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
 // failCrossSiteRequest is a simple helper to fail the request in a
 // consistent manner.
-func failCrossSiteRequest(w http.ResponseWriter) {
-	http.Error(w, http.StatusText(400), 400)
+func failCrossSiteRequest(w http.ResponseWriter, req *http.Request, code, message string) {
+	logtracing.AppendSpanKVs(req.Context(), "csrf.reject_reason", code)
+
+	var body crossSiteError
+	body.Error.Code = code
+	body.Error.Message = message
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// csrfExemptions marks requests that are exempt from the CSRF checks
+// (by method or path), so that verifyHeader and verifyOrigin pass
+// them through.
+func csrfExemptions(verifySafeMethods bool, exemptPaths []string, l log.Logger) Middleware {
+	exempt := newRouteMatcher(exemptPaths)
+
+	l.Info().Log(
+		"msg", fmt.Sprintf("CSRF checks exempt paths: %v, verify safe methods: %v", exemptPaths, verifySafeMethods),
+		"during", "appkit/server.csrfExemptions",
+		"exempt_paths", strings.Join(exemptPaths, ","),
+		"verify_safe_methods", verifySafeMethods,
+	)
+
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			_, exemptPath := exempt.match(req)
+			if exemptPath || (!verifySafeMethods && isSafeMethod(req.Method)) {
+				req = req.WithContext(context.WithValue(req.Context(), csrfExemptKey, true))
+			}
+
+			handler.ServeHTTP(res, req)
+		})
+	}
+}
+
+func isCSRFExempt(req *http.Request) bool {
+	exempt, _ := req.Context().Value(csrfExemptKey).(bool)
+	return exempt
 }
 
 // verifyHeader ensures that the request contains a header with the
@@ -98,7 +191,7 @@ func verifyHeader(l log.Logger, csrfHeader string) Middleware {
 	if csrfHeader == "" {
 		// Info (not Warn) because this can be set to "" for
 		// non-API-based apps (ie. ones that render HTML forms by
-		// themselves)
+		// themselves, which should use CSRFProtect instead)
 		l.Info().Log("msg", "no CSRF header set, disabling header verification")
 		return IdMiddleware
 	}
@@ -111,6 +204,11 @@ func verifyHeader(l log.Logger, csrfHeader string) Middleware {
 
 	return func(handler http.Handler) http.Handler {
 		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if isCSRFExempt(req) {
+				handler.ServeHTTP(res, req)
+				return
+			}
+
 			_, ok := req.Header[csrfHeader]
 			if !ok {
 				log.ForceContext(req.Context()).
@@ -118,9 +216,10 @@ func verifyHeader(l log.Logger, csrfHeader string) Middleware {
 					Log(
 						"msg", "Request missing csrf header",
 						"during", "appkit/server.verifyHeader",
+						"client_ip", clientIP(req),
 					)
 
-				failCrossSiteRequest(res)
+				failCrossSiteRequest(res, req, csrfMissingHeader, fmt.Sprintf("request missing %s header", csrfHeader))
 				return
 			}
 
@@ -133,7 +232,10 @@ func verifyHeader(l log.Logger, csrfHeader string) Middleware {
 // list of allowed origins. This is mitigation against CSRF "confused
 // deputy" attacks where a browser that is "authorised" on our site is
 // tricked by another site into making requests.
-func verifyOrigin(allowed []string, l log.Logger) Middleware {
+//
+// Requests from browsers that send `Sec-Fetch-Site: same-origin` are
+// same-origin requests, and are allowed without checking the origin.
+func verifyOrigin(allowed []string, origins *OriginMatcher, l log.Logger) Middleware {
 	l = l.With("during", "appkit/server.verifyOrigin")
 
 	if len(allowed) == 0 {
@@ -148,6 +250,12 @@ func verifyOrigin(allowed []string, l log.Logger) Middleware {
 
 	return func(handler http.Handler) http.Handler {
 		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			// Browsers don't let JS set Sec-Fetch-* headers
+			if isCSRFExempt(req) || req.Header.Get("Sec-Fetch-Site") == "same-origin" {
+				handler.ServeHTTP(res, req)
+				return
+			}
+
 			origin, ok := req.Header["Origin"]
 			referrer := req.Header["Referer"]
 
@@ -174,12 +282,10 @@ func verifyOrigin(allowed []string, l log.Logger) Middleware {
 				logger.Warn().Log("msg", "No origin or referrer for request")
 			}
 
-			for _, a := range allowed {
-				for _, o := range origin {
-					if a == o {
-						handler.ServeHTTP(res, req)
-						return
-					}
+			for _, o := range origin {
+				if origins.Match(o) {
+					handler.ServeHTTP(res, req)
+					return
 				}
 			}
 
@@ -187,16 +293,21 @@ func verifyOrigin(allowed []string, l log.Logger) Middleware {
 				"allowed_origins", strings.Join(allowed, ","),
 				"origin", strings.Join(origin, ","),
 				"referrer", strings.Join(referrer, ","),
+				"client_ip", clientIP(req),
 			)
 
-			failCrossSiteRequest(res)
+			if len(origin) == 0 {
+				failCrossSiteRequest(res, req, csrfMissingOrigin, "request has no origin or referrer")
+				return
+			}
+			failCrossSiteRequest(res, req, csrfOriginNotAllowed, "request origin/referrer is not allowed")
 		})
 	}
 }
 
 // corsPolicy will use github.com/rs/cors to define a CORS policy for
 // the system, based on the CrossSiteConfig
-func corsPolicy(allowedOrigins []string, cs CrossSiteConfig, l log.Logger) Middleware {
+func corsPolicy(allowedOrigins []string, origins *OriginMatcher, cs CrossSiteConfig, l log.Logger) Middleware {
 	l.Info().Log(
 		"msg", fmt.Sprintf("CORS: allowed at origins: %v, allowed with credentials: %v, allowed CSRF header %v", allowedOrigins, cs.AllowCredentials, cs.CSRFRequiredHeader),
 		"during", "appkit/server.corsPolicy",
@@ -205,11 +316,17 @@ func corsPolicy(allowedOrigins []string, cs CrossSiteConfig, l log.Logger) Middl
 		"allowed_headers", cs.CSRFRequiredHeader,
 	)
 
-	c := cors.New(cors.Options{
-		AllowedOrigins:   allowedOrigins,
+	if origins.AllowsAll() && cs.AllowCredentials {
+		l.Warn().Log(
+			"msg", "CORS: browsers refuse credentialed requests when any origin (*) is allowed",
+			"during", "appkit/server.corsPolicy",
+		)
+	}
+
+	c := cors.New(origins.CORSOptions(cors.Options{
 		AllowCredentials: cs.AllowCredentials,
 		AllowedHeaders:   []string{cs.CSRFRequiredHeader},
-	})
+	}))
 
 	return c.Handler
 }
@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 
@@ -56,7 +57,7 @@ func ExampleCrossSiteConfig_csrfHeaderMissing() {
 
 	exec(s, req)
 
-	// Output: level=warn msg="Request missing csrf header" during=appkit/server.verifyHeader
+	// Output: level=warn msg="Request missing csrf header" during=appkit/server.verifyHeader client_ip=127.0.0.1
 	// 400
 }
 
@@ -169,7 +170,7 @@ func ExampleCrossSiteConfig_originMissingOriginAndReferrer() {
 
 	// Output: level=warn during=appkit/server.verifyOrigin msg="No origin header, falling back to referrer" referrer=
 	// level=warn during=appkit/server.verifyOrigin msg="No origin or referrer for request"
-	// level=error during=appkit/server.verifyOrigin msg="CSRF failure: origin/referrer does not match target origin" allowed_origins=http://example.com,http://2.example.com origin= referrer=
+	// level=error during=appkit/server.verifyOrigin msg="CSRF failure: origin/referrer does not match target origin" allowed_origins=http://example.com,http://2.example.com origin= referrer= client_ip=127.0.0.1
 	// 400
 }
 
@@ -186,7 +187,7 @@ func ExampleCrossSiteConfig_originInvalidReferrerFallback() {
 
 	// Output: level=warn during=appkit/server.verifyOrigin msg="No origin header, falling back to referrer" referrer="not a valid referer url"
 	// level=warn during=appkit/server.verifyOrigin msg="No origin or referrer for request"
-	// level=error during=appkit/server.verifyOrigin msg="CSRF failure: origin/referrer does not match target origin" allowed_origins=http://example.com origin= referrer="not a valid referer url"
+	// level=error during=appkit/server.verifyOrigin msg="CSRF failure: origin/referrer does not match target origin" allowed_origins=http://example.com origin= referrer="not a valid referer url" client_ip=127.0.0.1
 	// 400
 }
 
@@ -202,7 +203,122 @@ func ExampleCrossSiteConfig_originOverlappingReferrerFallback() {
 	exec(s, req)
 
 	// Output: level=warn during=appkit/server.verifyOrigin msg="No origin header, falling back to referrer" referrer=http://example.com.evil.com/path
-	// level=error during=appkit/server.verifyOrigin msg="CSRF failure: origin/referrer does not match target origin" allowed_origins=http://example.com origin=http://example.com.evil.com referrer=http://example.com.evil.com/path
+	// level=error during=appkit/server.verifyOrigin msg="CSRF failure: origin/referrer does not match target origin" allowed_origins=http://example.com origin=http://example.com.evil.com referrer=http://example.com.evil.com/path client_ip=127.0.0.1
+	// 400
+}
+
+func ExampleCrossSiteConfig_originWildcard() {
+	cfg := CrossSiteConfig{
+		RawAllowedOrigins: "https://*.preview.example.com",
+	}
+
+	s, req := setup(cfg)
+
+	req.Header.Set("origin", "https://pr-123.preview.example.com")
+
+	exec(s, req)
+
+	req.Header.Set("origin", "https://preview.example.com.evil.com")
+
+	exec(s, req)
+
+	// Output: executed handler
+	// 200
+	// level=error during=appkit/server.verifyOrigin msg="CSRF failure: origin/referrer does not match target origin" allowed_origins=https://*.preview.example.com origin=https://preview.example.com.evil.com referrer= client_ip=127.0.0.1
+	// 400
+}
+
+func ExampleCrossSiteConfig_originRegexp() {
+	cfg := CrossSiteConfig{
+		RawAllowedOrigins: `http://example.com,regexp:https://pr-[0-9]+\.example\.com`,
+	}
+
+	s, req := setup(cfg)
+
+	req.Header.Set("origin", "https://pr-42.example.com")
+
+	exec(s, req)
+
+	// Output: executed handler
+	// 200
+}
+
+func ExampleCrossSiteConfig_originSecFetchSite() {
+	cfg := CrossSiteConfig{
+		RawAllowedOrigins: "http://example.com",
+	}
+
+	s, req := setup(cfg)
+
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+
+	exec(s, req)
+
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	req.Header.Set("origin", "http://evil.com")
+
+	exec(s, req)
+
+	// Output: executed handler
+	// 200
+	// level=error during=appkit/server.verifyOrigin msg="CSRF failure: origin/referrer does not match target origin" allowed_origins=http://example.com origin=http://evil.com referrer= client_ip=127.0.0.1
+	// 400
+}
+
+func ExampleCrossSiteConfig_corsWildcard() {
+	cfg := CrossSiteConfig{
+		RawAllowedOrigins: "https://*.preview.example.com",
+	}
+
+	s, req := setup(cfg)
+
+	req.Method = "OPTIONS"
+
+	req.Header.Add("Access-Control-Request-Method", "POST")
+	req.Header.Add("origin", "https://pr-123.preview.example.com")
+
+	printCORSHeaders(exec(s, req))
+
+	// Output: 200
+	// Vary: [Origin Access-Control-Request-Method Access-Control-Request-Headers]
+	// Access-Control-Allow-Origin: [https://pr-123.preview.example.com]
+	// Access-Control-Allow-Methods: [POST]
+	// Access-Control-Allow-Headers: []
+	// Access-Control-Allow-Credentials: []
+	// Access-Control-Max_age: []
+}
+
+func ExampleCrossSiteConfig_corsAnyOriginWithCredentials() {
+	cfg := CrossSiteConfig{
+		RawAllowedOrigins: "*",
+		AllowCredentials:  true,
+	}
+
+	s, req := setup(cfg)
+
+	req.Method = "OPTIONS"
+
+	req.Header.Add("Access-Control-Request-Method", "POST")
+	req.Header.Add("origin", "https://evil.com")
+
+	// the origin isn't reflected, so browsers refuse credentialed
+	// requests
+	printCORSHeaders(exec(s, req))
+
+	// ...and `*` doesn't pass the CSRF origin check
+	req.Method = "POST"
+	req.Header.Del("Access-Control-Request-Method")
+	req.Header.Add("X-Csrf", "1")
+	exec(s, req)
+
+	// Output: 200
+	// Vary: [Origin Access-Control-Request-Method Access-Control-Request-Headers]
+	// Access-Control-Allow-Origin: [*]
+	// Access-Control-Allow-Methods: [POST]
+	// Access-Control-Allow-Headers: []
+	// Access-Control-Allow-Credentials: [true]
+	// Access-Control-Max_age: []
+	// level=error during=appkit/server.verifyOrigin msg="CSRF failure: origin/referrer does not match target origin" allowed_origins=* origin=https://evil.com referrer= client_ip=127.0.0.1
 	// 400
 }
 
@@ -340,6 +456,97 @@ func ExampleCrossSiteConfig_corsCsrfHeaderRequest() {
 	// Access-Control-Max_age: []
 }
 
+//////////////////////////////////////////////////
+// Exemptions and errors
+
+func ExampleCrossSiteConfig_safeMethod() {
+	cfg := CrossSiteConfig{
+		RawAllowedOrigins:  "http://example.com",
+		CSRFRequiredHeader: "X-Csrf",
+	}
+
+	s, req := setup(cfg)
+
+	req.Method = "GET"
+
+	exec(s, req)
+
+	// Output: executed handler
+	// 200
+}
+
+func ExampleCrossSiteConfig_verifySafeMethods() {
+	cfg := CrossSiteConfig{
+		RawAllowedOrigins:  "http://example.com",
+		CSRFRequiredHeader: "X-Csrf",
+		VerifySafeMethods:  true,
+	}
+
+	s, req := setup(cfg)
+
+	req.Method = "GET"
+	req.Header.Add("origin", "http://example.com")
+
+	exec(s, req)
+
+	// Output: level=warn msg="Request missing csrf header" during=appkit/server.verifyHeader client_ip=127.0.0.1
+	// 400
+}
+
+func ExampleCrossSiteConfig_exemptPaths() {
+	cfg := CrossSiteConfig{
+		RawAllowedOrigins:  "http://example.com",
+		CSRFRequiredHeader: "X-Csrf",
+		RawExemptPaths:     "/webhooks/, POST /callbacks/{provider}",
+	}
+
+	s, req := setup(cfg)
+
+	req.URL.Path = "/webhooks/github"
+
+	exec(s, req)
+
+	req.URL.Path = "/callbacks/stripe"
+
+	exec(s, req)
+
+	req.URL.Path = "/other"
+	req.Header.Set("X-Csrf", ".")
+
+	exec(s, req)
+
+	// Output: executed handler
+	// 200
+	// executed handler
+	// 200
+	// level=warn during=appkit/server.verifyOrigin msg="No origin header, falling back to referrer" referrer=
+	// level=warn during=appkit/server.verifyOrigin msg="No origin or referrer for request"
+	// level=error during=appkit/server.verifyOrigin msg="CSRF failure: origin/referrer does not match target origin" allowed_origins=http://example.com origin= referrer= client_ip=127.0.0.1
+	// 400
+}
+
+func ExampleCrossSiteConfig_errorResponse() {
+	cfg := CrossSiteConfig{
+		RawAllowedOrigins: "http://example.com",
+	}
+
+	s, req := setup(cfg)
+
+	req.Header.Add("origin", "http://evil.com")
+
+	resp := exec(s, req)
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Println(resp.Header.Get("Content-Type"))
+	fmt.Print(string(body))
+
+	// Output: level=error during=appkit/server.verifyOrigin msg="CSRF failure: origin/referrer does not match target origin" allowed_origins=http://example.com origin=http://evil.com referrer= client_ip=127.0.0.1
+	// 400
+	// application/json; charset=utf-8
+	// {"error":{"code":"origin_not_allowed","message":"request origin/referrer is not allowed"}}
+}
+
 func testHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("executed handler")
 }
@@ -0,0 +1,433 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/theplant/appkit/log"
+)
+
+// CSP source expressions that must be quoted in a
+// Content-Security-Policy.
+const (
+	CSPSelf           = "'self'"
+	CSPNone           = "'none'"
+	CSPUnsafeInline   = "'unsafe-inline'"
+	CSPUnsafeEval     = "'unsafe-eval'"
+	CSPStrictDynamic  = "'strict-dynamic'"
+	CSPReportSample   = "'report-sample'"
+	CSPWasmUnsafeEval = "'wasm-unsafe-eval'"
+)
+
+// CSP is a Content-Security-Policy. Each field is a directive, with a
+// list of sources (eg. `CSPSelf`, `https://cdn.example.com`,
+// `data:`). Directives without sources are left out of the policy.
+type CSP struct {
+	DefaultSrc     []string
+	ScriptSrc      []string
+	StyleSrc       []string
+	ImgSrc         []string
+	ConnectSrc     []string
+	FontSrc        []string
+	ObjectSrc      []string
+	MediaSrc       []string
+	FrameSrc       []string
+	WorkerSrc      []string
+	ManifestSrc    []string
+	FrameAncestors []string
+	BaseURI        []string
+	FormAction     []string
+
+	// Directives are any other directives, keyed by directive name
+	// (eg. `sandbox` or `require-trusted-types-for`).
+	Directives map[string][]string
+
+	// ScriptNonce and StyleNonce add a per-request nonce to
+	// `script-src` and `style-src`. Get the nonce for a request with
+	// CSPNonce, to use in `<script nonce="...">` tags.
+	ScriptNonce bool
+	StyleNonce  bool
+
+	UpgradeInsecureRequests bool
+
+	// ReportURI is the URL that browsers send violation reports to
+	// (eg. the path CSPReportHandler is mounted on).
+	ReportURI string
+
+	// ReportTo is the name of a `Reporting-Endpoints` endpoint that
+	// browsers send violation reports to.
+	ReportTo string
+
+	// ReportOnly sends the policy in a
+	// `Content-Security-Policy-Report-Only` header, so that violations
+	// are reported but not blocked. Use this to try out a policy.
+	ReportOnly bool
+}
+
+func (c *CSP) usesNonce() bool {
+	return c.ScriptNonce || c.StyleNonce
+}
+
+// HeaderName returns the name of the header the policy is sent in.
+func (c *CSP) HeaderName() string {
+	if c.ReportOnly {
+		return "Content-Security-Policy-Report-Only"
+	}
+	return "Content-Security-Policy"
+}
+
+// String returns the policy with the given nonce (which is ignored
+// unless ScriptNonce or StyleNonce is set).
+func (c *CSP) String(nonce string) string {
+	var directives []string
+	add := func(name string, sources []string, withNonce bool) {
+		if withNonce && nonce != "" {
+			sources = append(sources[:len(sources):len(sources)], "'nonce-"+nonce+"'")
+		}
+		if len(sources) == 0 {
+			return
+		}
+		directives = append(directives, name+" "+strings.Join(sources, " "))
+	}
+
+	add("default-src", c.DefaultSrc, false)
+	add("script-src", c.ScriptSrc, c.ScriptNonce)
+	add("style-src", c.StyleSrc, c.StyleNonce)
+	add("img-src", c.ImgSrc, false)
+	add("connect-src", c.ConnectSrc, false)
+	add("font-src", c.FontSrc, false)
+	add("object-src", c.ObjectSrc, false)
+	add("media-src", c.MediaSrc, false)
+	add("frame-src", c.FrameSrc, false)
+	add("worker-src", c.WorkerSrc, false)
+	add("manifest-src", c.ManifestSrc, false)
+	add("frame-ancestors", c.FrameAncestors, false)
+	add("base-uri", c.BaseURI, false)
+	add("form-action", c.FormAction, false)
+
+	var names []string
+	for name := range c.Directives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if sources := c.Directives[name]; len(sources) == 0 {
+			// Directives such as `sandbox` don't need sources
+			directives = append(directives, name)
+		} else {
+			add(name, sources, false)
+		}
+	}
+
+	if c.UpgradeInsecureRequests {
+		directives = append(directives, "upgrade-insecure-requests")
+	}
+	if c.ReportURI != "" {
+		directives = append(directives, "report-uri "+c.ReportURI)
+	}
+	if c.ReportTo != "" {
+		directives = append(directives, "report-to "+c.ReportTo)
+	}
+
+	return strings.Join(directives, "; ")
+}
+
+// SecurityHeadersConfig is configuration for the SecurityHeaders
+// middleware. Headers for blank fields are not sent.
+type SecurityHeadersConfig struct {
+	// CSP is the Content-Security-Policy.
+	CSP *CSP
+
+	// ReferrerPolicy, eg. `strict-origin-when-cross-origin`.
+	ReferrerPolicy string
+
+	// PermissionsPolicy is keyed by feature (eg. `camera`), with the
+	// allowlist of origins for the feature: `self`, `*`, or origins
+	// such as `https://example.com`. An empty allowlist disables the
+	// feature.
+	PermissionsPolicy map[string][]string
+
+	// NoSniff sends `X-Content-Type-Options: nosniff`.
+	NoSniff bool
+
+	// FrameOptions is the `X-Frame-Options` header (`DENY` or
+	// `SAMEORIGIN`). Prefer CSP.FrameAncestors for new browsers.
+	FrameOptions string
+
+	// CrossOriginOpenerPolicy, eg. `same-origin`.
+	CrossOriginOpenerPolicy string
+
+	// CrossOriginEmbedderPolicy, eg. `require-corp`.
+	CrossOriginEmbedderPolicy string
+
+	// CrossOriginResourcePolicy, eg. `same-origin`.
+	CrossOriginResourcePolicy string
+
+	// HSTSMaxAge is the `max-age` of the Strict-Transport-Security
+	// header. Zero means no HSTS header.
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubDomains bool
+
+	// HSTSPreload adds the `preload` directive, for inclusion in
+	// browsers' HSTS preload lists. This requires a HSTSMaxAge of at
+	// least a year and HSTSIncludeSubDomains.
+	HSTSPreload bool
+}
+
+// hstsPreloadMinMaxAge is the minimum max-age accepted by
+// https://hstspreload.org
+const hstsPreloadMinMaxAge = 365 * 24 * time.Hour
+
+// SecurityHeaders is middleware that adds security-related headers to
+// responses. Headers are set (not added), so that using the
+// middleware more than once, or together with handlers that set the
+// same headers, doesn't send duplicate headers.
+//
+// If CSP.ScriptNonce or CSP.StyleNonce is set, every request gets a
+// fresh nonce, available to handlers via CSPNonce.
+//
+// SecurityHeaders will panic if HSTSPreload is set without the
+// HSTSMaxAge and HSTSIncludeSubDomains it requires.
+func SecurityHeaders(cfg SecurityHeadersConfig) Middleware {
+	if cfg.HSTSPreload && (cfg.HSTSMaxAge < hstsPreloadMinMaxAge || !cfg.HSTSIncludeSubDomains) {
+		panic("appkit/server.SecurityHeaders: HSTS preload requires a max-age of at least a year and includeSubDomains")
+	}
+
+	static := http.Header{}
+	set := func(name, value string) {
+		if value != "" {
+			static.Set(name, value)
+		}
+	}
+
+	set("Referrer-Policy", cfg.ReferrerPolicy)
+	set("Permissions-Policy", permissionsPolicy(cfg.PermissionsPolicy))
+	if cfg.NoSniff {
+		set("X-Content-Type-Options", "nosniff")
+	}
+	set("X-Frame-Options", cfg.FrameOptions)
+	set("Cross-Origin-Opener-Policy", cfg.CrossOriginOpenerPolicy)
+	set("Cross-Origin-Embedder-Policy", cfg.CrossOriginEmbedderPolicy)
+	set("Cross-Origin-Resource-Policy", cfg.CrossOriginResourcePolicy)
+
+	if cfg.HSTSMaxAge > 0 {
+		hsts := "max-age=" + strconv.Itoa(int(cfg.HSTSMaxAge.Seconds()))
+		if cfg.HSTSIncludeSubDomains {
+			hsts += "; includeSubDomains"
+		}
+		if cfg.HSTSPreload {
+			hsts += "; preload"
+		}
+		set("Strict-Transport-Security", hsts)
+	}
+
+	csp := cfg.CSP
+	if csp != nil && !csp.usesNonce() {
+		set(csp.HeaderName(), csp.String(""))
+		csp = nil
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := w.Header()
+			for name, values := range static {
+				header[name] = append([]string(nil), values...)
+			}
+
+			if csp != nil {
+				nonce := newCSPNonce()
+				header.Set(csp.HeaderName(), csp.String(nonce))
+				r = r.WithContext(context.WithValue(r.Context(), cspNonceKey, nonce))
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CSPNonce returns the Content-Security-Policy nonce of the request,
+// set by SecurityHeaders when CSP.ScriptNonce or CSP.StyleNonce is
+// set.
+func CSPNonce(ctx context.Context) (string, bool) {
+	nonce, ok := ctx.Value(cspNonceKey).(string)
+	return nonce, ok
+}
+
+func newCSPNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("appkit/server.SecurityHeaders: error generating CSP nonce: %v", err))
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func permissionsPolicy(policy map[string][]string) string {
+	var features []string
+	for feature := range policy {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+
+	var directives []string
+	for _, feature := range features {
+		directives = append(directives, feature+"="+permissionsAllowlist(policy[feature]))
+	}
+
+	return strings.Join(directives, ", ")
+}
+
+func permissionsAllowlist(origins []string) string {
+	var allowlist []string
+	for _, origin := range origins {
+		switch origin {
+		case "*":
+			return "*"
+		case "self", "src":
+			allowlist = append(allowlist, origin)
+		default:
+			allowlist = append(allowlist, strconv.Quote(origin))
+		}
+	}
+	return "(" + strings.Join(allowlist, " ") + ")"
+}
+
+////////////////////////////////////////////////////////////
+// Violation reports
+
+// maxCSPReportSize is the maximum size of a CSP violation report
+// request body.
+const maxCSPReportSize = 64 << 10
+
+// cspViolation is the subset of a violation report that gets logged.
+// Field names are those of the Reporting API `csp-violation` body;
+// the legacy `report-uri` format is mapped onto them.
+type cspViolation struct {
+	DocumentURL        string `json:"documentURL"`
+	BlockedURL         string `json:"blockedURL"`
+	EffectiveDirective string `json:"effectiveDirective"`
+	Disposition        string `json:"disposition"`
+	SourceFile         string `json:"sourceFile"`
+	LineNumber         int    `json:"lineNumber"`
+	Sample             string `json:"sample"`
+}
+
+type legacyCSPReport struct {
+	Report struct {
+		DocumentURI        string `json:"document-uri"`
+		BlockedURI         string `json:"blocked-uri"`
+		EffectiveDirective string `json:"effective-directive"`
+		ViolatedDirective  string `json:"violated-directive"`
+		Disposition        string `json:"disposition"`
+		SourceFile         string `json:"source-file"`
+		LineNumber         int    `json:"line-number"`
+		ScriptSample       string `json:"script-sample"`
+	} `json:"csp-report"`
+}
+
+type reportingAPIReport struct {
+	Type string       `json:"type"`
+	Body cspViolation `json:"body"`
+}
+
+// CSPReportHandler is a handler for Content-Security-Policy violation
+// reports (use its path as CSP.ReportURI, or as a
+// `Reporting-Endpoints` endpoint for CSP.ReportTo). It accepts both
+// legacy `application/csp-report` reports and Reporting API
+// `application/reports+json` reports, and logs each violation as a
+// warning.
+func CSPReportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		logger := log.ForceContext(r.Context())
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCSPReportSize))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		violations, err := parseCSPReports(r.Header.Get("Content-Type"), body)
+		if err != nil {
+			logger.Debug().Log(
+				"msg", fmt.Sprintf("invalid CSP report: %v", err),
+				"during", "appkit/server.CSPReportHandler",
+				"err", err,
+			)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		for _, v := range violations {
+			logger.Warn().Log(
+				"msg", fmt.Sprintf("CSP violation: %s blocked by %s", v.BlockedURL, v.EffectiveDirective),
+				"during", "appkit/server.CSPReportHandler",
+				"document_url", v.DocumentURL,
+				"blocked_url", v.BlockedURL,
+				"effective_directive", v.EffectiveDirective,
+				"disposition", v.Disposition,
+				"source_file", v.SourceFile,
+				"line_number", v.LineNumber,
+				"sample", v.Sample,
+				"user_agent", r.UserAgent(),
+			)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func parseCSPReports(contentType string, body []byte) ([]cspViolation, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	if mediaType == "application/reports+json" {
+		var reports []reportingAPIReport
+		if err := json.Unmarshal(body, &reports); err != nil {
+			return nil, err
+		}
+
+		var violations []cspViolation
+		for _, report := range reports {
+			if report.Type == "csp-violation" {
+				violations = append(violations, report.Body)
+			}
+		}
+		return violations, nil
+	}
+
+	// Browsers send legacy reports as `application/csp-report`, but
+	// accept any content type, as some send `application/json`.
+	var report legacyCSPReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+
+	directive := report.Report.EffectiveDirective
+	if directive == "" {
+		directive = report.Report.ViolatedDirective
+	}
+
+	return []cspViolation{{
+		DocumentURL:        report.Report.DocumentURI,
+		BlockedURL:         report.Report.BlockedURI,
+		EffectiveDirective: directive,
+		Disposition:        report.Report.Disposition,
+		SourceFile:         report.Report.SourceFile,
+		LineNumber:         report.Report.LineNumber,
+		Sample:             report.Report.ScriptSample,
+	}}, nil
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/theplant/appkit/log"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	cfg := SecurityHeadersConfig{
+		CSP: &CSP{
+			DefaultSrc:              []string{CSPSelf},
+			ImgSrc:                  []string{CSPSelf, "data:"},
+			ObjectSrc:               []string{CSPNone},
+			FrameAncestors:          []string{CSPNone},
+			Directives:              map[string][]string{"sandbox": nil},
+			UpgradeInsecureRequests: true,
+			ReportURI:               "/csp-reports",
+		},
+		ReferrerPolicy: "strict-origin-when-cross-origin",
+		PermissionsPolicy: map[string][]string{
+			"geolocation": {"self", "https://maps.example.com"},
+			"camera":      {},
+			"fullscreen":  {"*"},
+		},
+		NoSniff:                   true,
+		CrossOriginOpenerPolicy:   "same-origin",
+		CrossOriginEmbedderPolicy: "require-corp",
+		CrossOriginResourcePolicy: "same-site",
+		HSTSMaxAge:                2 * 365 * 24 * time.Hour,
+		HSTSIncludeSubDomains:     true,
+		HSTSPreload:               true,
+	}
+
+	h := Compose(SecurityHeaders(cfg), SecurityHeaders(cfg))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+
+	expected := map[string]string{
+		"Content-Security-Policy":      "default-src 'self'; img-src 'self' data:; object-src 'none'; frame-ancestors 'none'; sandbox; upgrade-insecure-requests; report-uri /csp-reports",
+		"Referrer-Policy":              "strict-origin-when-cross-origin",
+		"Permissions-Policy":           `camera=(), fullscreen=*, geolocation=(self "https://maps.example.com")`,
+		"X-Content-Type-Options":       "nosniff",
+		"Cross-Origin-Opener-Policy":   "same-origin",
+		"Cross-Origin-Embedder-Policy": "require-corp",
+		"Cross-Origin-Resource-Policy": "same-site",
+		"Strict-Transport-Security":    "max-age=63072000; includeSubDomains; preload",
+	}
+
+	for name, want := range expected {
+		// Applying the middleware twice shouldn't duplicate headers
+		if got := rw.Header().Values(name); len(got) != 1 || got[0] != want {
+			t.Errorf("%s: want %q, got %q", name, want, got)
+		}
+	}
+
+	if got := rw.Header().Get("X-Frame-Options"); got != "" {
+		t.Errorf("X-Frame-Options should not be set, got %q", got)
+	}
+}
+
+func TestSecurityHeadersNonce(t *testing.T) {
+	cfg := SecurityHeadersConfig{
+		CSP: &CSP{
+			ScriptSrc:   []string{CSPStrictDynamic},
+			ScriptNonce: true,
+			ReportOnly:  true,
+		},
+	}
+
+	var nonces []string
+	h := SecurityHeaders(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce, ok := CSPNonce(r.Context())
+		if !ok || nonce == "" {
+			t.Error("no nonce in request context")
+		}
+		nonces = append(nonces, nonce)
+	}))
+
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+
+		if rw.Header().Get("Content-Security-Policy") != "" {
+			t.Error("report-only policy should not be enforced")
+		}
+
+		want := "script-src 'strict-dynamic' 'nonce-" + nonces[i] + "'"
+		if got := rw.Header().Get("Content-Security-Policy-Report-Only"); got != want {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+
+	if nonces[0] == nonces[1] {
+		t.Error("nonce should be different for every request")
+	}
+}
+
+func TestSecurityHeadersInvalidPreload(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic")
+		}
+	}()
+
+	SecurityHeaders(SecurityHeadersConfig{HSTSMaxAge: time.Hour, HSTSPreload: true})
+}
+
+func TestCSPReportHandler(t *testing.T) {
+	cases := []struct {
+		desc        string
+		contentType string
+		body        string
+		wantCode    int
+		wantLog     string
+	}{
+		{
+			desc:        "legacy report",
+			contentType: "application/csp-report",
+			body:        `{"csp-report":{"document-uri":"https://example.com/","blocked-uri":"https://evil.example.com/x.js","violated-directive":"script-src","line-number":3}}`,
+			wantCode:    204,
+			wantLog:     `blocked_url=https://evil.example.com/x.js effective_directive=script-src`,
+		},
+		{
+			desc:        "reporting API",
+			contentType: "application/reports+json",
+			body:        `[{"type":"csp-violation","body":{"documentURL":"https://example.com/","blockedURL":"inline","effectiveDirective":"style-src-elem","disposition":"report"}},{"type":"deprecation","body":{}}]`,
+			wantCode:    204,
+			wantLog:     `blocked_url=inline effective_directive=style-src-elem disposition=report`,
+		},
+		{
+			desc:        "invalid report",
+			contentType: "application/csp-report",
+			body:        `{`,
+			wantCode:    400,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			h := log.WithLogger(log.Logger{Logger: kitlog.NewLogfmtLogger(buf)})(CSPReportHandler())
+
+			req := httptest.NewRequest("POST", "/csp-reports", strings.NewReader(c.body))
+			req.Header.Set("Content-Type", c.contentType)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			if rw.Code != c.wantCode {
+				t.Errorf("status: want %d, got %d", c.wantCode, rw.Code)
+			}
+			if c.wantLog != "" && !strings.Contains(buf.String(), c.wantLog) {
+				t.Errorf("log should contain %q, got %q", c.wantLog, buf.String())
+			}
+			if strings.Count(buf.String(), "CSP violation") > 1 {
+				t.Errorf("only CSP violations should be logged, got %q", buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,436 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/theplant/appkit/contexts"
+	"github.com/theplant/appkit/log"
+	"github.com/theplant/appkit/logtracing"
+)
+
+// TimeoutConfig is configuration for the Timeout middleware.
+type TimeoutConfig struct {
+	// Default is the timeout for requests that don't match any of
+	// Routes. Zero means no timeout.
+	Default time.Duration
+
+	// Routes sets timeouts for specific routes, keyed by
+	// http.ServeMux pattern (eg. `POST /reports/{id}` or
+	// `/exports/`). A zero timeout disables the timeout for the
+	// route.
+	Routes map[string]time.Duration
+
+	// StatusCode is the HTTP status sent when a handler times out
+	// before starting its response. Defaults to 503 Service
+	// Unavailable, set to 504 Gateway Timeout if that suits your
+	// clients (or load-balancer) better.
+	StatusCode int
+
+	// Body is the response body sent when a handler times out.
+	// Defaults to the status text of StatusCode.
+	Body string
+
+	// ContentType of Body. Defaults to `text/plain; charset=utf-8`.
+	ContentType string
+}
+
+// Timeout is middleware that gives each request a deadline, installed
+// in the request context, so that handlers (and anything they call
+// with the context) can stop work when the deadline passes.
+//
+// When a handler overruns its deadline before it has started its
+// response, the client gets a clean TimeoutConfig.StatusCode
+// response, and anything the handler writes afterwards is discarded
+// (writes return http.ErrHandlerTimeout). If the handler has already
+// started streaming its response, the response is left as-is and
+// only the context is cancelled. Unlike the http.Server timeouts,
+// the connection is not closed.
+//
+// Timeouts are recorded on the request's logtracing span as
+// `timeout=1`, and as a `timeout=1` request tag (see
+// contexts.SetRequestTag, used by monitoring.WithMonitor).
+//
+// A handler can extend (or, with a zero time, remove) its own
+// deadline with http.ResponseController:
+//
+//	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Minute))
+//
+// The new deadline is also passed on to the underlying connection's
+// write deadline, if there is one.
+func Timeout(cfg TimeoutConfig) Middleware {
+	if cfg.StatusCode == 0 {
+		cfg.StatusCode = http.StatusServiceUnavailable
+	}
+	if cfg.Body == "" {
+		cfg.Body = http.StatusText(cfg.StatusCode)
+	}
+	if cfg.ContentType == "" {
+		cfg.ContentType = "text/plain; charset=utf-8"
+	}
+
+	var patterns []string
+	for pattern := range cfg.Routes {
+		patterns = append(patterns, pattern)
+	}
+	routes := newRouteMatcher(patterns)
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout := cfg.Default
+			if pattern, ok := routes.match(r); ok {
+				timeout = cfg.Routes[pattern]
+			}
+
+			if timeout <= 0 {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			serveWithTimeout(h, w, r, timeout, &cfg)
+		})
+	}
+}
+
+func serveWithTimeout(h http.Handler, w http.ResponseWriter, r *http.Request, timeout time.Duration, cfg *TimeoutConfig) {
+	tw := &timeoutWriter{
+		ResponseWriter: w,
+		header:         http.Header{},
+	}
+
+	// The timeout response is sent before the context is done, so
+	// that a handler woken up by the context can't write first.
+	ctx := newTimeoutContext(r.Context(), time.Now().Add(timeout), func() {
+		tw.timeout(cfg)
+	})
+	defer ctx.cancel(context.Canceled)
+	tw.ctx = ctx
+
+	done := make(chan struct{})
+	panicChan := make(chan interface{}, 1)
+
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panicChan <- p
+				return
+			}
+			close(done)
+		}()
+
+		h.ServeHTTP(tw, r.WithContext(ctx))
+	}()
+
+	select {
+	case p := <-panicChan:
+		// Re-panic on the request's goroutine so that Recovery
+		// (and LogRequest) can handle it.
+		panic(p)
+
+	case <-done:
+		tw.finish()
+
+	case <-ctx.Done():
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// Request was cancelled (eg. client went away), there's
+			// nobody to respond to.
+			tw.abandon()
+			return
+		}
+
+		elapsed := time.Since(ctx.start)
+
+		logtracing.AppendSpanKVs(r.Context(), "timeout", 1)
+		contexts.SetRequestTag(r.Context(), "timeout", "1")
+		log.ForceContext(r.Context()).Warn().Log(
+			"msg", fmt.Sprintf("request timed out after %v", elapsed),
+			"during", "appkit/server.Timeout",
+			"timeout_ms", elapsed.Milliseconds(),
+		)
+
+		// Don't lose panics that happen after the response has
+		// gone.
+		go func() {
+			select {
+			case p := <-panicChan:
+				log.ForceContext(r.Context()).Error().Log(
+					"msg", fmt.Sprintf("panic in timed out handler: %v", p),
+					"during", "appkit/server.Timeout",
+					"err", p,
+				)
+			case <-done:
+			}
+		}()
+	}
+}
+
+////////////////////////////////////////////////////////////
+
+// timeoutWriter passes the handler's response through to the
+// underlying ResponseWriter until the request times out. The
+// handler's headers are always kept apart, and copied when it starts
+// its response (or returns), so that a handler still running after
+// the timeout can't race with the timeout response.
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx *timeoutContext
+
+	mu          sync.Mutex
+	header      http.Header
+	wroteHeader bool
+	done        bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.done {
+		return
+	}
+	tw.writeHeaderLocked(code)
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	if tw.wroteHeader {
+		return
+	}
+
+	tw.copyHeaderLocked()
+
+	// Informational responses don't start the response
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		tw.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	tw.wroteHeader = true
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(data []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.done {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	return tw.ResponseWriter.Write(data)
+}
+
+// Flush implements http.Flusher interface to support SSE streaming.
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.done {
+		return
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// SetWriteDeadline moves the handler's deadline to deadline (a zero
+// deadline removes it), and passes the deadline on to the underlying
+// ResponseWriter. This is reached via http.ResponseController.
+func (tw *timeoutWriter) SetWriteDeadline(deadline time.Time) error {
+	if !tw.ctx.extend(deadline) {
+		return http.ErrHandlerTimeout
+	}
+
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.done {
+		return http.ErrHandlerTimeout
+	}
+
+	err := http.NewResponseController(tw.ResponseWriter).SetWriteDeadline(deadline)
+	if errors.Is(err, http.ErrNotSupported) {
+		// The handler's deadline was still changed
+		return nil
+	}
+	return err
+}
+
+// Unwrap exposes the wrapped ResponseWriter to http.ResponseController.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// copyHeaderLocked copies the handler's headers to the underlying
+// ResponseWriter. Values are copied too, so the handler can't append
+// to a slice the server is reading.
+func (tw *timeoutWriter) copyHeaderLocked() {
+	dst := tw.ResponseWriter.Header()
+	for k, v := range tw.header {
+		dst[k] = append([]string(nil), v...)
+	}
+}
+
+// finish is called when the handler returns in time.
+func (tw *timeoutWriter) finish() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.done {
+		// Timed out as the handler returned
+		return
+	}
+
+	// Copy headers set by a handler that didn't write a body, and
+	// trailers set after the response started.
+	tw.copyHeaderLocked()
+	tw.done = true
+}
+
+// abandon stops any further writes from the handler.
+func (tw *timeoutWriter) abandon() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	tw.done = true
+}
+
+// timeout sends the timeout response if the handler hasn't started
+// its response, and stops any further writes from the handler.
+func (tw *timeoutWriter) timeout(cfg *TimeoutConfig) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.done {
+		// Handler returned as the request timed out
+		return
+	}
+	tw.done = true
+
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+
+	tw.ResponseWriter.Header().Set("Content-Type", cfg.ContentType)
+	tw.ResponseWriter.WriteHeader(cfg.StatusCode)
+	_, _ = fmt.Fprint(tw.ResponseWriter, cfg.Body)
+}
+
+////////////////////////////////////////////////////////////
+
+// timeoutContext is a context with a deadline that can be moved
+// after the context is created (context.WithDeadline's can't).
+type timeoutContext struct {
+	context.Context
+	start      time.Time
+	onDeadline func()
+
+	mu       sync.Mutex
+	deadline time.Time
+	timer    *time.Timer
+	done     chan struct{}
+	err      error
+	stop     func() bool
+}
+
+// newTimeoutContext returns a context that is done at deadline, or
+// when parent is done. onDeadline is called when the deadline passes,
+// before the context is done.
+func newTimeoutContext(parent context.Context, deadline time.Time, onDeadline func()) *timeoutContext {
+	ctx := &timeoutContext{
+		Context:    parent,
+		start:      time.Now(),
+		onDeadline: onDeadline,
+		deadline:   deadline,
+		done:       make(chan struct{}),
+	}
+
+	// Callbacks can't cancel before both are set up
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ctx.timer = time.AfterFunc(time.Until(deadline), func() {
+		ctx.cancel(context.DeadlineExceeded)
+	})
+	ctx.stop = context.AfterFunc(parent, func() {
+		ctx.cancel(parent.Err())
+	})
+
+	return ctx
+}
+
+func (c *timeoutContext) Deadline() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if parent, ok := c.Context.Deadline(); ok && (c.deadline.IsZero() || parent.Before(c.deadline)) {
+		return parent, true
+	}
+	return c.deadline, !c.deadline.IsZero()
+}
+
+func (c *timeoutContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *timeoutContext) Err() error {
+	// Err is nil until Done is closed, which happens after
+	// onDeadline has returned.
+	select {
+	case <-c.done:
+	default:
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+func (c *timeoutContext) cancel(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	c.timer.Stop()
+	c.stop()
+	c.mu.Unlock()
+
+	// onDeadline writes to the client, so it's called without the
+	// lock to not block Err and Deadline.
+	if err == context.DeadlineExceeded {
+		c.onDeadline()
+	}
+	close(c.done)
+}
+
+// extend moves the deadline. Returns false if the context is already
+// done.
+func (c *timeoutContext) extend(deadline time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return false
+	}
+
+	c.timer.Stop()
+	c.deadline = deadline
+	if !deadline.IsZero() {
+		c.timer.Reset(time.Until(deadline))
+	}
+
+	return true
+}
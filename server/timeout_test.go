@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/theplant/appkit/contexts"
+	"github.com/theplant/appkit/log"
+)
+
+// slowHandler waits for d, or for the request context to be done,
+// then writes "ok".
+func slowHandler(d time.Duration, ctxErr chan<- error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(d):
+		case <-r.Context().Done():
+		}
+		if ctxErr != nil {
+			ctxErr <- r.Context().Err()
+		}
+		_, _ = io.WriteString(w, "ok")
+	})
+}
+
+func serveTimeout(cfg TimeoutConfig, h http.Handler, method, path string) (*httptest.ResponseRecorder, context.Context) {
+	var ctx context.Context
+	outer := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx = r.Context()
+			h.ServeHTTP(w, r)
+		})
+	}
+
+	rw := httptest.NewRecorder()
+	Compose(
+		Timeout(cfg),
+		outer,
+		contexts.WithRequestTags,
+		log.WithLogger(log.NewNopLogger()),
+	)(h).ServeHTTP(rw, httptest.NewRequest(method, path, nil))
+
+	return rw, ctx
+}
+
+func TestTimeoutOverrun(t *testing.T) {
+	ctxErr := make(chan error, 1)
+	rw, ctx := serveTimeout(TimeoutConfig{Default: 10 * time.Millisecond}, slowHandler(time.Second, ctxErr), "GET", "/")
+
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("status: want 503, got %d", rw.Code)
+	}
+	if rw.Body.String() != "Service Unavailable" {
+		t.Errorf("unexpected body %q", rw.Body.String())
+	}
+
+	if err := <-ctxErr; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("handler context error: want DeadlineExceeded, got %v", err)
+	}
+
+	if tags, _ := contexts.RequestTags(ctx); tags["timeout"] != "1" {
+		t.Errorf("timeout request tag: want 1, got %q", tags["timeout"])
+	}
+}
+
+func TestTimeoutCustomResponse(t *testing.T) {
+	cfg := TimeoutConfig{
+		Default:     10 * time.Millisecond,
+		StatusCode:  http.StatusGatewayTimeout,
+		Body:        `{"error":"timeout"}`,
+		ContentType: "application/json",
+	}
+	rw, _ := serveTimeout(cfg, slowHandler(time.Second, nil), "GET", "/")
+
+	if rw.Code != http.StatusGatewayTimeout {
+		t.Errorf("status: want 504, got %d", rw.Code)
+	}
+	if ct := rw.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type: want application/json, got %q", ct)
+	}
+	if rw.Body.String() != `{"error":"timeout"}` {
+		t.Errorf("unexpected body %q", rw.Body.String())
+	}
+}
+
+func TestTimeoutInTime(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); !ok {
+			t.Error("no deadline in request context")
+		}
+		w.Header().Set("X-Test", "1")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, "created")
+	})
+
+	rw, ctx := serveTimeout(TimeoutConfig{Default: time.Second}, h, "GET", "/")
+
+	if rw.Code != http.StatusCreated || rw.Body.String() != "created" || rw.Header().Get("X-Test") != "1" {
+		t.Errorf("unexpected response %d %q %v", rw.Code, rw.Body.String(), rw.Header())
+	}
+	if tags, _ := contexts.RequestTags(ctx); tags["timeout"] != "" {
+		t.Errorf("timeout request tag should not be set")
+	}
+}
+
+func TestTimeoutPerRoute(t *testing.T) {
+	cfg := TimeoutConfig{
+		Routes: map[string]time.Duration{
+			"GET /slow/{id}": 10 * time.Millisecond,
+		},
+	}
+
+	rw, _ := serveTimeout(cfg, slowHandler(50*time.Millisecond, nil), "GET", "/slow/1")
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("status for /slow/1: want 503, got %d", rw.Code)
+	}
+
+	rw, _ = serveTimeout(cfg, slowHandler(50*time.Millisecond, nil), "GET", "/other")
+	if rw.Code != http.StatusOK {
+		t.Errorf("status for /other: want 200, got %d", rw.Code)
+	}
+}
+
+func TestTimeoutExtendDeadline(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Second))
+		if err != nil {
+			t.Errorf("SetWriteDeadline: %v", err)
+		}
+		slowHandler(50*time.Millisecond, nil).ServeHTTP(w, r)
+	})
+
+	rw, _ := serveTimeout(TimeoutConfig{Default: 10 * time.Millisecond}, h, "GET", "/")
+
+	if rw.Code != http.StatusOK || rw.Body.String() != "ok" {
+		t.Errorf("unexpected response %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestTimeoutAfterResponseStarted(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "started")
+		<-r.Context().Done()
+	})
+
+	rw, _ := serveTimeout(TimeoutConfig{Default: 10 * time.Millisecond}, h, "GET", "/")
+
+	if rw.Code != http.StatusOK || rw.Body.String() != "started" {
+		t.Errorf("unexpected response %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestTimeoutHeaderAfterTimeout(t *testing.T) {
+	handlerDone := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(handlerDone)
+		<-r.Context().Done()
+		w.Header().Set("X-Late", "1")
+	})
+
+	rw, _ := serveTimeout(TimeoutConfig{Default: 10 * time.Millisecond}, h, "GET", "/")
+	// Read the response headers while the handler may still be
+	// setting its own.
+	late := rw.Header().Get("X-Late")
+	<-handlerDone
+
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("status: want 503, got %d", rw.Code)
+	}
+	if late != "" || rw.Header().Get("X-Late") != "" {
+		t.Errorf("header set after timeout reached the response")
+	}
+}
+
+func TestTimeoutTrailers(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = io.WriteString(w, "ok")
+		w.Header().Set("X-Checksum", "abc")
+	})
+
+	rw, _ := serveTimeout(TimeoutConfig{Default: time.Second}, h, "GET", "/")
+
+	if got := rw.Result().Trailer.Get("X-Checksum"); got != "abc" {
+		t.Errorf("trailer: want abc, got %q", got)
+	}
+}
+
+func TestTimeoutPanic(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("test")
+	})
+
+	defer func() {
+		if p := recover(); p != "test" {
+			t.Errorf("want panic to reach the caller, got %v", p)
+		}
+	}()
+
+	serveTimeout(TimeoutConfig{Default: time.Second}, h, "GET", "/")
+}
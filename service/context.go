@@ -4,8 +4,12 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	neturl "net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/api"
 	"github.com/jinzhu/configor"
@@ -48,7 +52,7 @@ func serviceContext() (context.Context, io.Closer) {
 
 			vault.Auth().Token().RevokeSelf("")
 		}
-	}), mC, nC}
+	}), nC, mC}
 }
 
 func installLogger(ctx context.Context, serviceName string) (log.Logger, context.Context) {
@@ -75,68 +79,332 @@ type influxDBConfig struct {
 	URL string
 }
 
+type prometheusConfig struct {
+	// Addr of a separate listener that serves metrics, eg. ":9090"
+	Addr      string
+	Path      string `default:"/metrics"`
+	Namespace string
+	MaxSeries int
+}
+
+// monitorConfig configures combinators that wrap the configured
+// monitors.
+type monitorConfig struct {
+	// comma-separated static tags, eg. "env:production,region:eu"
+	Tags string
+	// fraction of metrics to send, between 0 and 1
+	SampleRate float64 `default:"1"`
+	// comma-separated measurements (or prefixes ending with `*`)
+	DropMeasurements string
+	// comma-separated old:new measurement names
+	RenameMeasurements string
+	// comma-separated tags to drop from all measurements
+	DropTags string
+	// comma-separated measurements (or prefixes ending with `*`) to
+	// aggregate, see monitoring.Aggregate
+	AggregateMeasurements    string
+	AggregateIntervalSeconds int `default:"10"`
+}
+
+// installMonitor installs a Prometheus monitor (see
+// installPrometheusMonitor), and monitors for each of the
+// comma-separated URLs in INFLUXDB_URL, combined with monitoring.Multi
+// and wrapped with the combinators configured by MONITOR_*, and
+// records runtime metrics with them (see installRuntimeCollector).
+// Without any configured monitor, it falls back to a log monitor
+// without runtime metrics.
 func installMonitor(ctx context.Context, l log.Logger, serviceName string, vault *vault.Client) (monitoring.Monitor, io.Closer, context.Context) {
 	var (
-		monitor monitoring.Monitor
-		closer  func()
-		url     *neturl.URL
-		q       neturl.Values
+		monitors, urlMonitors []monitoring.Monitor
+		closers               funcCloser
 	)
 
-	closer = noopCloser
+	if monitor, closer, ok := installPrometheusMonitor(l, serviceName); ok {
+		monitors = append(monitors, monitor)
+		closers = append(closers, closer)
+	}
 
 	config := influxDBConfig{}
 	err := configor.New(&configor.Config{ENVPrefix: "INFLUXDB"}).Load(&config)
 	if err != nil {
-		err = errors.Wrap(err, "error fetching influxdb config")
-		goto err
+		l.Warn().Log(
+			"msg", errors.Wrap(err, "error fetching influxdb config"),
+			"err", err,
+		)
 	}
 
-	url, err = neturl.Parse(config.URL)
+	for _, rawURL := range splitTrimmed(config.URL) {
+		monitor, closer, err := newURLMonitor(l, rawURL, serviceName, vault)
+		if err != nil {
+			l.Warn().Log(
+				"msg", errors.Wrap(err, "skipping monitor"),
+				"err", err,
+			)
+			continue
+		}
+
+		urlMonitors = append(urlMonitors, monitor)
+		closers = append(closers, noopCloserF(closer))
+	}
+
+	if len(monitors) == 0 && len(urlMonitors) == 0 {
+		l.Warn().Log(
+			"msg", "falling back to log monitor: no monitor configured",
+		)
+		return monitoring.NewLogMonitor(l), closers, ctx
+	}
+
+	monitor, flush := wrapMonitor(l, monitors, urlMonitors)
+
+	// stop recording runtime metrics, and write aggregates, before
+	// closing monitors
+	closers = append(funcCloser{installRuntimeCollector(l, monitor), noopCloserF(flush)}, closers...)
+
+	return monitor, closers, monitoring.Context(ctx, monitor)
+}
+
+// newURLMonitor creates an InfluxDB, InfluxDB+Vault or StatsD monitor,
+// depending on rawURL's scheme.
+func newURLMonitor(l log.Logger, rawURL, serviceName string, vault *vault.Client) (monitoring.Monitor, func(), error) {
+	url, err := neturl.Parse(rawURL)
 	if err != nil {
-		err = errors.Wrap(err, "error parsing influxdb config url")
-		goto err
+		return nil, nil, errors.Wrap(err, "error parsing influxdb config url")
 	}
 
 	// attach service name to url
-	q = url.Query()
+	q := url.Query()
 	if q.Get("service-name") == "" && serviceName != "" {
 		q.Set("service-name", serviceName)
 		url.RawQuery = q.Encode()
 	}
 
-	if url.Scheme == "vault" {
-		if vault != nil {
-			monitor, closer, err = influxdb.NewInfluxDBMonitor(l, vault, url)
-			err = errors.Wrap(err, "error creating influxdb+vault monitor")
-		} else {
-			err = errors.Wrap(err, "nil vault client when configured for influxdb+vault monitor")
+	switch url.Scheme {
+	case "vault":
+		if vault == nil {
+			return nil, nil, errors.New("nil vault client when configured for influxdb+vault monitor")
 		}
-	} else {
-		monitor, closer, err = monitoring.NewInfluxdbMonitor(monitoring.InfluxMonitorConfig(config.URL), l)
-		err = errors.Wrap(err, "error creating influxdb monitor")
+		monitor, closer, err := influxdb.NewInfluxDBMonitor(l, vault, url)
+		return monitor, closer, errors.Wrap(err, "error creating influxdb+vault monitor")
+
+	case "statsd":
+		monitor, closer, err := monitoring.NewStatsdMonitor(monitoring.StatsdMonitorConfig(url.String()), l)
+		return monitor, closer, errors.Wrap(err, "error creating statsd monitor")
+	}
+
+	monitor, closer, err := monitoring.NewInfluxdbMonitor(monitoring.InfluxMonitorConfig(rawURL), l)
+	return monitor, closer, errors.Wrap(err, "error creating influxdb monitor")
+}
+
+// wrapMonitor combines monitors and urlMonitors with monitoring.Multi,
+// wrapped with the combinators configured by MONITOR_*. Measurements
+// are only aggregated and sampled for urlMonitors, as the others
+// (Prometheus) already aggregate values, and would undercount sampled
+// ones. The returned function writes aggregated metrics.
+func wrapMonitor(l log.Logger, monitors, urlMonitors []monitoring.Monitor) (monitoring.Monitor, func()) {
+	config := monitorConfig{}
+	err := configor.New(&configor.Config{ENVPrefix: "MONITOR"}).Load(&config)
+	if err != nil {
+		panic(err)
+	}
+
+	sample := config.SampleRate > 0 && config.SampleRate < 1
+	if !sample && config.SampleRate != 1 {
+		l.Warn().Log(
+			"msg", fmt.Sprintf("ignoring invalid MONITOR_SampleRate %v, must be greater than 0, and at most 1", config.SampleRate),
+			"sample_rate", config.SampleRate,
+		)
+	}
+
+	flush := func() {}
+	aggregated := splitTrimmed(config.AggregateMeasurements)
+	if len(urlMonitors) > 0 {
+		urlMonitor := monitoring.Multi(urlMonitors...)
+		if len(aggregated) > 0 {
+			urlMonitor, flush = monitoring.Aggregate(urlMonitor, monitoring.AggregateConfig{
+				Measurements:  aggregated,
+				FlushInterval: time.Duration(config.AggregateIntervalSeconds) * time.Second,
+			})
+		}
+		if sample {
+			// aggregated measurements aren't sampled, as their
+			// counts and sums wouldn't be scaled
+			urlMonitor = monitoring.Sample(urlMonitor, config.SampleRate, aggregated...)
+		}
+		urlMonitors = []monitoring.Monitor{urlMonitor}
+	}
+	monitor := monitoring.Multi(append(monitors, urlMonitors...)...)
+
+	if dropTags := splitTrimmed(config.DropTags); len(dropTags) > 0 {
+		monitor = monitoring.Filter(monitor, monitoring.FilterRule{Measurement: "*", DropTags: dropTags})
+	}
+
+	var rules []monitoring.FilterRule
+	for _, measurement := range splitTrimmed(config.DropMeasurements) {
+		rules = append(rules, monitoring.FilterRule{Measurement: measurement, Drop: true})
+	}
+	for _, rename := range splitTrimmed(config.RenameMeasurements) {
+		from, to, ok := strings.Cut(rename, ":")
+		if !ok || from == "" || to == "" {
+			panic(errors.Errorf("invalid MONITOR_RenameMeasurements entry %q, expected old:new", rename))
+		}
+		rules = append(rules, monitoring.FilterRule{Measurement: from, Rename: to})
 	}
+	if len(rules) > 0 {
+		monitor = monitoring.Filter(monitor, rules...)
+	}
+
+	tags := map[string]string{}
+	for _, tag := range splitTrimmed(config.Tags) {
+		k, v, ok := strings.Cut(tag, ":")
+		if !ok || k == "" {
+			panic(errors.Errorf("invalid MONITOR_Tags entry %q, expected name:value", tag))
+		}
+		tags[k] = v
+	}
+
+	return monitoring.WithTags(monitor, tags), flush
+}
+
+// installPrometheusMonitor creates a Prometheus monitor, and serves
+// its metrics on a separate listener, if PROMETHEUS_Addr is set.
+func installPrometheusMonitor(l log.Logger, serviceName string) (monitoring.Monitor, io.Closer, bool) {
+	config := prometheusConfig{}
+	err := configor.New(&configor.Config{ENVPrefix: "PROMETHEUS"}).Load(&config)
 	if err != nil {
-		goto err
+		panic(err)
+	}
+
+	if config.Addr == "" {
+		return nil, nil, false
 	}
 
-	return monitor, noopCloserF(closer), monitoring.Context(ctx, monitor)
+	var constLabels map[string]string
+	if serviceName != "" {
+		constLabels = map[string]string{"service": serviceName}
+	}
 
-err:
-	l.Warn().Log(
-		"msg", errors.Wrap(err, "falling back to log monitor"),
-		"err", err,
+	monitor := monitoring.NewPrometheusMonitor(monitoring.PrometheusConfig{
+		Namespace:   config.Namespace,
+		ConstLabels: constLabels,
+		MaxSeries:   config.MaxSeries,
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle(config.Path, monitor.Handler())
+
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		panic(errors.Wrapf(err, "error listening for prometheus metrics on %q", config.Addr))
+	}
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			l.Error().Log(
+				"msg", errors.Wrap(err, "error serving prometheus metrics"),
+				"err", err,
+			)
+		}
+	}()
+
+	l.Info().Log(
+		"msg", fmt.Sprintf("serving prometheus metrics on %s%s", listener.Addr(), config.Path),
+		"addr", listener.Addr().String(),
+		"path", config.Path,
 	)
-	closer()
-	return monitoring.NewLogMonitor(l), noopCloser, ctx
+
+	return monitor, noopCloserF(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}), true
+}
+
+type runtimeMetricsConfig struct {
+	Disabled        bool
+	IntervalSeconds int `default:"30"`
+}
+
+// installRuntimeCollector starts a monitoring.RuntimeCollector that
+// records Go runtime and process metrics with monitor, unless
+// disabled by RUNTIMEMETRICS_Disabled. The returned closer stops the
+// collector.
+func installRuntimeCollector(l log.Logger, monitor monitoring.Monitor) io.Closer {
+	config := runtimeMetricsConfig{}
+	err := configor.New(&configor.Config{ENVPrefix: "RUNTIMEMETRICS"}).Load(&config)
+	if err != nil {
+		panic(err)
+	}
+
+	if config.Disabled {
+		l.Info().Log(
+			"msg", "runtime metrics disabled",
+		)
+		return noopCloser
+	}
+
+	collector := monitoring.NewRuntimeCollector(monitor, time.Duration(config.IntervalSeconds)*time.Second)
+	collector.Start()
+
+	return noopCloserF(collector.Stop)
 }
 
 ////////////////////////////////////////////////////////////
 // Error Notifier
 
+// installErrorNotifier installs the first configured error notifier:
+// Sentry (SENTRY_DSN), webhook (ERROR_WEBHOOK_URL), or Airbrake
+// (AIRBRAKE_PROJECTID and AIRBRAKE_TOKEN), falling back to logging
+// errors.
 func installErrorNotifier(ctx context.Context, l log.Logger) (errornotifier.Notifier, io.Closer, context.Context) {
+	sentryConfig := errornotifier.SentryConfig{}
+	err := configor.New(&configor.Config{ENVPrefix: "SENTRY"}).Load(&sentryConfig)
+	if err != nil {
+		panic(err)
+	}
+
+	if sentryConfig.DSN != "" {
+		n, closer, err := errornotifier.NewSentryNotifier(sentryConfig, l)
+		if err == nil {
+			l.Info().Log(
+				"msg", "creating sentry notifier",
+				"env", sentryConfig.Environment,
+			)
+
+			return dedupErrorNotifier(ctx, l, n, closer)
+		}
+
+		l.Warn().Log(
+			"msg", errors.Wrap(err, "error creating sentry notifier"),
+			"err", err,
+		)
+	}
+
+	webhookConfig := errornotifier.WebhookConfig{}
+	err = configor.New(&configor.Config{ENVPrefix: "ERROR_WEBHOOK"}).Load(&webhookConfig)
+	if err != nil {
+		panic(err)
+	}
+
+	if webhookConfig.URL != "" {
+		n, closer, err := errornotifier.NewWebhookNotifier(webhookConfig, l)
+		if err == nil {
+			l.Info().Log(
+				"msg", "creating webhook error notifier",
+				"env", webhookConfig.Environment,
+			)
+
+			return dedupErrorNotifier(ctx, l, n, closer)
+		}
+
+		l.Warn().Log(
+			"msg", errors.Wrap(err, "error creating webhook error notifier"),
+			"err", err,
+		)
+	}
+
 	airbrakeConfig := errornotifier.AirbrakeConfig{}
-	err := configor.New(&configor.Config{ENVPrefix: "AIRBRAKE"}).Load(&airbrakeConfig)
+	err = configor.New(&configor.Config{ENVPrefix: "AIRBRAKE"}).Load(&airbrakeConfig)
 	if err != nil {
 		panic(err)
 	}
@@ -157,7 +425,40 @@ func installErrorNotifier(ctx context.Context, l log.Logger) (errornotifier.Noti
 		"env", airbrakeConfig.Environment,
 	)
 
-	return n, closer, errornotifier.Context(ctx, n)
+	return dedupErrorNotifier(ctx, l, n, closer)
+}
+
+type errorDedupConfig struct {
+	Disabled      bool
+	WindowSeconds int `default:"60"`
+	PerMinute     int `default:"60"`
+}
+
+// dedupErrorNotifier wraps n with errornotifier.Dedup, unless disabled
+// by ERROR_DEDUP_DISABLED, and installs it in ctx. Suppressed
+// notifications are counted with the context's monitor. The returned
+// closer sends the last summaries, and then closes closer.
+func dedupErrorNotifier(ctx context.Context, l log.Logger, n errornotifier.Notifier, closer io.Closer) (errornotifier.Notifier, io.Closer, context.Context) {
+	config := errorDedupConfig{}
+	err := configor.New(&configor.Config{ENVPrefix: "ERROR_DEDUP"}).Load(&config)
+	if err != nil {
+		panic(err)
+	}
+
+	if config.Disabled {
+		l.Info().Log(
+			"msg", "error notification deduplication disabled",
+		)
+		return n, closer, errornotifier.Context(ctx, n)
+	}
+
+	n, dedupCloser := errornotifier.Dedup(n, errornotifier.DedupConfig{
+		Window:    time.Duration(config.WindowSeconds) * time.Second,
+		PerMinute: config.PerMinute,
+		Monitor:   monitoring.ForceContext(ctx),
+	})
+
+	return n, funcCloser{dedupCloser, closer}, errornotifier.Context(ctx, n)
 }
 
 ////////////////////////////////////////////////////////////
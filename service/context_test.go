@@ -3,16 +3,23 @@ package service
 import (
 	"context"
 	"fmt"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/theplant/appkit/log"
+	"github.com/theplant/appkit/monitoring"
 )
 
 func TestInstallErrorNotifier(t *testing.T) {
 	ctx := context.Background()
 	l := log.Default()
 
+	// check the type of the wrapped notifier
+	t.Setenv("ERROR_DEDUP_DISABLED", "true")
+
 	t.Run("airbrake", func(t *testing.T) {
 		os.Setenv("AIRBRAKE_PROJECTID", "1")
 		os.Setenv("AIRBRAKE_TOKEN", "token")
@@ -24,4 +31,192 @@ func TestInstallErrorNotifier(t *testing.T) {
 			t.Fatalf("want notifier type is *errornotifier.airbrakeNotifier but get %s", typ)
 		}
 	})
+
+	t.Run("sentry", func(t *testing.T) {
+		t.Setenv("SENTRY_DSN", "https://key@sentry.example.com/42")
+		notifier, closer, _ := installErrorNotifier(ctx, l)
+		defer closer.Close()
+		typ := fmt.Sprintf("%T", notifier)
+		if typ != "*errornotifier.sentryNotifier" {
+			t.Fatalf("want notifier type is *errornotifier.sentryNotifier but get %s", typ)
+		}
+	})
+
+	t.Run("webhook", func(t *testing.T) {
+		t.Setenv("ERROR_WEBHOOK_URL", "https://errors.example.com/notify")
+		notifier, closer, _ := installErrorNotifier(ctx, l)
+		defer closer.Close()
+		typ := fmt.Sprintf("%T", notifier)
+		if typ != "*errornotifier.webhookNotifier" {
+			t.Fatalf("want notifier type is *errornotifier.webhookNotifier but get %s", typ)
+		}
+	})
+
+	t.Run("dedup", func(t *testing.T) {
+		t.Setenv("ERROR_DEDUP_DISABLED", "false")
+		notifier, closer, _ := installErrorNotifier(ctx, l)
+		defer closer.Close()
+		typ := fmt.Sprintf("%T", notifier)
+		if typ != "*errornotifier.dedupNotifier" {
+			t.Fatalf("want notifier type is *errornotifier.dedupNotifier but get %s", typ)
+		}
+	})
+
+	t.Run("invalid sentry DSN falls back", func(t *testing.T) {
+		t.Setenv("SENTRY_DSN", "https://sentry.example.com/42")
+		notifier, closer, _ := installErrorNotifier(ctx, l)
+		defer closer.Close()
+		typ := fmt.Sprintf("%T", notifier)
+		if typ != "*errornotifier.airbrakeNotifier" {
+			t.Fatalf("want notifier type is *errornotifier.airbrakeNotifier but get %s", typ)
+		}
+	})
+}
+
+func TestInstallPrometheusMonitor(t *testing.T) {
+	ctx := context.Background()
+	l := log.Default()
+
+	os.Setenv("PROMETHEUS_ADDR", "127.0.0.1:0")
+	defer os.Unsetenv("PROMETHEUS_ADDR")
+
+	monitor, closer, _ := installMonitor(ctx, l, "test", nil)
+	defer closer.Close()
+
+	typ := fmt.Sprintf("%T", monitor)
+	if typ != "*monitoring.PrometheusMonitor" {
+		t.Fatalf("want monitor type is *monitoring.PrometheusMonitor but get %s", typ)
+	}
+}
+
+func TestInstallStatsdMonitor(t *testing.T) {
+	ctx := context.Background()
+	l := log.Default()
+
+	os.Setenv("INFLUXDB_URL", "statsd://127.0.0.1:8125")
+	defer os.Unsetenv("INFLUXDB_URL")
+
+	monitor, closer, _ := installMonitor(ctx, l, "test", nil)
+	defer closer.Close()
+
+	typ := fmt.Sprintf("%T", monitor)
+	if typ != "*monitoring.statsdMonitor" {
+		t.Fatalf("want monitor type is *monitoring.statsdMonitor but get %s", typ)
+	}
+}
+
+func TestInstallMultipleMonitors(t *testing.T) {
+	ctx := context.Background()
+	l := log.Default()
+
+	os.Setenv("PROMETHEUS_ADDR", "127.0.0.1:0")
+	defer os.Unsetenv("PROMETHEUS_ADDR")
+	os.Setenv("INFLUXDB_URL", "statsd://127.0.0.1:8125, not a url")
+	defer os.Unsetenv("INFLUXDB_URL")
+
+	monitor, closer, _ := installMonitor(ctx, l, "test", nil)
+	defer closer.Close()
+
+	typ := fmt.Sprintf("%T", monitor)
+	if typ != "monitoring.multiMonitor" {
+		t.Fatalf("want monitor type is monitoring.multiMonitor but get %s", typ)
+	}
+
+	os.Setenv("MONITOR_TAGS", "env:test")
+	defer os.Unsetenv("MONITOR_TAGS")
+
+	monitor, closer, _ = installMonitor(ctx, l, "test", nil)
+	defer closer.Close()
+
+	typ = fmt.Sprintf("%T", monitor)
+	if typ != "monitoring.tagsMonitor" {
+		t.Fatalf("want monitor type is monitoring.tagsMonitor but get %s", typ)
+	}
+}
+
+func TestInstallAggregateMonitor(t *testing.T) {
+	ctx := context.Background()
+	l := log.Default()
+
+	os.Setenv("INFLUXDB_URL", "statsd://127.0.0.1:8125")
+	defer os.Unsetenv("INFLUXDB_URL")
+	os.Setenv("MONITOR_AGGREGATEMEASUREMENTS", "request")
+	defer os.Unsetenv("MONITOR_AGGREGATEMEASUREMENTS")
+
+	monitor, closer, _ := installMonitor(ctx, l, "test", nil)
+	defer closer.Close()
+
+	typ := fmt.Sprintf("%T", monitor)
+	if typ != "*monitoring.aggregateMonitor" {
+		t.Fatalf("want monitor type is *monitoring.aggregateMonitor but get %s", typ)
+	}
+
+	// Prometheus monitors aren't aggregated
+	os.Setenv("PROMETHEUS_ADDR", "127.0.0.1:0")
+	defer os.Unsetenv("PROMETHEUS_ADDR")
+
+	monitor, closer, _ = installMonitor(ctx, l, "test", nil)
+	defer closer.Close()
+
+	typ = fmt.Sprintf("%T", monitor)
+	if typ != "monitoring.multiMonitor" {
+		t.Fatalf("want monitor type is monitoring.multiMonitor but get %s", typ)
+	}
+}
+
+// countingMonitor counts inserted records.
+type countingMonitor struct {
+	monitoring.Monitor
+	records int
+}
+
+func (m *countingMonitor) InsertRecord(string, interface{}, map[string]string, map[string]interface{}, time.Time) {
+	m.records++
+}
+
+func TestWrapMonitorSampling(t *testing.T) {
+	os.Setenv("MONITOR_SAMPLERATE", "0.01")
+	defer os.Unsetenv("MONITOR_SAMPLERATE")
+
+	prometheus, url := &countingMonitor{}, &countingMonitor{}
+	monitor, _ := wrapMonitor(log.NewNopLogger(), []monitoring.Monitor{prometheus}, []monitoring.Monitor{url})
+
+	for i := 0; i < 1000; i++ {
+		monitor.InsertRecord("request", 1, nil, nil, time.Now())
+	}
+
+	// Prometheus monitors aren't sampled
+	if prometheus.records != 1000 {
+		t.Errorf("want 1000 records sent to prometheus, got %d", prometheus.records)
+	}
+	if url.records >= 100 {
+		t.Errorf("want about 10 records sent to url monitors, got %d", url.records)
+	}
+}
+
+func TestInstallRuntimeCollector(t *testing.T) {
+	l := log.Default()
+
+	scrape := func(p *monitoring.PrometheusMonitor) string {
+		rw := httptest.NewRecorder()
+		p.Handler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+		return rw.Body.String()
+	}
+
+	p := monitoring.NewPrometheusMonitor(monitoring.PrometheusConfig{})
+	installRuntimeCollector(l, p).Close()
+
+	if !strings.Contains(scrape(p), "runtime_goroutines_count 1") {
+		t.Fatalf("expected runtime metrics to be collected")
+	}
+
+	os.Setenv("RUNTIMEMETRICS_DISABLED", "true")
+	defer os.Unsetenv("RUNTIMEMETRICS_DISABLED")
+
+	p = monitoring.NewPrometheusMonitor(monitoring.PrometheusConfig{})
+	installRuntimeCollector(l, p).Close()
+
+	if strings.Contains(scrape(p), "runtime_goroutines") {
+		t.Fatalf("expected runtime collector to be disabled")
+	}
 }
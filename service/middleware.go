@@ -8,6 +8,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/goji/httpauth"
@@ -16,7 +17,10 @@ import (
 	newrelic "github.com/newrelic/go-agent"
 	"github.com/pkg/errors"
 	"github.com/rs/cors"
+	"github.com/theplant/appkit/auth"
+	"github.com/theplant/appkit/contexts"
 	kitaws "github.com/theplant/appkit/credentials/aws"
+	"github.com/theplant/appkit/credentials/vault"
 	"github.com/theplant/appkit/errornotifier"
 	"github.com/theplant/appkit/log"
 	"github.com/theplant/appkit/monitoring"
@@ -41,7 +45,7 @@ func middleware(ctx context.Context) (server.Middleware, io.Closer, error) {
 
 	return server.Compose(
 		withAWSConfig(kitaws.ForceContext(ctx)),
-		httpAuthMiddleware(logger),
+		authMiddleware(ctx, logger),
 		corsMiddleware(logger),
 		newRelicMiddleware(logger),
 		avoidClickjackingMiddleware(logger),
@@ -50,6 +54,7 @@ func middleware(ctx context.Context) (server.Middleware, io.Closer, error) {
 		errornotifier.Recover(errornotifier.ForceContext(ctx)),
 		tracer,
 		server.DefaultMiddleware(logger),
+		clientIPMiddleware(logger),
 	), tC, nil
 }
 
@@ -169,11 +174,15 @@ func corsMiddleware(logger log.Logger) server.Middleware {
 		config.AllowedHeaders[i] = strings.TrimSpace(allowedHeader)
 	}
 
-	c := cors.New(cors.Options{
-		AllowedOrigins:   config.AllowedOrigins,
+	origins, err := server.NewOriginMatcher(config.AllowedOrigins)
+	if err != nil {
+		panic(errors.Wrap(err, "error configuring CORS allowed origins"))
+	}
+
+	c := cors.New(origins.CORSOptions(cors.Options{
 		AllowCredentials: config.AllowCredentials,
 		AllowedHeaders:   config.AllowedHeaders,
-	})
+	}))
 
 	logger.Info().Log(
 		"msg", "enabling CORS middleware",
@@ -258,6 +267,228 @@ func httpAuthMiddleware(logger log.Logger) server.Middleware {
 	}
 }
 
+////////////////////////////////////////////////////////////
+// Authentication
+
+type authConfig struct {
+	HtpasswdFile string
+	// comma-separated name:key pairs
+	APIKeys string
+	// Vault path of a secret whose fields are API key name => key
+	APIKeysVaultPath string
+
+	JWKSFile    string
+	JWTIssuer   string
+	JWTAudience string
+	// allowed clock skew when checking JWT expiry
+	JWTLeewaySeconds int `default:"30"`
+
+	Realm    string
+	Optional bool
+
+	UserAgentWhitelistRegexp string
+	PathWhitelistRegexp      string
+}
+
+func (c authConfig) enabled() bool {
+	return c.HtpasswdFile != "" || c.APIKeys != "" || c.APIKeysVaultPath != "" || c.JWKSFile != ""
+}
+
+// authMiddleware configures auth.Middleware from `AUTH_*`
+// environment variables, falling back to HTTP basic auth configured
+// from `BASICAUTH_*`.
+func authMiddleware(ctx context.Context, logger log.Logger) server.Middleware {
+	config := authConfig{}
+
+	err := configor.New(&configor.Config{ENVPrefix: "AUTH"}).Load(&config)
+	if err != nil {
+		panic(err)
+	}
+
+	if !config.enabled() {
+		return httpAuthMiddleware(logger)
+	}
+
+	var chain auth.Chain
+	var methods []string
+
+	if config.HtpasswdFile != "" {
+		htpasswd, err := auth.LoadHtpasswd(config.HtpasswdFile)
+		if err != nil {
+			panic(errors.Wrapf(err, "error loading htpasswd file %q", config.HtpasswdFile))
+		}
+		chain = append(chain, htpasswd)
+		methods = append(methods, "htpasswd")
+	}
+
+	basicAuth := httpAuthConfig{}
+	if err := configor.New(&configor.Config{ENVPrefix: "BASICAUTH"}).Load(&basicAuth); err != nil {
+		panic(err)
+	}
+	if basicAuth.Username != "" {
+		chain = append(chain, auth.StaticBasic{Username: basicAuth.Username, Password: basicAuth.Password})
+		methods = append(methods, "basic")
+	}
+
+	if config.APIKeys != "" || config.APIKeysVaultPath != "" {
+		keys, err := auth.ParseAPIKeys(config.APIKeys)
+		if err != nil {
+			panic(errors.Wrap(err, "error parsing AUTH_APIKeys"))
+		}
+		apiKeys := auth.NewAPIKeys(keys)
+
+		if config.APIKeysVaultPath != "" {
+			loadVaultAPIKeys(vault.ForceContext(ctx), config.APIKeysVaultPath, apiKeys, logger)
+		}
+
+		chain = append(chain, apiKeys)
+		methods = append(methods, "api_key")
+	}
+
+	if config.JWKSFile != "" {
+		jwks, err := auth.LoadJWKS(config.JWKSFile)
+		if err != nil {
+			panic(errors.Wrapf(err, "error loading JWKS file %q", config.JWKSFile))
+		}
+		chain = append(chain, &auth.JWT{
+			Keys:     jwks,
+			Issuer:   config.JWTIssuer,
+			Audience: config.JWTAudience,
+			Leeway:   time.Duration(config.JWTLeewaySeconds) * time.Second,
+		})
+		methods = append(methods, "jwt")
+	}
+
+	var userAgentRegexp, pathRegexp *regexp.Regexp
+
+	if config.UserAgentWhitelistRegexp != "" {
+		userAgentRegexp, err = regexp.Compile(config.UserAgentWhitelistRegexp)
+		if err != nil {
+			panic(errors.Wrap(err, fmt.Sprintf("error compiling auth user-agent whitelist regexp %q", config.UserAgentWhitelistRegexp)))
+		}
+	}
+
+	if config.PathWhitelistRegexp != "" {
+		pathRegexp, err = regexp.Compile(config.PathWhitelistRegexp)
+		if err != nil {
+			panic(errors.Wrap(err, fmt.Sprintf("error compiling auth path whitelist regexp %q", config.PathWhitelistRegexp)))
+		}
+	}
+
+	logger.Info().Log(
+		"msg", "enabling authentication middleware",
+		"methods", strings.Join(methods, ","),
+		"optional", config.Optional,
+		"user_agent_whitelist", config.UserAgentWhitelistRegexp,
+		"path_whitelist", config.PathWhitelistRegexp,
+	)
+
+	return auth.Middleware(auth.Config{
+		Authenticator: chain,
+		Realm:         config.Realm,
+		Optional:      config.Optional,
+		Skip: func(r *http.Request) bool {
+			return (userAgentRegexp != nil && userAgentRegexp.MatchString(r.Header.Get("User-Agent"))) ||
+				(pathRegexp != nil && pathRegexp.MatchString(r.URL.Path))
+		},
+	})
+}
+
+// loadVaultAPIKeys loads API keys from the Vault secret at path
+// whenever the Vault client authenticates. Keys configured in the
+// environment are replaced by the Vault keys.
+func loadVaultAPIKeys(client *vault.Client, path string, apiKeys *auth.APIKeys, logger log.Logger) {
+	if client == nil {
+		panic(errors.Errorf("nil vault client when configured to load API keys from %q", path))
+	}
+
+	l := logger.With("during", "appkit/service.loadVaultAPIKeys", "path", path)
+
+	client.OnAuth(func() error {
+		secret, err := client.Logical().Read(path)
+		if err != nil {
+			l.WithError(errors.Wrap(err, "error fetching API keys")).Log()
+			return nil
+		} else if secret == nil {
+			l.WithError(errors.New("vault client returned nil secret")).Log()
+			return nil
+		}
+
+		data := secret.Data
+		// KV version 2 secrets nest the fields under `data`
+		if nested, ok := data["data"].(map[string]interface{}); ok {
+			data = nested
+		}
+
+		keys := map[string]string{}
+		for name, key := range data {
+			if key, ok := key.(string); ok && key != "" {
+				keys[name] = key
+			}
+		}
+
+		apiKeys.SetKeys(keys)
+
+		l.Info().Log(
+			"msg", fmt.Sprintf("loaded %d API keys from vault", len(keys)),
+		)
+
+		return nil
+	})
+}
+
+////////////////////////////////////////////////////////////
+// Client IP
+
+type clientIPConfig struct {
+	// comma-separated CIDRs or IP addresses
+	TrustedProxies string
+	// comma-separated, eg. "X-Forwarded-For,X-Real-IP"
+	Headers string
+}
+
+func clientIPMiddleware(logger log.Logger) server.Middleware {
+	config := clientIPConfig{}
+
+	err := configor.New(&configor.Config{ENVPrefix: "CLIENTIP"}).Load(&config)
+	if err != nil {
+		panic(err)
+	}
+
+	if config.TrustedProxies == "" {
+		logger.Info().Log(
+			"msg", "not enabling client IP middleware: no trusted proxies configured, using default private network proxies",
+		)
+		return server.IdMiddleware
+	}
+
+	resolver, err := contexts.NewClientIPResolver(contexts.ClientIPConfig{
+		TrustedProxies: splitTrimmed(config.TrustedProxies),
+		Headers:        splitTrimmed(config.Headers),
+	})
+	if err != nil {
+		panic(errors.Wrap(err, "error configuring client IP resolution"))
+	}
+
+	logger.Info().Log(
+		"msg", "enabling client IP middleware",
+		"trusted_proxies", config.TrustedProxies,
+		"headers", config.Headers,
+	)
+
+	return contexts.WithClientIP(resolver)
+}
+
+func splitTrimmed(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 ////////////////////////////////////////////////////////////
 // AWS Config in request context
 
@@ -276,8 +507,15 @@ type hstsConfig struct {
 	// seconds
 	MaxAge            int
 	IncludeSubDomains bool
+	// requires a MaxAge of at least hstsPreloadMinMaxAge, and
+	// IncludeSubDomains
+	Preload bool
 }
 
+// hstsPreloadMinMaxAge is the minimum max-age (a year, in seconds)
+// accepted by https://hstspreload.org
+const hstsPreloadMinMaxAge = 365 * 24 * 60 * 60
+
 func hstsMiddleware(logger log.Logger) server.Middleware {
 	config := hstsConfig{}
 
@@ -295,20 +533,28 @@ func hstsMiddleware(logger log.Logger) server.Middleware {
 		return server.IdMiddleware
 	}
 
+	if config.Preload && (config.MaxAge < hstsPreloadMinMaxAge || !config.IncludeSubDomains) {
+		panic(errors.Errorf("HSTS_Preload requires a HSTS_MaxAge of at least %d (a year) and HSTS_IncludeSubDomains", hstsPreloadMinMaxAge))
+	}
+
 	hstsVal := fmt.Sprintf("max-age=%d", config.MaxAge)
 	if config.IncludeSubDomains {
 		hstsVal += "; includeSubDomains"
 	}
+	if config.Preload {
+		hstsVal += "; preload"
+	}
 
 	logger.Info().Log(
 		"msg", "enabling HSTS middleware",
 		"max_age", config.MaxAge,
 		"include_sub_domains", config.IncludeSubDomains,
+		"preload", config.Preload,
 	)
 
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Add("Strict-Transport-Security", hstsVal)
+			w.Header().Set("Strict-Transport-Security", hstsVal)
 			h.ServeHTTP(w, r)
 		})
 	}
@@ -365,7 +611,7 @@ func avoidClickjackingMiddleware(logger log.Logger) server.Middleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if xfoVal != "" {
-				w.Header().Add("X-Frame-Options", xfoVal)
+				w.Header().Set("X-Frame-Options", xfoVal)
 			}
 			if cspVal != "" {
 				w.Header().Add("Content-Security-Policy", cspVal)
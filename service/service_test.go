@@ -6,8 +6,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/theplant/appkit/log"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // ADDR -> PORT -> 9800 fallback
@@ -129,6 +133,78 @@ func TestBasicAuth(t *testing.T) {
 	}
 }
 
+func TestAuth(t *testing.T) {
+	os.Setenv("AUTH_APIKEYS", "ci:ci-key")
+	defer func() { os.Unsetenv("AUTH_APIKEYS") }()
+
+	os.Setenv("AUTH_PATHWHITELISTREGEXP", "^/healthz$")
+	defer func() { os.Unsetenv("AUTH_PATHWHITELISTREGEXP") }()
+
+	os.Setenv("BASICAUTH_USERNAME", "username")
+	defer func() { os.Unsetenv("BASICAUTH_USERNAME") }()
+
+	os.Setenv("BASICAUTH_PASSWORD", "password")
+	defer func() { os.Unsetenv("BASICAUTH_PASSWORD") }()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(htpasswd, []byte(fmt.Sprintf("alice:%s\n", hash)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("AUTH_HTPASSWDFILE", htpasswd)
+	defer func() { os.Unsetenv("AUTH_HTPASSWDFILE") }()
+
+	ctx, c := serviceContext()
+	defer c.Close()
+
+	m, c2, err := middleware(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+
+	cases := []struct {
+		name     string
+		path     string
+		setup    func(r *http.Request)
+		expected int
+	}{
+		{name: "api key", path: "/", setup: func(r *http.Request) { r.Header.Set("Authorization", "Bearer ci-key") }, expected: 204},
+		{name: "basic auth", path: "/", setup: func(r *http.Request) { r.SetBasicAuth("username", "password") }, expected: 204},
+		{name: "htpasswd", path: "/", setup: func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, expected: 204},
+		{name: "wrong basic auth password", path: "/", setup: func(r *http.Request) { r.SetBasicAuth("username", "secret") }, expected: 401},
+		{name: "unknown basic auth user", path: "/", setup: func(r *http.Request) { r.SetBasicAuth("bob", "secret") }, expected: 401},
+		{name: "wrong api key", path: "/", setup: func(r *http.Request) { r.Header.Set("X-API-Key", "wrong") }, expected: 401},
+		{name: "no credentials", path: "/", expected: 401},
+		{name: "whitelisted path", path: "/healthz", expected: 204},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", c.path, nil)
+			if c.setup != nil {
+				c.setup(r)
+			}
+
+			w := httptest.ResponseRecorder{}
+
+			h.ServeHTTP(&w, r)
+
+			if w.Code != c.expected {
+				t.Fatalf("unexpected status code, wanted %d, got %d", c.expected, w.Code)
+			}
+		})
+	}
+}
+
 func TestCORS(t *testing.T) {
 	// Loose testing of CORS configuration
 	os.Setenv("CORS_RawAllowedOrigins", "cors1.example.com,cors2.example.com")
@@ -178,3 +254,32 @@ func TestCORS(t *testing.T) {
 		})
 	}
 }
+
+func TestHSTSPreload(t *testing.T) {
+	os.Setenv("HSTS_MAXAGE", "300")
+	defer func() { os.Unsetenv("HSTS_MAXAGE") }()
+
+	os.Setenv("HSTS_PRELOAD", "true")
+	defer func() { os.Unsetenv("HSTS_PRELOAD") }()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected HSTS preload without a year's max-age and includeSubDomains to panic")
+			}
+		}()
+		hstsMiddleware(log.NewNopLogger())
+	}()
+
+	os.Setenv("HSTS_MAXAGE", "31536000")
+	os.Setenv("HSTS_INCLUDESUBDOMAINS", "true")
+	defer func() { os.Unsetenv("HSTS_INCLUDESUBDOMAINS") }()
+
+	h := hstsMiddleware(log.NewNopLogger())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if hsts := w.Header().Get("Strict-Transport-Security"); hsts != "max-age=31536000; includeSubDomains; preload" {
+		t.Errorf("unexpected Strict-Transport-Security %q", hsts)
+	}
+}